@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// accuracyHorizons are the buckets predictions are scored in, by how
+// far ahead of the arrival they were made.
+var accuracyHorizons = []struct {
+	Name string
+	Max  time.Duration
+}{
+	{"0-5m", 5 * time.Minute},
+	{"5-10m", 10 * time.Minute},
+	{"10-20m", 20 * time.Minute},
+	{"20m+", 24 * time.Hour},
+}
+
+// arrivalSlack is how far past its last predicted arrival a stop time
+// update can drop out of the feed and still count as having arrived.
+// Updates that drop out earlier than that were canceled or reassigned,
+// not served, and aren't scored.
+const arrivalSlack = 2 * time.Minute
+
+type tripStop struct {
+	trip, stop string
+}
+
+type predictionSample struct {
+	made    time.Time
+	arrival time.Time
+}
+
+// observedArrival is a trip's arrival at a stop, as inferred from the
+// trip updates feed.
+type observedArrival struct {
+	TripID  string
+	StopID  string
+	RouteID string
+	At      time.Time
+}
+
+type pendingArrival struct {
+	route   string
+	samples []predictionSample
+}
+
+type horizonAccuracy struct {
+	Horizon string `json:"horizon"`
+	Count   int    `json:"count"`
+
+	// MeanAbsError is in seconds.
+	MeanAbsError float64 `json:"mean_abs_error"`
+
+	// Within60s is the fraction of predictions within a minute of the
+	// arrival.
+	Within60s float64 `json:"within_60s"`
+
+	sumAbs time.Duration
+	within int
+}
+
+type routeAccuracy struct {
+	RouteID  string             `json:"route_id"`
+	Horizons []*horizonAccuracy `json:"horizons"`
+}
+
+// accuracyTracker scores the trip updates feed against itself.  Every
+// prediction for a trip's arrival at a stop is kept until the stop
+// drops out of the feed; the last prediction before then is taken as
+// when the bus actually arrived, and each earlier prediction is scored
+// by how far off it was.  Scores accumulate from startup.
+type accuracyTracker struct {
+	db *sqlx.DB
+
+	mu      sync.Mutex
+	pending map[tripStop]*pendingArrival
+	routes  map[string]*routeAccuracy
+}
+
+func newAccuracyTracker(db *sqlx.DB) *accuracyTracker {
+	return &accuracyTracker{
+		db:      db,
+		pending: map[tripStop]*pendingArrival{},
+		routes:  map[string]*routeAccuracy{},
+	}
+}
+
+// run scores each trip updates snapshot as it arrives, passing the
+// arrivals it observes on to otp.
+func (t *accuracyTracker) run(events *eventBus, otp *otpTracker) {
+	ch := events.subscribe(predictionsUpdated)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		ctx := context.Background()
+		arrivals, err := t.update(ctx, feedNow())
+		if err != nil {
+			slog.Error("error scoring predictions", "err", err)
+			continue
+		}
+		if err := otp.record(ctx, arrivals); err != nil {
+			slog.Error("error recording on-time performance", "err", err)
+		}
+	}
+}
+
+// update adds a trip updates snapshot, returning the arrivals it
+// completed.
+func (t *accuracyTracker) update(ctx context.Context, now time.Time) ([]observedArrival, error) {
+	var rows []struct {
+		TripID      string `db:"trip_id"`
+		StopID      string `db:"stop_id"`
+		RouteID     string `db:"route_id"`
+		ArrivalTime int64  `db:"arrival_time"`
+	}
+	const q = `SELECT stu.trip_id, stu.stop_id, trips.route_id, stu.arrival_time
+		   FROM stop_time_updates AS stu
+		   INNER JOIN trips ON stu.trip_id = trips.trip_id
+		   WHERE stu.arrival_time > 0`
+	if err := dbSelect(ctx, t.db, "scored predictions", &rows, q); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[tripStop]bool, len(rows))
+	for _, r := range rows {
+		k := tripStop{r.TripID, r.StopID}
+		seen[k] = true
+
+		p := t.pending[k]
+		if p == nil {
+			p = &pendingArrival{route: r.RouteID}
+			t.pending[k] = p
+		}
+		p.samples = append(p.samples, predictionSample{made: now, arrival: time.Unix(r.ArrivalTime, 0)})
+	}
+
+	var arrivals []observedArrival
+	for k, p := range t.pending {
+		if seen[k] {
+			continue
+		}
+		delete(t.pending, k)
+
+		arrived := p.samples[len(p.samples)-1].arrival
+		if now.Sub(arrived) > arrivalSlack || arrived.Sub(now) > arrivalSlack {
+			continue
+		}
+		t.score(p.route, arrived, p.samples[:len(p.samples)-1])
+		arrivals = append(arrivals, observedArrival{TripID: k.trip, StopID: k.stop, RouteID: p.route, At: arrived})
+	}
+	return arrivals, nil
+}
+
+func (t *accuracyTracker) score(route string, arrived time.Time, samples []predictionSample) {
+	ra := t.routes[route]
+	if ra == nil {
+		ra = &routeAccuracy{RouteID: route}
+		for _, h := range accuracyHorizons {
+			ra.Horizons = append(ra.Horizons, &horizonAccuracy{Horizon: h.Name})
+		}
+		t.routes[route] = ra
+	}
+
+	for _, s := range samples {
+		ahead := arrived.Sub(s.made)
+		if ahead < 0 {
+			continue
+		}
+		i := sort.Search(len(accuracyHorizons), func(i int) bool { return ahead < accuracyHorizons[i].Max })
+		if i == len(accuracyHorizons) {
+			continue
+		}
+
+		off := s.arrival.Sub(arrived).Abs()
+		h := ra.Horizons[i]
+		h.Count++
+		h.sumAbs += off
+		if off <= time.Minute {
+			h.within++
+		}
+		h.MeanAbsError = h.sumAbs.Seconds() / float64(h.Count)
+		h.Within60s = float64(h.within) / float64(h.Count)
+	}
+}
+
+// get returns the scores for route, or for every route if route is
+// empty.
+func (t *accuracyTracker) get(route string) []routeAccuracy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := []routeAccuracy{}
+	for id, ra := range t.routes {
+		if route != "" && id != route {
+			continue
+		}
+		c := routeAccuracy{RouteID: id}
+		for _, h := range ra.Horizons {
+			hc := *h
+			c.Horizons = append(c.Horizons, &hc)
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].RouteID < out[j].RouteID })
+	return out
+}
+
+func handleAccuracy(t *accuracyTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(t.get(req.FormValue("route")))
+	}
+}
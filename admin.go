@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminAuth only lets requests through that carry the admin token as a
+// bearer token.  With no token configured the admin endpoints are
+// disabled entirely.
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if token == "" {
+			writeError(rw, http.StatusNotFound, "Admin endpoints are disabled")
+			return
+		}
+
+		got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="cota-bus admin"`)
+			writeError(rw, http.StatusUnauthorized, "Missing or invalid admin token")
+			return
+		}
+
+		next(rw, req)
+	}
+}
+
+func handleReload(loader *gtfsLoader) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if loader.frozen {
+			writeError(rw, http.StatusConflict, "Static GTFS is frozen with -gtfs-frozen")
+			return
+		}
+
+		start := time.Now()
+		if err := loader.Load(req.Context()); err != nil {
+			writeError(rw, http.StatusInternalServerError, "Reload failed: "+err.Error())
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(map[string]interface{}{
+			"status":   "ok",
+			"duration": time.Since(start).String(),
+		})
+	}
+}
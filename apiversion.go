@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The API is served under /vN/ for each version up to
+// currentAPIVersion.  Unversioned paths are aliases for
+// defaultAPIVersion, which stays at 1 so clients written before
+// versioning never see a change.
+const (
+	currentAPIVersion = 1
+	defaultAPIVersion = 1
+)
+
+// versionedPaths serves /vN/path as path, and tells clients which
+// version answered in an API-Version header.
+func versionedPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		version, rest, ok := splitVersion(req.URL.Path)
+		if !ok {
+			rw.Header().Set("API-Version", strconv.Itoa(defaultAPIVersion))
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if version < 1 || version > currentAPIVersion {
+			http.NotFound(rw, req)
+			return
+		}
+
+		rw.Header().Set("API-Version", strconv.Itoa(version))
+		// The original request, which the access log reports, keeps
+		// its URL.
+		u := *req.URL
+		u.Path, u.RawPath = rest, ""
+		r := *req
+		r.URL = &u
+		next.ServeHTTP(rw, &r)
+	})
+}
+
+// splitVersion splits /v1/cota/stops into 1 and /cota/stops.
+func splitVersion(path string) (int, string, bool) {
+	seg, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(seg) < 2 || seg[0] != 'v' {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(seg[1:])
+	if err != nil {
+		return 0, "", false
+	}
+	return n, "/" + rest, true
+}
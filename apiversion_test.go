@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitVersion(t *testing.T) {
+	tests := []struct {
+		path    string
+		version int
+		rest    string
+		ok      bool
+	}{
+		{"/v1/cota/stops", 1, "/cota/stops", true},
+		{"/v2/cota/stops", 2, "/cota/stops", true},
+		{"/v1", 1, "/", true},
+		{"/cota/stops", 0, "", false},
+		{"/v/cota/stops", 0, "", false},
+		{"/vx/cota/stops", 0, "", false},
+		{"/version", 0, "", false},
+	}
+	for _, tt := range tests {
+		version, rest, ok := splitVersion(tt.path)
+		if version != tt.version || rest != tt.rest || ok != tt.ok {
+			t.Errorf("splitVersion(%q) = %d, %q, %v, want %d, %q, %v", tt.path, version, rest, ok, tt.version, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestVersionedPaths(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cota/stops", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("stops " + req.URL.Query().Get("route")))
+	})
+	mux.HandleFunc("/version", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("version"))
+	})
+	h := versionedPaths(mux)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if target == "/v1/cota/stops?route=2" && req.URL.Path != "/v1/cota/stops" {
+			t.Errorf("original request's path changed to %s", req.URL.Path)
+		}
+		return rw
+	}
+
+	unversioned := get("/cota/stops?route=2")
+	versioned := get("/v1/cota/stops?route=2")
+	if unversioned.Code != http.StatusOK || unversioned.Body.String() != "stops 2" {
+		t.Errorf("/cota/stops = %d %q", unversioned.Code, unversioned.Body)
+	}
+	if versioned.Code != unversioned.Code || versioned.Body.String() != unversioned.Body.String() {
+		t.Errorf("/v1/cota/stops = %d %q, want the same as /cota/stops", versioned.Code, versioned.Body)
+	}
+	for _, rw := range []*httptest.ResponseRecorder{unversioned, versioned} {
+		if v := rw.Header().Get("API-Version"); v != "1" {
+			t.Errorf("API-Version = %q, want 1", v)
+		}
+	}
+	if rw := get("/version"); rw.Code != http.StatusOK || rw.Body.String() != "version" {
+		t.Errorf("/version = %d %q", rw.Code, rw.Body)
+	}
+
+	for _, target := range []string{"/v2/cota/stops", "/v0/cota/stops", "/v/cota/stops"} {
+		if rw := get(target); rw.Code != http.StatusNotFound {
+			t.Errorf("%s = %d, want 404", target, rw.Code)
+		}
+	}
+}
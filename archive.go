@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type archivedVehicle struct {
+	FetchedAt time.Time `db:"-" json:"fetched_at"`
+	VehicleID string    `db:"vehicle_id" json:"vehicle_id"`
+	Label     string    `db:"vehicle_label" json:"vehicle_label"`
+	TripID    string    `db:"trip_id" json:"trip_id"`
+	Latitude  float64   `db:"latitude" json:"latitude"`
+	Longitude float64   `db:"longitude" json:"longitude"`
+	Feed      string    `db:"feed_source" json:"feed_source"`
+	Occupancy string    `db:"occupancy_status" json:"occupancy_status"`
+}
+
+type archivedStopTimeUpdate struct {
+	FetchedAt   time.Time `db:"-" json:"fetched_at"`
+	StopID      string    `db:"stop_id" json:"stop_id"`
+	TripID      string    `db:"trip_id" json:"trip_id"`
+	ArrivalTime int64     `db:"arrival_time" json:"arrival_time"` // Unix seconds
+	VehicleID   string    `db:"vehicle_id" json:"vehicle_id"`
+	Feed        string    `db:"feed_source" json:"feed_source"`
+
+	ScheduleRelationship string `db:"schedule_relationship" json:"schedule_relationship"`
+}
+
+// archiveRealtime copies every realtime snapshot into dir, each as its
+// own Parquet file, partitioned by date and hour so that query engines
+// can skip what they don't need:
+//
+//	dir/vehicle_positions/date=2024-05-01/hour=13/20240501T130000.000Z.parquet
+//	dir/stop_time_updates/date=2024-05-01/hour=13/20240501T130000.000Z.parquet
+//
+// dir may be an s3 or gs URL.
+func archiveRealtime(db *sqlx.DB, events *eventBus, dir string) {
+	ch := events.subscribe(vehiclesUpdated, predictionsUpdated)
+	defer events.unsubscribe(ch)
+
+	for e := range ch {
+		now := feedNow().UTC()
+		ctx := context.Background()
+
+		var err error
+		switch e {
+		case vehiclesUpdated:
+			rows := []archivedVehicle{}
+			const q = `SELECT vehicle_id, vehicle_label, trip_id, CAST(latitude AS REAL) AS latitude, CAST(longitude AS REAL) AS longitude, feed_source, occupancy_status FROM vehicle_positions`
+			if err = dbSelect(ctx, db, "archive vehicle positions", &rows, q); err == nil {
+				for i := range rows {
+					rows[i].FetchedAt = now
+				}
+				err = writeArchive(dir, "vehicle_positions", now, rows)
+			}
+
+		case predictionsUpdated:
+			rows := []archivedStopTimeUpdate{}
+			const q = `SELECT stop_id, trip_id, CAST(arrival_time AS INTEGER) AS arrival_time, vehicle_id, feed_source, schedule_relationship FROM stop_time_updates`
+			if err = dbSelect(ctx, db, "archive stop time updates", &rows, q); err == nil {
+				for i := range rows {
+					rows[i].FetchedAt = now
+				}
+				err = writeArchive(dir, "stop_time_updates", now, rows)
+			}
+		}
+		if err != nil {
+			slog.Error("error archiving realtime data", "event", e, "err", err)
+		}
+	}
+}
+
+// writeArchive writes rows to a Parquet file for the snapshot taken at
+// now.  Local files are written under a temporary name and renamed, so
+// readers never see one half-written.
+func writeArchive[T any](dir, table string, now time.Time, rows []T) error {
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, rows); err != nil {
+		return err
+	}
+
+	date, hour, name := "date="+now.Format("2006-01-02"), fmt.Sprintf("hour=%02d", now.Hour()), now.Format(recordTimeFormat)+".parquet"
+	if isObjectURL(dir) {
+		return putObject(context.Background(), objectJoin(dir, table, date, hour, name), buf.Bytes())
+	}
+
+	path := filepath.Join(dir, table, date, hour, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Query engines skip files whose names start with a dot.
+	tmp := filepath.Join(filepath.Dir(path), "."+name)
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// realtimePaths are the endpoints whose responses change with every
+// realtime update or with the time of day.  The other endpoints in
+// apiEndpoints only change when static data is reloaded.
+var realtimePaths = map[string]bool{
+	"/cota/vehicles":            true,
+	"/cota/predictions":         true,
+	"/cota/departures":          true,
+	"/cota/countdown":           true,
+	"/cota/trip-plans":          true,
+	"/cota/accuracy":            true,
+	"/cota/analytics/otp":       true,
+	"/cota/analytics/occupancy": true,
+}
+
+// cachePolicy sets Cache-Control on API responses, so caches and CDNs
+// in front of the server know how long each can be reused.
+type cachePolicy struct {
+	static, realtime time.Duration
+
+	// reloadHour and reloadMinute are the daily reload time, when
+	// reloadDaily is set, and checkEvery how often the source is
+	// checked for a new feed.  Static responses aren't cached past
+	// either.
+	reloadDaily              bool
+	reloadHour, reloadMinute int
+	checkEvery               time.Duration
+}
+
+// maxAge returns how long a response from path may be cached, or false
+// if it isn't an API endpoint.
+func (p *cachePolicy) maxAge(path string) (time.Duration, bool) {
+	if realtimePaths[path] {
+		return p.realtime, true
+	}
+
+	static := false
+	for _, e := range apiEndpoints {
+		static = static || e.Path == path
+	}
+	if !static {
+		return 0, false
+	}
+
+	age := p.static
+	if p.reloadDaily {
+		age = min(age, time.Until(nextTimeOfDay(time.Now(), p.reloadHour, p.reloadMinute)))
+	}
+	if p.checkEvery > 0 {
+		age = min(age, p.checkEvery)
+	}
+	// Routes carry today's service spans, which the server itself only
+	// caches for a minute.
+	if path == "/cota/routes" {
+		age = min(age, time.Minute)
+	}
+	return age, true
+}
+
+func (p *cachePolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		age, ok := p.maxAge(req.URL.Path)
+		if !ok || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		value := "no-cache"
+		if secs := int(age / time.Second); secs > 0 {
+			value = fmt.Sprintf("public, max-age=%d", secs)
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: rw, value: value}, req)
+	})
+}
+
+// cacheControlWriter sets Cache-Control as the response is written,
+// so errors aren't cached.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status == http.StatusOK {
+			w.Header().Set("Cache-Control", w.value)
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const usage = `usage: cota-bus [command] [flags] [args]
+
+Commands:
+  serve                          run the server (the default)
+  validate <gtfs>                validate a static GTFS feed
+  fetch-realtime [vehicles|trip-updates]
+                                 fetch and print COTA's realtime feeds
+  dump <stops|routes|vehicles>   print data from the database
+
+Run "cota-bus <command> -h" for a command's flags.
+`
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		serveCommand(args)
+	case "validate":
+		validateCommand(args)
+	case "fetch-realtime":
+		fetchRealtimeCommand(args)
+	case "dump":
+		dumpCommand(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// newCommandFlags returns a flag set for a command, with the logging
+// flags every command shares.
+func newCommandFlags(name, args string) (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: cota-bus %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	logLevel := fs.String("log-level", "warn", "log level: debug, info, warn, or error")
+	logJSON := fs.Bool("log-json", false, "write logs as JSON")
+
+	return fs, func() {
+		if err := setupLogging(*logLevel, *logJSON); err != nil {
+			fatal("invalid logging configuration", "err", err)
+		}
+	}
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fatal("error writing output", "err", err)
+	}
+}
+
+// validateCommand loads a static feed into a scratch database and
+// prints its validation report, exiting with status 1 if the feed
+// would be rejected.
+func validateCommand(args []string) {
+	fs, setup := newCommandFlags("validate", "<gtfs>")
+	maxErrors := fs.Int("max-errors", 0, "reject feeds with more than this many validation errors (negative never rejects)")
+	header := headerFlag{}
+	fs.Var(header, "header", "`Name: value` header to send when downloading an http(s) feed (repeatable; $VAR is expanded)")
+	fs.Parse(args)
+	setup()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	src := fs.Arg(0)
+	setFeedHeaders(src, header)
+	ctx := context.Background()
+
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		fatal("error opening scratch database", "err", err)
+	}
+	// Every connection to :memory: is a different database.
+	db.SetMaxOpenConns(1)
+
+	fsys, closeFeed, err := openGTFS(ctx, src)
+	if err != nil {
+		fatal("error opening GTFS", "src", redactURL(src), "err", err)
+	}
+	defer closeFeed()
+
+	l := &gtfsLoader{db: db, src: src, maxErrors: *maxErrors}
+	loaded, err := l.importAll(ctx, fsys)
+	if err != nil {
+		fatal("error importing GTFS", "src", redactURL(src), "err", err)
+	}
+	report, err := validateStaging(ctx, db, src, loaded)
+	if err != nil {
+		fatal("error validating GTFS", "src", redactURL(src), "err", err)
+	}
+	report.Rejected = *maxErrors >= 0 && report.Errors > *maxErrors
+
+	printJSON(report)
+	if report.Rejected {
+		os.Exit(1)
+	}
+}
+
+// fetchRealtimeCommand prints the realtime feeds as JSON.
+func fetchRealtimeCommand(args []string) {
+	fs, setup := newCommandFlags("fetch-realtime", "[vehicles|trip-updates]")
+	setFeeds := realtimeFeedFlags(fs)
+	fs.Parse(args)
+	setup()
+	if err := setFeeds(); err != nil {
+		fatal("invalid realtime feeds", "err", err)
+	}
+
+	feeds := map[string][]realtimeFeed{
+		"vehicles":     vehiclePositionsFeeds,
+		"trip-updates": tripUpdatesFeeds,
+	}
+	kinds := []string{"vehicles", "trip-updates"}
+	switch {
+	case fs.NArg() == 1 && feeds[fs.Arg(0)] != nil:
+		kinds = fs.Args()
+	case fs.NArg() != 0:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Messages are keyed by kind, or by kind/name for kinds with more
+	// than one feed.
+	out := map[string]*FeedMessage{}
+	for _, kind := range kinds {
+		for _, f := range feeds[kind] {
+			msg, err := f.source().FetchFeed(context.Background())
+			if err != nil {
+				fatal("error fetching realtime feed", "feed", kind, "name", f.Name, "err", err)
+			}
+			key := kind
+			if len(feeds[kind]) > 1 {
+				key += "/" + f.Name
+			}
+			out[key] = msg
+		}
+	}
+	if len(out) == 1 {
+		for _, msg := range out {
+			printJSON(msg)
+		}
+		return
+	}
+	printJSON(out)
+}
+
+// dumpCommand prints stops, routes, or vehicles from the database as
+// the API would return them.
+func dumpCommand(args []string) {
+	fs, setup := newCommandFlags("dump", "<stops|routes|vehicles>")
+	dbPath := fs.String("db", "cota-gtfs.db", "sqlite database to read")
+	fs.Parse(args)
+	setup()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+
+	db, err := sqlx.Open("sqlite3", "file:"+*dbPath+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		fatal("error opening database", "err", err)
+	}
+
+	switch fs.Arg(0) {
+	case "stops":
+		stops := &stopCache{}
+		if err := stops.refresh(ctx, db); err != nil {
+			fatal("error reading stops", "err", err)
+		}
+		printJSON(stops.all())
+
+	case "routes":
+		routes, err := selectRoutes(ctx, db, &serviceSpanCache{}, feedNow())
+		if err != nil {
+			fatal("error reading routes", "err", err)
+		}
+		printJSON(routes)
+
+	case "vehicles":
+		shapes := &shapeCache{}
+		if err := shapes.refresh(ctx, db); err != nil {
+			fatal("error reading shapes", "err", err)
+		}
+		vehicles, err := selectVehicles(ctx, db, shapes, "")
+		if err != nil {
+			fatal("error reading vehicles", "err", err)
+		}
+		printJSON(vehicles)
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy describes which cross-origin requests browsers should
+// allow.  An empty origin list disables CORS headers entirely.
+type corsPolicy struct {
+	Origins []string
+	Methods []string
+	Headers []string
+	MaxAge  time.Duration
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (p corsPolicy) allowOrigin(origin string) string {
+	for _, o := range p.Origins {
+		if o == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func (p corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		allowed := p.allowOrigin(origin)
+
+		if allowed != "" {
+			rw.Header().Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				rw.Header().Add("Vary", "Origin")
+			}
+			rw.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Feed-Version, X-Feed-Valid, X-Realtime-Updated, X-Realtime-Feed-Timestamp, API-Version, Deprecation, Sunset, Warning, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
+		}
+
+		// Answer preflight requests here rather than passing them on to
+		// handlers that only know about GET.
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed != "" {
+				rw.Header().Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+				if len(p.Headers) > 0 {
+					rw.Header().Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+				}
+				if p.MaxAge > 0 {
+					rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+				}
+			}
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// maxCountdown bounds the n argument to /cota/countdown.
+const maxCountdown = 10
+
+// countdownRow is deliberately terse, for signs with little memory to
+// parse JSON in.
+type countdownRow struct {
+	Route    string `json:"r"`
+	Headsign string `json:"h"`
+	Minutes  int    `json:"m"`
+
+	// Scheduled is 1 for arrivals from the schedule rather than a
+	// realtime prediction.
+	Scheduled int `json:"s"`
+}
+
+// handleCountdown lists the next few arrivals at a stop in minutes, as
+// compact JSON or, with format=text, one line per arrival:
+//
+//	2 Downtown 4
+//	10 Easton 12*
+//
+// where a trailing * marks an arrival from the schedule.
+func handleCountdown(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		stop := req.FormValue("stop")
+		if stop == "" {
+			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
+			return
+		}
+
+		n := 3
+		if v := req.FormValue("n"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i <= 0 || i > maxCountdown {
+				http.Error(rw, "n must be between 1 and 10", http.StatusBadRequest)
+				return
+			}
+			n = i
+		}
+
+		now := feedNow()
+		deps, err := departures(req.Context(), db, stop, now, timeWindow{from: now})
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(deps) > n {
+			deps = deps[:n]
+		}
+
+		rows := make([]countdownRow, len(deps))
+		for i, d := range deps {
+			rows[i] = countdownRow{
+				Route:    d.RouteShortName,
+				Headsign: d.TripHeadsign,
+				Minutes:  int(d.ArrivalTime / 60),
+			}
+			if d.Source == "scheduled" {
+				rows[i].Scheduled = 1
+			}
+		}
+
+		if req.FormValue("format") == "text" {
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			var b strings.Builder
+			for _, r := range rows {
+				mark := ""
+				if r.Scheduled == 1 {
+					mark = "*"
+				}
+				fmt.Fprintf(&b, "%s %s %d%s\n", r.Route, r.Headsign, r.Minutes, mark)
+			}
+			rw.Write([]byte(b.String()))
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(rows)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// maxDepartures bounds the limit argument to /cota/departures.
+const maxDepartures = 100
+
+type departure struct {
+	TripID         string `json:"trip_id"`
+	RouteID        string `json:"route_id"`
+	RouteShortName string `json:"route_short_name"`
+	TripHeadsign   string `json:"trip_headsign"`
+
+	// Time is when the vehicle arrives, and ArrivalTime is the number
+	// of seconds from now until then.
+	Time        time.Time `json:"time"`
+	ArrivalTime uint64    `json:"arrival_time"`
+
+	// Source is "realtime" or "scheduled".
+	Source string `json:"source"`
+
+	// Canceled is set on scheduled departures of trips the trip
+	// updates feed has canceled.
+	Canceled bool `json:"canceled"`
+
+	// Delay is how many seconds behind schedule a realtime departure
+	// is, negative if it is ahead.
+	Delay *int `json:"delay"`
+}
+
+// departures returns every arrival at stop within w, or within
+// scheduleLookahead of its start if it has no end, soonest first.
+// Trips with a realtime prediction use it; the rest fall back to the
+// schedule.
+func departures(ctx context.Context, db *sqlx.DB, stop string, now time.Time, w timeWindow) ([]departure, error) {
+	until := w.until(scheduleLookahead)
+
+	var realtime []struct {
+		TripID           string `db:"trip_id"`
+		RouteID          string `db:"route_id"`
+		RouteShortName   string `db:"route_short_name"`
+		TripHeadsign     string `db:"trip_headsign"`
+		ArrivalTime      int64  `db:"arrival_time"`
+		ScheduledArrival string `db:"scheduled_arrival"`
+	}
+	const q = `SELECT stu.trip_id, trips.route_id, routes.route_short_name, trips.trip_headsign, stu.arrival_time,
+		          COALESCE(st.arrival_time, '') AS scheduled_arrival
+		   FROM stop_time_updates AS stu
+		   INNER JOIN trips ON stu.trip_id = trips.trip_id
+		   INNER JOIN routes ON trips.route_id = routes.route_id
+		   LEFT JOIN stop_times AS st ON stu.trip_id = st.trip_id AND stu.stop_id = st.stop_id
+		   WHERE stu.stop_id = ? AND stu.arrival_time BETWEEN ? AND ?`
+	if err := dbSelect(ctx, db, "realtime departures", &realtime, q, stop, w.from.Unix(), until.Unix()); err != nil {
+		return nil, err
+	}
+
+	loc := agencyLocation(ctx, db)
+	out := []departure{}
+	seen := map[string]bool{}
+	for _, r := range realtime {
+		if seen[r.TripID] {
+			continue
+		}
+		seen[r.TripID] = true
+
+		at := time.Unix(r.ArrivalTime, 0).In(loc)
+		out = append(out, departure{
+			TripID:         r.TripID,
+			RouteID:        r.RouteID,
+			RouteShortName: r.RouteShortName,
+			TripHeadsign:   r.TripHeadsign,
+			Time:           at,
+			ArrivalTime:    uint64(at.Sub(now) / time.Second),
+			Source:         "realtime",
+			Delay:          scheduleDelay(at, r.ScheduledArrival, loc),
+		})
+	}
+
+	// Trips predicted outside the window are left out of it, rather
+	// than listed at their scheduled times: they have either already
+	// passed the stop or won't reach it in time.
+	var predicted []string
+	if err := dbSelect(ctx, db, "predicted trips", &predicted, `SELECT DISTINCT trip_id FROM stop_time_updates WHERE stop_id = ?`, stop); err != nil {
+		return nil, err
+	}
+	for _, t := range predicted {
+		seen[t] = true
+	}
+
+	scheduled, err := scheduledArrivals(ctx, db, stop, w.from, until.Sub(w.from))
+	if err != nil {
+		return nil, err
+	}
+	canceled, err := canceledTrips(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range scheduled {
+		if seen[a.TripID] {
+			continue
+		}
+		seen[a.TripID] = true
+
+		out = append(out, departure{
+			TripID:         a.TripID,
+			RouteID:        a.RouteID,
+			RouteShortName: a.RouteShortName,
+			TripHeadsign:   a.TripHeadsign,
+			Time:           a.At,
+			ArrivalTime:    uint64(a.At.Sub(now) / time.Second),
+			Source:         "scheduled",
+			Canceled:       canceled[a.TripID],
+		})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+func handleDepartures(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		stop := req.FormValue("stop")
+		if stop == "" {
+			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
+			return
+		}
+
+		limit := 20
+		if l := req.FormValue("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxDepartures {
+				http.Error(rw, "limit must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		now := feedNow()
+		window, err := parseTimeWindow(req, now)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		deps, err := departures(req.Context(), db, stop, now, window)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(deps) > limit {
+			deps = deps[:limit]
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(deps)
+	}
+}
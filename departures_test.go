@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// departuresGTFS is a feed with route 2 trips T1, T2, and T3 arriving
+// at HIGBRON at 08:10, 08:40, and 08:50 every day of 2024, in UTC.
+func departuresGTFS() fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	fsys["agency.txt"] = &fstest.MapFile{Data: []byte("agency_id,agency_name,agency_url,agency_timezone\nCOTA,COTA,https://www.cota.com,UTC\n")}
+	fsys["calendar.txt"] = &fstest.MapFile{Data: []byte("service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\nWK,1,1,1,1,1,1,1,20240101,20241231\n")}
+	fsys["routes.txt"] = &fstest.MapFile{Data: []byte("route_id,agency_id,route_short_name,route_long_name,route_type\n2,COTA,2,N High St,3\n")}
+	fsys["stops.txt"] = &fstest.MapFile{Data: []byte("stop_id,stop_name,stop_lat,stop_lon\nHIGBRON,High St & Broad St,39.962,-83.0\n")}
+	fsys["trips.txt"] = &fstest.MapFile{Data: []byte("route_id,service_id,trip_id,trip_headsign\n2,WK,T1,Downtown\n2,WK,T2,Downtown\n2,WK,T3,Downtown\n")}
+	fsys["stop_times.txt"] = &fstest.MapFile{Data: []byte("trip_id,arrival_time,departure_time,stop_id,stop_sequence\nT1,08:10:00,08:10:00,HIGBRON,1\nT2,08:40:00,08:40:00,HIGBRON,1\nT3,08:50:00,08:50:00,HIGBRON,1\n")}
+	return fsys
+}
+
+// TestCanceledTrips checks that scheduled arrivals of trips the trip
+// updates feed canceled are flagged rather than passed off as running.
+func TestCanceledTrips(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, departuresGTFS())
+
+	if _, err := db.Exec(`INSERT INTO stop_time_updates (stop_id, trip_id, arrival_time, vehicle_id, feed_source, schedule_relationship)
+		VALUES ('', 'T1', 0, '', 'cota', 'canceled')`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	w := timeWindow{from: now}
+
+	deps, err := departures(ctx, db, "HIGBRON", now, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 3 || deps[0].TripID != "T1" || !deps[0].Canceled || deps[1].Canceled || deps[2].Canceled {
+		t.Errorf("departures = %+v, want T1 canceled and T2 and T3 not", deps)
+	}
+
+	preds, err := scheduledPredictions(ctx, db, "HIGBRON", now, w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preds) != 2 || !preds[0].Canceled || preds[1].Canceled || preds[1].ArrivalTime != 40*60 {
+		t.Errorf("scheduled predictions = %+v, want the canceled 08:10 and the 08:40 after it", preds)
+	}
+}
+
+// TestDeparturesPredictedOutsideWindow checks that trips predicted to
+// arrive outside the window aren't listed at their scheduled times
+// inside it.
+func TestDeparturesPredictedOutsideWindow(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, departuresGTFS())
+
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	// T1 is running so late it arrives after the window, and T2 so
+	// early it has already passed the stop.
+	for trip, at := range map[string]time.Time{
+		"T1": now.Add(scheduleLookahead + 30*time.Minute),
+		"T2": now.Add(-5 * time.Minute),
+	} {
+		if _, err := db.Exec(`INSERT INTO stop_time_updates (stop_id, trip_id, arrival_time, vehicle_id, feed_source, schedule_relationship)
+			VALUES ('HIGBRON', ?, ?, '', 'cota', 'scheduled')`, trip, at.Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deps, err := departures(ctx, db, "HIGBRON", now, timeWindow{from: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].TripID != "T3" || deps[0].Source != "scheduled" {
+		t.Errorf("departures = %+v, want only T3 from the schedule", deps)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// deprecation marks an endpoint or parameter in apiEndpoints or
+// apiOperations as on its way out.  Responses that use it carry
+// Deprecation and, if a removal date is set, Sunset headers, along with
+// a Warning explaining what to do instead, and the OpenAPI document
+// marks it deprecated.
+type deprecation struct {
+	// Since is when it was deprecated.
+	Since time.Time
+
+	// Sunset is when it will stop working, or zero if no date is set.
+	Sunset time.Time
+
+	// Instead tells clients what to use in its place.
+	Instead string
+}
+
+func (d *deprecation) message(what string) string {
+	msg := what + " is deprecated"
+	if !d.Sunset.IsZero() {
+		msg += " and will be removed on " + d.Sunset.Format(time.DateOnly)
+	}
+	if d.Instead != "" {
+		msg += "; " + d.Instead
+	}
+	return msg
+}
+
+// deprecatedRoute is an endpoint that is deprecated or takes
+// deprecated parameters.
+type deprecatedRoute struct {
+	path       string
+	deprecated *deprecation
+	params     []apiParam
+}
+
+// deprecations sets the deprecation headers on requests to deprecated
+// endpoints and requests that give deprecated parameters.
+func deprecations(next http.Handler) http.Handler {
+	// Routes are found with a mux of their own so that operations
+	// match by method and path pattern, as they are registered.
+	mux := http.NewServeMux()
+	routes := map[string]deprecatedRoute{}
+	add := func(pattern string, r deprecatedRoute) {
+		if r.deprecated == nil && !slices.ContainsFunc(r.params, func(p apiParam) bool { return p.Deprecated != nil }) {
+			return
+		}
+		mux.Handle(pattern, next)
+		routes[pattern] = r
+	}
+	for _, e := range apiEndpoints {
+		add(e.Path, deprecatedRoute{e.Path, e.Deprecated, e.Params})
+	}
+	for _, o := range apiOperations {
+		add(o.Method+" "+o.Path, deprecatedRoute{o.Method + " " + o.Path, o.Deprecated, o.Params})
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, pattern := mux.Handler(req)
+		e, ok := routes[pattern]
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		var since, sunset time.Time
+		warn := func(d *deprecation, what string) {
+			if since.IsZero() || d.Since.Before(since) {
+				since = d.Since
+			}
+			if !d.Sunset.IsZero() && (sunset.IsZero() || d.Sunset.Before(sunset)) {
+				sunset = d.Sunset
+			}
+			rw.Header().Add("Warning", fmt.Sprintf("299 - %q", d.message(what)))
+		}
+
+		if e.deprecated != nil {
+			warn(e.deprecated, e.path)
+		}
+		query := req.URL.Query()
+		for _, p := range e.params {
+			if p.Deprecated != nil && query.Has(p.Name) {
+				warn(p.Deprecated, "The "+p.Name+" parameter")
+			}
+		}
+
+		if !since.IsZero() {
+			rw.Header().Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+		}
+		if !sunset.IsZero() {
+			rw.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
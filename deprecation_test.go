@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withDeprecatedFixtures replaces the documented endpoints with a
+// deprecated endpoint, an endpoint with a deprecated parameter, and a
+// deprecated operation, until the test ends.
+func withDeprecatedFixtures(t *testing.T) {
+	endpoints, operations := apiEndpoints, apiOperations
+	t.Cleanup(func() { apiEndpoints, apiOperations = endpoints, operations })
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	apiEndpoints = []apiEndpoint{
+		{
+			Path:       "/old",
+			Summary:    "Old",
+			Schema:     agency{},
+			SchemaName: "Agency",
+			Deprecated: &deprecation{Since: since, Sunset: since.AddDate(0, 6, 0), Instead: "use /new"},
+		},
+		{
+			Path:       "/new",
+			Summary:    "New",
+			Params:     []apiParam{{Name: "stop_code", Description: "Old name for code", Deprecated: &deprecation{Since: since, Instead: "use code"}}, {Name: "code"}},
+			Schema:     agency{},
+			SchemaName: "Agency",
+		},
+	}
+	apiOperations = []apiOperation{
+		{
+			Method:     http.MethodDelete,
+			Path:       "/things/{id}",
+			Summary:    "Remove a thing",
+			Params:     []apiParam{{Name: "id", Required: true}},
+			Status:     http.StatusNoContent,
+			Deprecated: &deprecation{Since: since},
+		},
+	}
+}
+
+func TestDeprecationHeaders(t *testing.T) {
+	withDeprecatedFixtures(t)
+	h := deprecations(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	tests := []struct {
+		method, target  string
+		deprecated      bool
+		sunset, warning string
+	}{
+		{"GET", "/old", true, "Mon, 01 Jul 2024 00:00:00 GMT", "/old is deprecated and will be removed on 2024-07-01; use /new"},
+		{"GET", "/new?stop_code=1", true, "", "The stop_code parameter is deprecated; use code"},
+		{"GET", "/new?code=1", false, "", ""},
+		{"DELETE", "/things/abc", true, "", "DELETE /things/{id} is deprecated"},
+		{"GET", "/things/abc", false, "", ""},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if got := rw.Header().Get("Deprecation"); (got != "") != tt.deprecated || (tt.deprecated && got != "@1704067200") {
+			t.Errorf("%s %s: Deprecation = %q", tt.method, tt.target, got)
+		}
+		if got := rw.Header().Get("Sunset"); got != tt.sunset {
+			t.Errorf("%s %s: Sunset = %q, want %q", tt.method, tt.target, got, tt.sunset)
+		}
+		if got := rw.Header().Get("Warning"); !strings.Contains(got, tt.warning) || (tt.warning == "") != (got == "") {
+			t.Errorf("%s %s: Warning = %q, want %q", tt.method, tt.target, got, tt.warning)
+		}
+	}
+}
+
+func TestDeprecationOpenAPI(t *testing.T) {
+	withDeprecatedFixtures(t)
+	paths := openAPIDocument()["paths"].(map[string]interface{})
+
+	op := func(path, method string) map[string]interface{} {
+		return paths[path].(map[string]interface{})[method].(map[string]interface{})
+	}
+	if old := op("/old", "get"); old["deprecated"] != true {
+		t.Errorf("/old = %v, want deprecated", old)
+	}
+	if op("/new", "get")["deprecated"] != nil {
+		t.Error("/new is marked deprecated")
+	}
+	params := op("/new", "get")["parameters"].([]interface{})
+	if p := params[0].(map[string]interface{}); p["deprecated"] != true {
+		t.Errorf("stop_code = %v, want deprecated", p)
+	}
+	if p := params[1].(map[string]interface{}); p["deprecated"] != nil {
+		t.Errorf("code = %v, want not deprecated", p)
+	}
+	if del := op("/things/{id}", "delete"); del["deprecated"] != true {
+		t.Errorf("DELETE /things/{id} = %v, want deprecated", del)
+	}
+}
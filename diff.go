@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stopMoveThreshold is how far a stop has to move between feed
+// versions to be reported.  Smaller changes are usually just rounding.
+const stopMoveThreshold = 10 // meters
+
+type stopMove struct {
+	StopID       string  `json:"stop_id"`
+	Name         string  `json:"name"`
+	OldLatitude  float64 `json:"old_latitude"`
+	OldLongitude float64 `json:"old_longitude"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Meters       float64 `json:"meters"`
+}
+
+type routeTripCount struct {
+	RouteID string `db:"route_id" json:"route_id"`
+	Before  int    `db:"old_trips" json:"before"`
+	After   int    `db:"new_trips" json:"after"`
+}
+
+// gtfsDiff describes what changed in the static schedule between the
+// data that was live and a newly loaded feed.
+type gtfsDiff struct {
+	Time          time.Time        `json:"time"`
+	OldVersion    string           `json:"old_version"`
+	NewVersion    string           `json:"new_version"`
+	RoutesAdded   []string         `json:"routes_added"`
+	RoutesRemoved []string         `json:"routes_removed"`
+	StopsAdded    []string         `json:"stops_added"`
+	StopsRemoved  []string         `json:"stops_removed"`
+	StopsMoved    []stopMove       `json:"stops_moved"`
+	TripsAdded    int              `json:"trips_added"`
+	TripsRemoved  int              `json:"trips_removed"`
+	RouteTrips    []routeTripCount `json:"route_trip_counts"`
+}
+
+// distanceMeters returns the great circle distance between two points.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000 // meters
+
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// diffStaging compares the live routes, stops, and trips tables with
+// their staging copies.  Tables that weren't loaded, or that have no
+// live copy yet, are left out.
+func diffStaging(ctx context.Context, db *sqlx.DB, oldVersion string, loaded []string) (*gtfsDiff, error) {
+	ctx, span := tracer.Start(ctx, "diff gtfs")
+	defer span.End()
+
+	d := &gtfsDiff{
+		Time:          time.Now(),
+		OldVersion:    oldVersion,
+		RoutesAdded:   []string{},
+		RoutesRemoved: []string{},
+		StopsAdded:    []string{},
+		StopsRemoved:  []string{},
+		StopsMoved:    []stopMove{},
+		RouteTrips:    []routeTripCount{},
+	}
+
+	// ids selects the values of col in table a but not table b.
+	ids := func(col, a, b string) ([]string, error) {
+		out := []string{}
+		err := db.SelectContext(ctx, &out, `SELECT `+col+` FROM `+a+` WHERE `+col+` NOT IN (SELECT `+col+` FROM `+b+`) ORDER BY `+col)
+		return out, err
+	}
+
+	// compare reports whether there are both old and new copies of
+	// table to compare.
+	compare := func(table string) bool {
+		var n int
+		db.GetContext(ctx, &n, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table)
+		return n > 0 && slices.Contains(loaded, table)
+	}
+
+	if slices.Contains(loaded, "feed_info") {
+		// feed_version is optional, so leave NewVersion empty if
+		// there isn't one.
+		db.GetContext(ctx, &d.NewVersion, `SELECT feed_version FROM `+stagingTable("feed_info")+` LIMIT 1`)
+	}
+
+	var err error
+	if compare("routes") {
+		if d.RoutesAdded, err = ids("route_id", stagingTable("routes"), "routes"); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		if d.RoutesRemoved, err = ids("route_id", "routes", stagingTable("routes")); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+	}
+
+	if compare("stops") {
+		if d.StopsAdded, err = ids("stop_id", stagingTable("stops"), "stops"); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		if d.StopsRemoved, err = ids("stop_id", "stops", stagingTable("stops")); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+
+		var moved []stopMove
+		rows, err := db.QueryContext(ctx, `SELECT n.stop_id, n.stop_name,
+			       CAST(o.stop_lat AS REAL), CAST(o.stop_lon AS REAL),
+			       CAST(n.stop_lat AS REAL), CAST(n.stop_lon AS REAL)
+			FROM `+stagingTable("stops")+` AS n
+			INNER JOIN stops AS o ON n.stop_id = o.stop_id
+			WHERE n.stop_lat != o.stop_lat OR n.stop_lon != o.stop_lon
+			ORDER BY n.stop_id`)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		for rows.Next() {
+			var m stopMove
+			if err := rows.Scan(&m.StopID, &m.Name, &m.OldLatitude, &m.OldLongitude, &m.Latitude, &m.Longitude); err != nil {
+				rows.Close()
+				endSpan(span, err)
+				return nil, err
+			}
+			m.Meters = math.Round(distanceMeters(m.OldLatitude, m.OldLongitude, m.Latitude, m.Longitude))
+			if m.Meters >= stopMoveThreshold {
+				moved = append(moved, m)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		if moved != nil {
+			d.StopsMoved = moved
+		}
+	}
+
+	if compare("trips") {
+		if err := db.GetContext(ctx, &d.TripsAdded, `SELECT COUNT(*) FROM `+stagingTable("trips")+` WHERE trip_id NOT IN (SELECT trip_id FROM trips)`); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		if err := db.GetContext(ctx, &d.TripsRemoved, `SELECT COUNT(*) FROM trips WHERE trip_id NOT IN (SELECT trip_id FROM `+stagingTable("trips")+`)`); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+
+		// SQLite has no full outer join, so count both sides under a
+		// union of their route IDs.
+		err := db.SelectContext(ctx, &d.RouteTrips, `WITH
+			    o AS (SELECT route_id, COUNT(*) AS n FROM trips GROUP BY route_id),
+			    n AS (SELECT route_id, COUNT(*) AS n FROM `+stagingTable("trips")+` GROUP BY route_id),
+			    r AS (SELECT route_id FROM o UNION SELECT route_id FROM n)
+			SELECT r.route_id, COALESCE(o.n, 0) AS old_trips, COALESCE(n.n, 0) AS new_trips
+			FROM r
+			LEFT JOIN o ON r.route_id = o.route_id
+			LEFT JOIN n ON r.route_id = n.route_id
+			WHERE COALESCE(o.n, 0) != COALESCE(n.n, 0)
+			ORDER BY r.route_id`)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func handleDiff(loader *gtfsLoader) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		d := loader.lastDiff()
+		if d == nil {
+			writeError(rw, http.StatusNotFound, "No GTFS reload has been compared yet")
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(d)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// feedEntities tracks the entities of a GTFS-realtime feed, for feeds
+// that set incrementality to DIFFERENTIAL.  Those only send entities
+// that changed, and deleted entities by ID alone, so the updaters merge
+// them into the table instead of replacing it.  To do that they need
+// the vehicle_id or trip_id each entity ID wrote its rows under.
+//
+// Each updater runs in a single goroutine, so there is no locking.
+type feedEntities struct {
+	// keys maps entity IDs to the key of their rows.
+	keys map[string]string
+
+	// baseline is set once a fetch has filled the table.  The first
+	// differential fetch in a process replaces the table, so rows left
+	// from before a restart, whose entity IDs are unknown, don't linger.
+	baseline bool
+}
+
+// vehicleEntities and tripEntities are by feed name.
+var (
+	vehicleEntities = map[string]*feedEntities{}
+	tripEntities    = map[string]*feedEntities{}
+)
+
+func entitiesFor(m map[string]*feedEntities, feed string) *feedEntities {
+	f := m[feed]
+	if f == nil {
+		f = &feedEntities{keys: map[string]string{}}
+		m[feed] = f
+	}
+	return f
+}
+
+// replace reports whether a fetch should replace the whole table
+// rather than merge into it, and forgets the entities if so.
+func (f *feedEntities) replace(msg *FeedMessage) bool {
+	if msg.GetHeader().GetIncrementality() == FeedHeader_DIFFERENTIAL && f.baseline {
+		return false
+	}
+	f.keys = map[string]string{}
+	f.baseline = true
+	return true
+}
+
+// deleted returns the key of the rows written by a deleted entity,
+// falling back to fallback if the entity was never seen.
+func (f *feedEntities) deleted(ent *FeedEntity, fallback string) string {
+	key, ok := f.keys[ent.GetId()]
+	delete(f.keys, ent.GetId())
+	if !ok {
+		key = fallback
+	}
+	return key
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// mobilityDatabaseCatalog is the Mobility Database's catalog of every
+// feed it knows about, which can be read without an account.
+const mobilityDatabaseCatalog = "https://files.mobilitydatabase.org/feeds_v2.csv"
+
+// transitlandFeedsAPI looks up feeds by onestop ID, with an API key.
+const transitlandFeedsAPI = "https://transit.land/api/v2/rest/feeds/"
+
+// discoveredFeeds are the current URLs of an agency's feeds, any of
+// which may be empty if the registry doesn't list one.
+type discoveredFeeds struct {
+	Static      string
+	Vehicles    string
+	TripUpdates string
+}
+
+// merge fills in feeds missing from f with those from o.
+func (f *discoveredFeeds) merge(o discoveredFeeds) {
+	if f.Static == "" {
+		f.Static = o.Static
+	}
+	if f.Vehicles == "" {
+		f.Vehicles = o.Vehicles
+	}
+	if f.TripUpdates == "" {
+		f.TripUpdates = o.TripUpdates
+	}
+}
+
+// discoverFeeds resolves Mobility Database IDs (mdb-123) and
+// Transitland onestop IDs (f-dp3-cota) to feed URLs.  A static feed's
+// Mobility Database ID also finds the realtime feeds that refer to it;
+// Transitland lists realtime feeds under their own onestop IDs, so
+// those have to be given too.
+func discoverFeeds(ctx context.Context, ids []string, transitlandKey string) (discoveredFeeds, error) {
+	var out discoveredFeeds
+	var mdb []string
+	for _, id := range ids {
+		switch {
+		case strings.HasPrefix(id, "mdb-"):
+			mdb = append(mdb, id)
+		case strings.HasPrefix(id, "f-"):
+			f, err := discoverTransitland(ctx, id, transitlandKey)
+			if err != nil {
+				return out, fmt.Errorf("looking up %s in Transitland: %w", id, err)
+			}
+			out.merge(f)
+		default:
+			return out, fmt.Errorf("%q is neither a Mobility Database ID (mdb-...) nor a Transitland onestop ID (f-...)", id)
+		}
+	}
+
+	if len(mdb) > 0 {
+		f, err := discoverMobilityDatabase(ctx, mdb)
+		if err != nil {
+			return out, fmt.Errorf("looking up %s in the Mobility Database: %w", strings.Join(mdb, ", "), err)
+		}
+		out.merge(f)
+	}
+	return out, nil
+}
+
+func discoveryGet(ctx context.Context, u string, header http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func discoverMobilityDatabase(ctx context.Context, ids []string) (discoveredFeeds, error) {
+	var out discoveredFeeds
+
+	body, err := discoveryGet(ctx, mobilityDatabaseCatalog, nil)
+	if err != nil {
+		return out, err
+	}
+	defer body.Close()
+
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return out, err
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range []string{"id", "data_type", "entity_type", "static_reference", "urls.direct_download", "urls.latest"} {
+		if _, ok := col[name]; !ok {
+			return out, fmt.Errorf("catalog has no %s column", name)
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i := col[name]; i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	found := map[string]bool{}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return out, err
+		}
+
+		id := field(rec, "id")
+		refersTo := false
+		for _, ref := range strings.Split(field(rec, "static_reference"), "|") {
+			refersTo = refersTo || want[strings.TrimSpace(ref)]
+		}
+		if !want[id] && !refersTo {
+			continue
+		}
+		found[id] = true
+
+		u := field(rec, "urls.latest")
+		if u == "" {
+			u = field(rec, "urls.direct_download")
+		}
+		switch field(rec, "data_type") {
+		case "gtfs":
+			if want[id] && out.Static == "" {
+				out.Static = u
+			}
+		case "gtfs_rt":
+			for _, entity := range strings.Split(field(rec, "entity_type"), "|") {
+				switch strings.TrimSpace(entity) {
+				case "vp":
+					if out.Vehicles == "" {
+						out.Vehicles = u
+					}
+				case "tu":
+					if out.TripUpdates == "" {
+						out.TripUpdates = u
+					}
+				}
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			return out, fmt.Errorf("no feed %s", id)
+		}
+	}
+	return out, nil
+}
+
+func discoverTransitland(ctx context.Context, id, key string) (discoveredFeeds, error) {
+	var out discoveredFeeds
+	if key == "" {
+		key = os.Getenv("TRANSITLAND_API_KEY")
+	}
+	if key == "" {
+		return out, errors.New("Transitland needs an API key")
+	}
+
+	body, err := discoveryGet(ctx, transitlandFeedsAPI+url.PathEscape(id), http.Header{"Apikey": {key}})
+	if err != nil {
+		return out, err
+	}
+	defer body.Close()
+
+	var resp struct {
+		Feeds []struct {
+			URLs struct {
+				StaticCurrent            string `json:"static_current"`
+				RealtimeVehiclePositions string `json:"realtime_vehicle_positions"`
+				RealtimeTripUpdates      string `json:"realtime_trip_updates"`
+			} `json:"urls"`
+		} `json:"feeds"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return out, err
+	}
+	if len(resp.Feeds) == 0 {
+		return out, errors.New("no such feed")
+	}
+
+	urls := resp.Feeds[0].URLs
+	out.Static = urls.StaticCurrent
+	out.Vehicles = urls.RealtimeVehiclePositions
+	out.TripUpdates = urls.RealtimeTripUpdates
+	return out, nil
+}
+
+// setDiscoveredFlags points fs's -gtfs-url, -vehicles-url, and
+// -trip-updates-url at the discovered feeds, except where they were
+// given explicitly.
+func setDiscoveredFlags(fs *flag.FlagSet, f discoveredFeeds) {
+	explicit := map[string]bool{}
+	fs.Visit(func(fl *flag.Flag) { explicit[fl.Name] = true })
+
+	for _, d := range []struct{ flag, url string }{
+		{"gtfs-url", f.Static},
+		{"vehicles-url", f.Vehicles},
+		{"trip-updates-url", f.TripUpdates},
+	} {
+		if d.url == "" || explicit[d.flag] {
+			continue
+		}
+		fs.Set(d.flag, d.url)
+		slog.Info("discovered feed", "flag", d.flag, "url", redactURL(d.url))
+	}
+}
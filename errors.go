@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+type apiError struct {
+	Status string          `json:"status"`
+	Title  string          `json:"title"`
+	Detail string          `json:"detail,omitempty"`
+	Source *apiErrorSource `json:"source,omitempty"`
+}
+
+// apiErrorSource is the part of the request an error is about.
+type apiErrorSource struct {
+	Parameter string `json:"parameter,omitempty"`
+}
+
+// writeError writes a JSON:API style error document.
+func writeError(rw http.ResponseWriter, status int, detail string) {
+	writeErrors(rw, status, []apiError{{
+		Status: strconv.Itoa(status),
+		Title:  http.StatusText(status),
+		Detail: detail,
+	}})
+}
+
+// writeErrors writes a JSON:API style error document with several
+// errors.
+func writeErrors(rw http.ResponseWriter, status int, errs []apiError) {
+	rw.Header().Set("Content-Type", "application/vnd.api+json")
+	rw.WriteHeader(status)
+
+	enc := json.NewEncoder(rw)
+	enc.Encode(map[string][]apiError{"errors": errs})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// event is something that changed in the data we serve.
+type event int
+
+const (
+	vehiclesUpdated event = iota
+	predictionsUpdated
+	staticReloaded
+)
+
+func (e event) String() string {
+	switch e {
+	case vehiclesUpdated:
+		return "vehicles updated"
+	case predictionsUpdated:
+		return "predictions updated"
+	case staticReloaded:
+		return "static data reloaded"
+	}
+	return "unknown event"
+}
+
+// eventBus tells subscribers when the data changes, so they don't have
+// to poll the database.  Events are wakeups, not a queue: each
+// subscriber has at most one of each kind of event pending, so one that
+// falls behind gets a single event for several changes rather than
+// holding up the publisher, and should reread whatever it's interested
+// in.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan event]*subscription
+}
+
+// subscription is what a subscriber's channel is fed from.  Its
+// pending flags are guarded by the bus's mutex.
+type subscription struct {
+	want    map[event]bool
+	pending [staticReloaded + 1]bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[chan event]*subscription{}}
+}
+
+// subscribe returns a channel that receives the given events, or every
+// event if none are given.  It must be passed to unsubscribe when the
+// caller is done with it.
+func (b *eventBus) subscribe(events ...event) chan event {
+	s := &subscription{
+		want: map[event]bool{},
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	for _, e := range events {
+		s.want[e] = true
+	}
+	if len(events) == 0 {
+		s.want = nil
+	}
+
+	ch := make(chan event)
+	b.mu.Lock()
+	b.subs[ch] = s
+	b.mu.Unlock()
+
+	go b.deliver(ch, s)
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	if s, ok := b.subs[ch]; ok {
+		close(s.done)
+		delete(b.subs, ch)
+	}
+	b.mu.Unlock()
+}
+
+// deliver sends s's pending events to ch until it is unsubscribed.  An
+// event's flag is cleared before it is sent, so a change published
+// while the subscriber is busy is delivered after it.
+func (b *eventBus) deliver(ch chan event, s *subscription) {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+
+		for {
+			e, ok := event(0), false
+			b.mu.Lock()
+			for k := range s.pending {
+				if s.pending[k] {
+					e, ok = event(k), true
+					s.pending[k] = false
+					break
+				}
+			}
+			b.mu.Unlock()
+			if !ok {
+				break
+			}
+
+			select {
+			case ch <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (b *eventBus) publish(e event) {
+	slog.Debug("publishing event", "event", e)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.subs {
+		if s.want != nil && !s.want[e] {
+			continue
+		}
+		s.pending[e] = true
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
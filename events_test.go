@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBusCoalescesPerKind(t *testing.T) {
+	b := newEventBus()
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	// While the subscriber is busy, a burst of one kind must neither
+	// queue up nor crowd out another kind.
+	b.publish(vehiclesUpdated)
+	time.Sleep(10 * time.Millisecond)
+	for range 5 {
+		b.publish(vehiclesUpdated)
+	}
+	b.publish(staticReloaded)
+	b.publish(predictionsUpdated)
+
+	var got []event
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case e := <-ch:
+			got = append(got, e)
+			continue
+		case <-timeout:
+		}
+		break
+	}
+
+	want := []event{vehiclesUpdated, vehiclesUpdated, predictionsUpdated, staticReloaded}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type fare struct {
+	ID               string     `db:"fare_id" json:"fare_id"`
+	Price            string     `db:"price" json:"price"`
+	CurrencyType     string     `db:"currency_type" json:"currency_type"`
+	PaymentMethod    string     `db:"payment_method" json:"payment_method"`
+	Transfers        string     `db:"transfers" json:"transfers"`
+	TransferDuration string     `db:"transfer_duration" json:"transfer_duration"`
+	Rules            []fareRule `db:"-" json:"rules"`
+}
+
+type fareRule struct {
+	FareID        string `db:"fare_id" json:"-"`
+	RouteID       string `db:"route_id" json:"route_id"`
+	OriginID      string `db:"origin_id" json:"origin_id"`
+	DestinationID string `db:"destination_id" json:"destination_id"`
+	ContainsID    string `db:"contains_id" json:"contains_id"`
+}
+
+// handleFares lists the fare classes along with the rules that say
+// which routes and zones each applies to.  With a route argument only
+// fares that apply to that route, and only their rules for it, are
+// returned.
+func handleFares(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		route := req.FormValue("route")
+
+		fares := []fare{}
+		q := `SELECT fare_id, price, currency_type, payment_method, transfers, transfer_duration
+		      FROM fare_attributes`
+		var err error
+		if route != "" {
+			q += ` WHERE fare_id IN (SELECT fare_id FROM fare_rules WHERE route_id = ?)`
+			err = dbSelect(req.Context(), db, "fares", &fares, q, route)
+		} else {
+			err = dbSelect(req.Context(), db, "fares", &fares, q)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rules := []fareRule{}
+		q = `SELECT fare_id, route_id, origin_id, destination_id, contains_id FROM fare_rules`
+		if route != "" {
+			q += ` WHERE route_id = ?`
+			err = dbSelect(req.Context(), db, "fare rules", &rules, q, route)
+		} else {
+			err = dbSelect(req.Context(), db, "fare rules", &rules, q)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byID := map[string]*fare{}
+		for i := range fares {
+			fares[i].Rules = []fareRule{}
+			byID[fares[i].ID] = &fares[i]
+		}
+		for _, r := range rules {
+			if f := byID[r.FareID]; f != nil {
+				f.Rules = append(f.Rules, r)
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(fares)
+	}
+}
@@ -3,21 +3,37 @@ package main
 //go:generate protoc --gogo_out=import_path=main:. gtfs-realtime.proto
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	vehiclePositionsURL = "https://gtfs-rt.cota.vontascloud.com/TMGTFSRealTimeWebService/Vehicle/VehiclePositions.pb"
-	tripUpdatesURL      = "https://gtfs-rt.cota.vontascloud.com/TMGTFSRealTimeWebService/TripUpdate/TripUpdates.pb"
+	defaultVehiclePositionsURL = "https://gtfs-rt.cota.vontascloud.com/TMGTFSRealTimeWebService/Vehicle/VehiclePositions.pb"
+	defaultTripUpdatesURL      = "https://gtfs-rt.cota.vontascloud.com/TMGTFSRealTimeWebService/TripUpdate/TripUpdates.pb"
+)
+
+// The realtime feeds polled, set with -vehicles-url and
+// -trip-updates-url.
+var (
+	vehiclePositionsFeeds = []realtimeFeed{{Name: "cota", URL: defaultVehiclePositionsURL}}
+	tripUpdatesFeeds      = []realtimeFeed{{Name: "cota", URL: defaultTripUpdatesURL}}
 )
 
 type agency struct {
@@ -30,6 +46,10 @@ type route struct {
 	ID        string `db:"route_id" json:"route_id"`
 	LongName  string `db:"route_long_name" json:"long_name"`
 	ShortName string `db:"route_short_name" json:"short_name"`
+
+	// ServiceSpan is when the route runs in each direction on the
+	// current service day.  It is empty if the route doesn't run.
+	ServiceSpan []serviceSpan `db:"-" json:"service_span"`
 }
 
 type stop struct {
@@ -37,6 +57,24 @@ type stop struct {
 	Name      string `db:"stop_name" json:"name"`
 	Latitude  string `db:"stop_lat" json:"latitude"`
 	Longitude string `db:"stop_lon" json:"longitude"`
+
+	// Code is the short code posted at the stop, if the feed has one.
+	Code string `db:"stop_code" json:"code,omitempty"`
+
+	// ParentStation is the stop_id of the station this stop is part
+	// of, such as a bay at a transit center.
+	ParentStation string `db:"parent_station" json:"parent_station,omitempty"`
+
+	// Distance is in meters from the point of a nearby search.
+	Distance float64 `db:"-" json:"distance,omitempty"`
+}
+
+type transfer struct {
+	FromStopID      string `db:"from_stop_id" json:"from_stop_id"`
+	ToStopID        string `db:"to_stop_id" json:"to_stop_id"`
+	ToStopName      string `db:"to_stop_name" json:"to_stop_name"`
+	TransferType    string `db:"transfer_type" json:"transfer_type"`
+	MinTransferTime string `db:"min_transfer_time" json:"min_transfer_time"`
 }
 
 type vehicle struct {
@@ -44,8 +82,53 @@ type vehicle struct {
 	Name         string  `db:"vehicle_label" json:"name"`
 	TripHeadsign string  `db:"trip_headsign" json:"trip_headsign"`
 	RouteID      string  `db:"route_id" json:"route_id"`
+	ShapeID      string  `db:"shape_id" json:"shape_id"`
 	Latitude     float32 `db:"latitude" json:"latitude"`
 	Longitude    float32 `db:"longitude" json:"longitude"`
+
+	// Feed is the name of the realtime feed that reported the vehicle.
+	Feed string `db:"feed_source" json:"feed"`
+
+	// Distance is in meters from the point of a nearby search.
+	Distance float64 `db:"-" json:"distance,omitempty"`
+
+	// DistanceAlongShape is in the units of the feed's
+	// shape_dist_traveled, or meters if it has none.  Both are nil if
+	// the vehicle's trip has no shape.
+	DistanceAlongShape *float64 `db:"-" json:"distance_along_shape"`
+	Progress           *float64 `db:"-" json:"progress"`
+
+	// OffRoute is set when the vehicle is more than offRouteMeters
+	// from its trip's shape, as on a detour.
+	OffRoute bool `db:"-" json:"off_route"`
+
+	// Delay is how many seconds behind schedule the vehicle is
+	// predicted to reach its next stop, negative if it is ahead.  It
+	// is nil if there is no prediction for the vehicle.
+	Delay *int `db:"-" json:"delay"`
+}
+
+// offRouteMeters is how far a vehicle can be from its trip's shape
+// before it is flagged as off route.
+var offRouteMeters = 150.0
+
+// equal reports whether two vehicles have the same data.
+func (v vehicle) equal(o vehicle) bool {
+	floatEqual := func(a, b *float64) bool {
+		return a == b || (a != nil && b != nil && *a == *b)
+	}
+	return v.ID == o.ID &&
+		v.Name == o.Name &&
+		v.TripHeadsign == o.TripHeadsign &&
+		v.RouteID == o.RouteID &&
+		v.ShapeID == o.ShapeID &&
+		v.Latitude == o.Latitude &&
+		v.Longitude == o.Longitude &&
+		v.Feed == o.Feed &&
+		floatEqual(v.DistanceAlongShape, o.DistanceAlongShape) &&
+		floatEqual(v.Progress, o.Progress) &&
+		v.OffRoute == o.OffRoute &&
+		(v.Delay == o.Delay || (v.Delay != nil && o.Delay != nil && *v.Delay == *o.Delay))
 }
 
 type prediction struct {
@@ -53,223 +136,1143 @@ type prediction struct {
 	RouteID      string `db:"route_id" json:"route_id"`
 	TripHeadsign string `db:"trip_headsign" json:"trip_headsign"`
 	ArrivalTime  uint64 `db:"arrival_time" json:"arrival_time"`
+
+	// Scheduled is set when there is no realtime prediction for the
+	// route and ArrivalTime comes from the static schedule instead.
+	Scheduled bool `db:"-" json:"scheduled"`
+
+	// Delay is how many seconds behind schedule a realtime prediction
+	// is, negative if it is ahead.  It is nil for scheduled arrivals
+	// and stops with no stop time in the schedule.
+	Delay *int `db:"-" json:"delay"`
+
+	// Stale is set on realtime predictions from a trip updates feed
+	// that hasn't been updated in staleFeedAge.
+	Stale bool `db:"-" json:"stale"`
+
+	// Canceled is set on scheduled arrivals of trips the trip updates
+	// feed has canceled.
+	Canceled bool `db:"-" json:"canceled"`
+
+	ScheduledArrival string `db:"scheduled_arrival" json:"-"`
+
+	// ArrivalAt is the predicted arrival as a Unix time.
+	ArrivalAt int64 `db:"arrival_at" json:"-"`
 }
 
-func fetchProtobuf(url string) (*FeedMessage, error) {
-	resp, err := http.Get(url)
+// fetchProtobuf fetches and parses a GTFS-realtime feed, also returning
+// how long the upstream server took to respond.
+func fetchProtobuf(ctx context.Context, url string) (*FeedMessage, time.Duration, error) {
+	start := time.Now()
+
+	d, err := fetchURL(ctx, url)
+	latency := time.Since(start)
 	if err != nil {
-		return nil, err
+		return nil, latency, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+	_, span := tracer.Start(ctx, "parse feed")
+	var msg FeedMessage
+	err = proto.Unmarshal(d, &msg)
+	endSpan(span, err)
+	span.End()
+	if err != nil {
+		return nil, latency, err
 	}
 
-	d, err := ioutil.ReadAll(resp.Body)
+	slog.Debug("fetched feed",
+		"url", redactURL(url),
+		"bytes", len(d),
+		"entities", len(msg.Entity),
+		"duration", time.Since(start),
+	)
+
+	return &msg, latency, nil
+}
+
+// fetchURL fetches url and records what it got.
+func fetchURL(ctx context.Context, url string) ([]byte, error) {
+	d, err := fetchURLBody(ctx, url)
 	if err != nil {
 		return nil, err
 	}
+	recordFeed(url, d, time.Now())
+	return d, nil
+}
 
-	var msg FeedMessage
-	if err := proto.Unmarshal(d, &msg); err != nil {
+// fetchURLBody fetches url, or when replaying, returns its recording.
+func fetchURLBody(ctx context.Context, url string) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "fetch feed", trace.WithAttributes(semconv.URLFull(redactURL(url))))
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	if replay != nil {
+		return replay.fetch(url)
+	}
+
+	if isObjectURL(url) {
+		return getObject(ctx, url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
 		return nil, err
 	}
+	for name, values := range feedHeaders[url] {
+		req.Header[name] = values
+	}
+
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
 
-	return &msg, nil
+	return ioutil.ReadAll(resp.Body)
 }
 
-func updateVehiclePositions(db *sqlx.DB) error {
-	msg, err := fetchProtobuf(vehiclePositionsURL)
-	if err != nil {
+// createRealtimeTables creates the tables the realtime updaters write
+// to, as gtfs-load.sh does, so the server can start from an empty
+// database, along with occupancy_counts, which the occupancy tracker
+// keeps its counts in.
+func createRealtimeTables(db *sqlx.DB) error {
+	const schema = `
+		CREATE TABLE IF NOT EXISTS vehicle_positions (
+		    vehicle_id string PRIMARY KEY,
+		    vehicle_label string,
+		    trip_id string,
+		    latitude string,
+		    longitude string,
+		    feed_source string NOT NULL DEFAULT '',
+		    occupancy_status string NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS vehicle_positions_trip_id_idx ON vehicle_positions (trip_id);
+
+		CREATE TABLE IF NOT EXISTS stop_time_updates (
+		    stop_id string,
+		    trip_id string,
+		    arrival_time string,
+		    vehicle_id string,
+		    feed_source string NOT NULL DEFAULT '',
+		    schedule_relationship string NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS stop_time_updates_stop_id_idx ON stop_time_updates (stop_id);
+		CREATE INDEX IF NOT EXISTS stop_time_updates_trip_id_idx ON stop_time_updates (trip_id);
+		CREATE INDEX IF NOT EXISTS stop_time_updates_vehicle_id_idx ON stop_time_updates (vehicle_id);
+
+		CREATE TABLE IF NOT EXISTS occupancy_counts (
+		    day string NOT NULL,
+		    route_id string NOT NULL,
+		    stop_id string NOT NULL,
+		    hour integer NOT NULL,
+		    occupancy_status string NOT NULL,
+		    n integer NOT NULL,
+		    PRIMARY KEY (day, route_id, stop_id, hour, occupancy_status)
+		);`
+
+	if _, err := db.Exec(schema); err != nil {
 		return err
 	}
 
+	// Databases from before feeds were attributed lack feed_source,
+	// those from before occupancy was recorded occupancy_status, and
+	// those from before cancellations were recorded
+	// schedule_relationship.
+	for _, c := range []struct{ table, column string }{
+		{"vehicle_positions", "feed_source"},
+		{"stop_time_updates", "feed_source"},
+		{"vehicle_positions", "occupancy_status"},
+		{"stop_time_updates", "schedule_relationship"},
+	} {
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column); err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` string NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func updateVehiclePositions(ctx context.Context, db *sqlx.DB) (res updateResult, err error) {
+	ctx, span := tracer.Start(ctx, "update vehicle positions")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	fetched, res, err := fetchRealtimeFeeds(ctx, vehiclePositionsFeeds)
+	if err != nil {
+		return res, err
+	}
+
+	realtimeWrites.Lock()
+	defer realtimeWrites.Unlock()
+
 	tx, err := db.Beginx()
 	if err != nil {
-		return err
+		return res, err
 	}
 	defer tx.Commit()
 
-	if _, err := tx.Exec(`DELETE FROM vehicle_positions`); err != nil {
+	if err := clearRemovedFeeds(tx, "vehicle_positions", vehiclePositionsFeeds); err != nil {
 		tx.Rollback()
-		return err
+		return res, err
 	}
 
-	const q = `INSERT INTO vehicle_positions (
+	// Vehicles in differential feeds replace their existing rows.
+	const q = `INSERT OR REPLACE INTO vehicle_positions (
 		       vehicle_id,
 		       vehicle_label,
 		       trip_id,
 		       latitude,
-		       longitude)
-		   VALUES (?, ?, ?, ?, ?)`
-
-	for _, ent := range msg.Entity {
-		v := ent.Vehicle
-
-		if _, err := tx.Exec(
-			q,
-			v.Vehicle.GetId(),
-			v.Vehicle.GetLabel(),
-			v.Trip.GetTripId(),
-			v.Position.GetLatitude(),
-			v.Position.GetLongitude(),
-		); err != nil {
-			tx.Rollback()
-			return err
+		       longitude,
+		       feed_source,
+		       occupancy_status)
+		   VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	// vehicle_id is the primary key, so a vehicle that shows up in
+	// more than one entity, even in different feeds, would fail the
+	// whole update.  Keep the first.
+	seen := map[string]bool{}
+	var dups int
+	for _, f := range fetched {
+		source := f.feed.Name
+		entities := entitiesFor(vehicleEntities, source)
+		if entities.replace(f.msg) {
+			if _, err := tx.Exec(`DELETE FROM vehicle_positions WHERE feed_source = ?`, source); err != nil {
+				tx.Rollback()
+				return res, err
+			}
+		}
+
+		for _, ent := range f.msg.Entity {
+			if ent.GetIsDeleted() {
+				id := entities.deleted(ent, ent.GetVehicle().GetVehicle().GetId())
+				if _, err := tx.Exec(`DELETE FROM vehicle_positions WHERE vehicle_id = ? AND feed_source = ?`, id, source); err != nil {
+					tx.Rollback()
+					return res, err
+				}
+				continue
+			}
+
+			v := ent.Vehicle
+
+			id := v.Vehicle.GetId()
+			if seen[id] {
+				dups++
+				continue
+			}
+			seen[id] = true
+			entities.keys[ent.GetId()] = id
+
+			// Occupancy is optional, and absent isn't the same as
+			// EMPTY, which is the enum's zero value.
+			var occupancy string
+			if v.OccupancyStatus != nil {
+				occupancy = strings.ToLower(v.GetOccupancyStatus().String())
+			}
+
+			if _, err := tx.Exec(
+				q,
+				id,
+				v.Vehicle.GetLabel(),
+				v.Trip.GetTripId(),
+				v.Position.GetLatitude(),
+				v.Position.GetLongitude(),
+				source,
+				occupancy,
+			); err != nil {
+				tx.Rollback()
+				return res, err
+			}
 		}
 	}
 
-	return nil
+	if dups > 0 {
+		slog.Warn("duplicate vehicles in vehicle positions feed", "duplicates", dups)
+	}
+	slog.Debug("updated vehicle positions", "vehicles", len(seen))
+
+	return res, nil
 }
 
-func updateTripUpdates(db *sqlx.DB) error {
-	msg, err := fetchProtobuf(tripUpdatesURL)
+func updateTripUpdates(ctx context.Context, db *sqlx.DB) (res updateResult, err error) {
+	ctx, span := tracer.Start(ctx, "update trip updates")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	fetched, res, err := fetchRealtimeFeeds(ctx, tripUpdatesFeeds)
 	if err != nil {
-		return err
+		return res, err
 	}
 
+	realtimeWrites.Lock()
+	defer realtimeWrites.Unlock()
+
 	tx, err := db.Beginx()
 	if err != nil {
-		return err
+		return res, err
 	}
 	defer tx.Commit()
 
-	if _, err := tx.Exec(`DELETE FROM stop_time_updates`); err != nil {
+	if err := clearRemovedFeeds(tx, "stop_time_updates", tripUpdatesFeeds); err != nil {
 		tx.Rollback()
-		return err
+		return res, err
 	}
 
 	const q = `INSERT INTO stop_time_updates (
 		       stop_id,
 		       trip_id,
 		       arrival_time,
-		       vehicle_id)
-		   VALUES (?, ?, ?, ?)`
-
-	for _, ent := range msg.Entity {
-		tu := ent.TripUpdate
+		       vehicle_id,
+		       feed_source,
+		       schedule_relationship)
+		   VALUES (?, ?, ?, ?, ?, ?)`
 
-		for _, u := range tu.StopTimeUpdate {
-			if _, err := tx.Exec(
-				q,
-				u.GetStopId(),
-				tu.Trip.GetTripId(),
-				u.Arrival.GetTime(),
-				tu.Vehicle.GetId(),
-			); err != nil {
+	var trips, n int
+	for _, f := range fetched {
+		source := f.feed.Name
+		entities := entitiesFor(tripEntities, source)
+		replace := entities.replace(f.msg)
+		if replace {
+			if _, err := tx.Exec(`DELETE FROM stop_time_updates WHERE feed_source = ?`, source); err != nil {
 				tx.Rollback()
-				return err
+				return res, err
+			}
+		}
+
+		for _, ent := range f.msg.Entity {
+			// A trip in a differential feed replaces all of its
+			// stop time updates, or removes them if it was deleted.
+			if !replace {
+				trip := ent.GetTripUpdate().GetTrip().GetTripId()
+				if ent.GetIsDeleted() {
+					trip = entities.deleted(ent, trip)
+				}
+				if _, err := tx.Exec(`DELETE FROM stop_time_updates WHERE trip_id = ? AND feed_source = ?`, trip, source); err != nil {
+					tx.Rollback()
+					return res, err
+				}
+			}
+			if ent.GetIsDeleted() {
+				continue
+			}
+
+			tu := ent.TripUpdate
+			entities.keys[ent.GetId()] = tu.Trip.GetTripId()
+			trips++
+
+			// A canceled trip arrives nowhere, so it is recorded as a
+			// single row with no stop or arrival, which the queries
+			// for arrivals all pass over.
+			rel := strings.ToLower(tu.Trip.GetScheduleRelationship().String())
+			if tu.Trip.GetScheduleRelationship() == TripDescriptor_CANCELED {
+				if _, err := tx.Exec(q, "", tu.Trip.GetTripId(), 0, tu.Vehicle.GetId(), source, rel); err != nil {
+					tx.Rollback()
+					return res, err
+				}
+				continue
+			}
+
+			for _, u := range tu.StopTimeUpdate {
+				n++
+				if _, err := tx.Exec(
+					q,
+					u.GetStopId(),
+					tu.Trip.GetTripId(),
+					u.Arrival.GetTime(),
+					tu.Vehicle.GetId(),
+					source,
+					rel,
+				); err != nil {
+					tx.Rollback()
+					return res, err
+				}
 			}
 		}
 	}
 
-	return nil
+	slog.Debug("updated trip updates", "trips", trips, "stop_time_updates", n)
+
+	return res, nil
+}
+
+// selectVehicles returns the current vehicle positions, on route if it
+// isn't empty, along with how far each vehicle is along its shape and
+// whether it has strayed from it.
+func selectVehicles(ctx context.Context, db *sqlx.DB, shapes *shapeCache, route string) ([]vehicle, error) {
+	vehicles := []vehicle{}
+
+	q := `SELECT vp.vehicle_id, vp.vehicle_label, trips.trip_headsign, trips.route_id, trips.shape_id, vp.latitude, vp.longitude, vp.feed_source
+	      FROM vehicle_positions AS vp
+	      INNER JOIN trips ON vp.trip_id = trips.trip_id`
+
+	var err error
+	if route != "" {
+		q += ` WHERE trips.route_id = ? ORDER BY vp.vehicle_id`
+		err = dbSelect(ctx, db, "vehicles", &vehicles, q, route)
+	} else {
+		q += ` ORDER BY vp.vehicle_id`
+		err = dbSelect(ctx, db, "vehicles", &vehicles, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Each vehicle's delay is that of its next predicted stop.
+	var next []struct {
+		VehicleID        string `db:"vehicle_id"`
+		ArrivalTime      int64  `db:"arrival_time"`
+		ScheduledArrival string `db:"scheduled_arrival"`
+	}
+	const nq = `SELECT stu.vehicle_id, min(stu.arrival_time) AS arrival_time, COALESCE(st.arrival_time, '') AS scheduled_arrival
+		    FROM stop_time_updates AS stu
+		    LEFT JOIN stop_times AS st ON stu.trip_id = st.trip_id AND stu.stop_id = st.stop_id
+		    WHERE stu.vehicle_id != '' AND stu.arrival_time >= ?
+		    GROUP BY stu.vehicle_id`
+	if err := dbSelect(ctx, db, "vehicle delays", &next, nq, feedNow().Unix()); err != nil {
+		return nil, err
+	}
+	loc := agencyLocation(ctx, db)
+	delays := make(map[string]*int, len(next))
+	for _, n := range next {
+		delays[n.VehicleID] = scheduleDelay(time.Unix(n.ArrivalTime, 0), n.ScheduledArrival, loc)
+	}
+
+	for i, v := range vehicles {
+		vehicles[i].Delay = delays[v.ID]
+		if dist, progress, offset, ok := shapes.locate(v.ShapeID, float64(v.Latitude), float64(v.Longitude)); ok {
+			vehicles[i].DistanceAlongShape = &dist
+			vehicles[i].Progress = &progress
+			vehicles[i].OffRoute = offset > offRouteMeters
+		}
+	}
+
+	return vehicles, nil
 }
 
-func updateRealtimeData(db *sqlx.DB) {
+// realtimeUpdater is one kind of realtime data, with the function that
+// polls its feeds into table, the name its health is recorded under,
+// and the event published when the table changes.  Instances that
+// share realtime data share each updater's table.
+type realtimeUpdater struct {
+	table, name string
+	event       event
+	update      func(context.Context, *sqlx.DB) (updateResult, error)
+}
+
+var realtimeUpdaters = []realtimeUpdater{
+	{"vehicle_positions", "vehicle_positions", vehiclesUpdated, updateVehiclePositions},
+	{"stop_time_updates", "trip_updates", predictionsUpdated, updateTripUpdates},
+}
+
+// realtimeWrites serializes the updaters' transactions, which would
+// otherwise wait on each other's locks in sqlite.
+var realtimeWrites sync.Mutex
+
+func updateRealtimeData(db *sqlx.DB, events *eventBus, health *healthTracker, share *realtimeShare) {
 	for {
-		if err := updateVehiclePositions(db); err != nil {
-			log.Println("error updating vehicle positions:", err)
+		health.cycle()
+		if share != nil && !share.polls() {
+			readSharedRealtimeData(db, events, health, share)
+			continue
 		}
 
-		if err := updateTripUpdates(db); err != nil {
-			log.Println("error updating trips:", err)
+		start := time.Now()
+		ctx, span := tracer.Start(context.Background(), "realtime update cycle")
+
+		// The updaters run at once, so a slow feed doesn't hold up
+		// the others, and must all finish before the next cycle.
+		ctx, cancel := context.WithTimeout(ctx, realtimeInterval)
+		var wg sync.WaitGroup
+		for _, u := range realtimeUpdaters {
+			wg.Go(func() {
+				res, err := u.update(ctx, db)
+				health.record(u.name, res, err)
+				if err != nil {
+					slog.Error("error updating realtime data", "updater", u.name, "err", err)
+					return
+				}
+				events.publish(u.event)
+				shareRealtimeTable(ctx, db, share, u.table)
+			})
 		}
+		wg.Wait()
+		cancel()
+
+		span.End()
+
+		slog.Info("realtime update cycle complete", "duration", time.Since(start))
 
-		time.Sleep(60 * time.Second)
+		feedSleep(realtimeInterval)
 	}
 }
 
-func main() {
-	db, err := sqlx.Open("sqlite3", "cota-gtfs.db")
+// serveCommand runs the server, the default command.
+func serveCommand(args []string) {
+	var (
+		rateLimit  = flag.Float64("rate-limit", 0, "per-client requests per second (0 disables rate limiting)")
+		rateBurst  = flag.Int("rate-burst", 20, "per-client burst size for rate limiting")
+		trustProxy = flag.Bool("trust-proxy", false, "use X-Forwarded-For to identify clients")
+		proxyNets  = flag.String("trusted-proxies", "", "comma-separated addresses or CIDR prefixes of proxies in front of the one that connects to the server, skipped in X-Forwarded-For with -trust-proxy")
+		apiKeyFile = flag.String("api-keys-file", "", "file of API keys, one per line, that get their own rate limit; requests with any other key are limited by IP")
+		strict     = flag.Bool("strict-params", false, "reject API requests with query parameters the endpoint doesn't support")
+		strictRefs = flag.Bool("strict-routes", false, "respond 404 to API requests whose route parameter names no route, instead of an empty result with a Warning")
+		cacheStat  = flag.Duration("cache-static", time.Hour, "how long clients and CDNs may cache responses that only change when static GTFS is reloaded, capped by -gtfs-reload-at and -gtfs-check-interval")
+		cacheRT    = flag.Duration("cache-realtime", 10*time.Second, "how long clients and CDNs may cache responses built from realtime data")
+		logLevel   = flag.String("log-level", "info", "log level: debug, info, warn, or error")
+		logJSON    = flag.Bool("log-json", false, "write logs as JSON")
+		otlpAddr   = flag.String("otlp-endpoint", "", "send traces to this OTLP/HTTP collector host:port (empty disables tracing)")
+		otlpInsec  = flag.Bool("otlp-insecure", false, "use plain HTTP to talk to the OTLP collector")
+		corsOrigin = flag.String("cors-origins", "*", "comma-separated origins allowed to make cross-origin requests (empty disables CORS)")
+		corsMethod = flag.String("cors-methods", "GET, OPTIONS", "comma-separated methods allowed in cross-origin requests")
+		corsHeader = flag.String("cors-headers", "X-API-Key, X-Request-ID", "comma-separated request headers allowed in cross-origin requests")
+		corsMaxAge = flag.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache preflight responses")
+		listenAddr = flag.String("listen", ":18080", "address to listen on, or unix:/path/to/socket for a unix socket that group members can connect to")
+		tlsCert    = flag.String("tls-cert", "", "TLS certificate file; serve HTTPS when set with -tls-key")
+		tlsKey     = flag.String("tls-key", "", "TLS private key file")
+		acDomains  = flag.String("autocert-domains", "", "comma-separated domains to obtain Let's Encrypt certificates for")
+		acCache    = flag.String("autocert-cache", "autocert-cache", "directory to cache Let's Encrypt certificates in")
+		acEmail    = flag.String("autocert-email", "", "contact email for the Let's Encrypt account")
+		acHTTP     = flag.String("autocert-http", "", "also listen on this address (e.g. :80) for HTTP-01 challenges and HTTPS redirects")
+		gtfsURL    = flag.String("gtfs-url", "cota-gtfs", "static GTFS feed to load on reload: a directory of .txt files, a zip file, a file:// URL, or an http(s), s3://, or gs:// URL to a zip file")
+		dbPath     = flag.String("db", "cota-gtfs.db", "sqlite database holding the static GTFS data between restarts")
+		loadStart  = flag.Bool("gtfs-load-on-start", false, "reload static GTFS in the background at startup, serving the existing database until it finishes")
+		reloadAt   = flag.String("gtfs-reload-at", "", "reload static GTFS every day at this local HH:MM time (empty disables)")
+		checkEvery = flag.Duration("gtfs-check-interval", 0, "how often to check -gtfs-url for a new feed_version and reload when it changes (0 disables)")
+		maxErrors  = flag.Int("gtfs-max-errors", 0, "reject static GTFS loads with more than this many validation errors (negative never rejects)")
+		frozen     = flag.Bool("gtfs-frozen", false, "serve the feed at -gtfs-url indefinitely, never reloading it, for reproducible testing and analysis")
+		adminToken = flag.String("admin-token", "", "bearer token for /admin endpoints (empty disables them)")
+		recordTo   = flag.String("record-dir", "", "save every fetched realtime feed, and each new version of a static GTFS zip downloaded from -gtfs-url, to this directory or s3:// or gs:// URL (empty disables)")
+		replayDir  = flag.String("replay-dir", "", "read realtime feeds, and an http(s) -gtfs-url, from recordings made with -record-dir instead of fetching them (empty disables)")
+		replaySpd  = flag.Float64("replay-speed", 1, "how many times faster than real time to replay recordings")
+		offRoute   = flag.Float64("off-route-meters", 150, "flag vehicles further than this from their trip's shape as off route")
+		archiveDir = flag.String("archive-dir", "", "write every realtime snapshot as Parquet under this directory or s3:// or gs:// URL (empty disables)")
+		maxHooks   = flag.Int("max-webhooks", 0, "how many arrival webhooks clients may register (0 disables webhooks)")
+		mqttBroker = flag.String("mqtt-broker", "", "publish vehicles and predictions to the MQTT broker at this host:port or tcp://, ssl://, ws://, or wss:// URL (empty disables)")
+		mqttPrefix = flag.String("mqtt-topic-prefix", "cota", "prefix of the MQTT topics published to")
+		mqttUser   = flag.String("mqtt-username", "", "username to connect to the MQTT broker with")
+		mqttPass   = flag.String("mqtt-password", "", "password to connect to the MQTT broker with")
+		natsServer = flag.String("nats-server", "", "publish vehicles and predictions to the NATS server at this host:port or nats:// or tls:// URL (empty disables)")
+		natsPrefix = flag.String("nats-subject-prefix", "cota", "prefix of the NATS subjects published to")
+		natsToken  = flag.String("nats-token", "", "token to authenticate to the NATS server with")
+		kafkaProxy = flag.String("kafka-rest-proxy", "", "publish vehicles and predictions to Kafka through the Confluent REST Proxy at this URL (empty disables)")
+		kafkaPref  = flag.String("kafka-topic-prefix", "cota", "prefix of the Kafka topics published to")
+		redisAddr  = flag.String("redis", "", "share realtime data with other instances through the Redis server at this host:port or redis:// URL, or rediss:// for TLS (empty disables)")
+		redisUser  = flag.String("redis-username", "", "ACL username to authenticate to the Redis server with")
+		redisPass  = flag.String("redis-password", "", "password to authenticate to the Redis server with")
+		redisPref  = flag.String("redis-prefix", "cota", "prefix of the Redis keys realtime data is shared under")
+		redisRead  = flag.Bool("redis-read-only", false, "read realtime data shared through -redis instead of polling COTA")
+		redisElect = flag.Bool("redis-elect-leader", false, "elect one instance through -redis to poll COTA, with the others reading the realtime data it shares")
+		follow     = flag.String("follow", "", "load realtime data from the cota-bus instance at this base URL instead of polling COTA (empty disables)")
+		staticOnly = flag.Bool("static-only", false, "serve only the static schedule, without fetching any realtime data")
+		feedIDs    = flag.String("feed-id", "", "comma-separated Mobility Database (mdb-123) or Transitland (f-dp3-cota) IDs to find -gtfs-url, -vehicles-url, and -trip-updates-url from, where not given")
+		tlKey      = flag.String("transitland-key", "", "API key for looking up Transitland -feed-id IDs (default $TRANSITLAND_API_KEY)")
+		outTimeout = flag.Duration("outbound-timeout", 60*time.Second, "give up on outbound requests, such as feed fetches, after this long")
+		outRetries = flag.Int("outbound-retries", 2, "retry failed outbound GET and PUT requests this many times")
+		outProxy   = flag.String("outbound-proxy", "", "send outbound requests through the proxy at this URL (empty uses $HTTPS_PROXY and $HTTP_PROXY)")
+		outIdle    = flag.Int("outbound-idle-conns", 4, "idle connections to keep open to each upstream host")
+		statsdAddr = flag.String("statsd", "", "also send metrics to the StatsD server at this host:port (empty disables)")
+		statsdPref = flag.String("statsd-prefix", "cota_bus", "prefix of the StatsD metric names")
+		statsdTags = flag.Bool("statsd-tags", false, "send labels as DogStatsD tags instead of folding them into StatsD metric names")
+	)
+	gtfsHeader := headerFlag{}
+	flag.Var(gtfsHeader, "gtfs-header", "`Name: value` header to send when downloading an http(s) -gtfs-url (repeatable; $VAR is expanded)")
+	setFeeds := realtimeFeedFlags(flag.CommandLine)
+	flag.CommandLine.Parse(args)
+
+	if err := setupLogging(*logLevel, *logJSON); err != nil {
+		fatal("invalid logging configuration", "err", err)
+	}
+
+	offRouteMeters = *offRoute
+	client, err := newHTTPClient(httpClientOptions{
+		Timeout:     *outTimeout,
+		Retries:     *outRetries,
+		RetryWait:   time.Second,
+		Proxy:       *outProxy,
+		MaxIdleHost: *outIdle,
+	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid outbound HTTP configuration", "err", err)
+	}
+	feedClient = client
+	if *feedIDs != "" {
+		found, err := discoverFeeds(context.Background(), splitList(*feedIDs), *tlKey)
+		if err != nil {
+			fatal("error discovering feeds", "err", err)
+		}
+		setDiscoveredFlags(flag.CommandLine, found)
+	}
+	setFeedHeaders(*gtfsURL, gtfsHeader)
+	if err := setFeeds(); err != nil {
+		fatal("invalid realtime feeds", "err", err)
+	}
+
+	proxies := proxyConfig{trust: *trustProxy}
+	if proxies.trusted, err = parseTrustedProxies(*proxyNets); err != nil {
+		fatal("invalid -trusted-proxies", "err", err)
+	}
+	var apiKeys map[string]bool
+	if *apiKeyFile != "" {
+		if apiKeys, err = readAPIKeys(*apiKeyFile); err != nil {
+			fatal("error reading API keys", "err", err)
+		}
 	}
 
-	go updateRealtimeData(db)
+	if *recordTo != "" && !isObjectURL(*recordTo) {
+		if err := os.MkdirAll(*recordTo, 0755); err != nil {
+			fatal("error creating record directory", "err", err)
+		}
+		recordDir = *recordTo
+	}
+
+	if *replayDir != "" {
+		r, err := openReplay(*replayDir, *replaySpd)
+		if err != nil {
+			fatal("error opening replay directory", "err", err)
+		}
+		replay = r
+		slog.Info("replaying recorded feeds", "dir", *replayDir, "start", r.start, "speed", r.speed)
+	}
+
+	if *otlpAddr != "" {
+		shutdown, err := setupTracing(context.Background(), *otlpAddr, *otlpInsec)
+		if err != nil {
+			fatal("error setting up tracing", "err", err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	// The realtime updaters and GTFS reloads write concurrently with
+	// readers, so wait on locks rather than failing immediately.
+	db, err := sqlx.Open("sqlite3", *dbPath+"?_busy_timeout=10000")
+	if err != nil {
+		fatal("error opening database", "err", err)
+	}
+
+	cors := corsPolicy{
+		Origins: splitList(*corsOrigin),
+		Methods: splitList(*corsMethod),
+		Headers: splitList(*corsHeader),
+		MaxAge:  *corsMaxAge,
+	}
+
+	if err := createRealtimeTables(db); err != nil {
+		fatal("error creating realtime tables", "err", err)
+	}
+	if *staticOnly {
+		// Don't serve whatever realtime data was left from the last
+		// run as if it were current.
+		if _, err := db.Exec(`DELETE FROM vehicle_positions; DELETE FROM stop_time_updates`); err != nil {
+			fatal("error clearing realtime tables", "err", err)
+		}
+	}
+
+	shapes := &shapeCache{}
+	if err := shapes.refresh(context.Background(), db); err != nil {
+		slog.Warn("no shapes in database", "err", err)
+	}
+
+	stopIdx := &stopCache{}
+	if err := stopIdx.refresh(context.Background(), db); err != nil {
+		slog.Warn("no stops in database", "err", err)
+	}
+
+	search := &searchCache{}
+	if err := search.refresh(context.Background(), db); err != nil {
+		slog.Warn("no search data in database", "err", err)
+	}
+
+	patterns := &patternCache{}
+	if err := patterns.refresh(context.Background(), db); err != nil {
+		slog.Warn("no route patterns in database", "err", err)
+	}
+
+	events := newEventBus()
+	spans := &serviceSpanCache{}
+	go spans.watch(events)
+	responses := &jsonCache{}
+	go responses.watch(events)
+	routeIDs := &routeIDCache{}
+	go routeIDs.watch(events)
+	hub := newVehicleHub(db, shapes, events, cors)
+	health := newHealthTracker()
+	if *archiveDir != "" {
+		go archiveRealtime(db, events, *archiveDir)
+	}
+	accuracy := newAccuracyTracker(db)
+	otp := newOTPTracker(db)
+	go accuracy.run(events, otp)
+	occupancy := newOccupancyTracker(db)
+	go occupancy.run(events)
+	if *mqttBroker != "" {
+		mqtt := newMQTTClient(*mqttBroker, "cota-bus-"+newRequestID(), *mqttUser, *mqttPass)
+		go newStreamPublisher(db, shapes, *mqttPrefix, mqtt).run(events)
+	}
+	if *natsServer != "" {
+		nats, err := newNATSClient(*natsServer, *natsToken)
+		if err != nil {
+			fatal("invalid NATS configuration", "err", err)
+		}
+		go newStreamPublisher(db, shapes, *natsPrefix, nats).run(events)
+	}
+	if *kafkaProxy != "" {
+		kafka := &kafkaClient{proxy: *kafkaProxy}
+		go newStreamPublisher(db, shapes, *kafkaPref, kafka).run(events)
+	}
+	hooks := newWebhookRegistry(db, *maxHooks, proxies)
+	if *maxHooks > 0 {
+		go hooks.run(events)
+	}
+	var share *realtimeShare
+	switch {
+	case *follow != "" && *redisAddr != "":
+		fatal("-follow and -redis can't be used together")
+	case *follow != "":
+		share = followRealtime(*follow)
+	case *redisAddr != "":
+		redis, err := newRedisClient(*redisAddr, *redisUser, *redisPass)
+		if err != nil {
+			fatal("invalid Redis configuration", "err", err)
+		}
+		share = newRealtimeShare(redis, *redisPref, *redisRead, *redisElect)
+	}
+	if *staticOnly {
+		go sdWatchdog(nil)
+	} else {
+		go updateRealtimeData(db, events, health, share)
+		go sdWatchdog(health)
+	}
+
+	feed := &feedInfoCache{}
+	if err := feed.refresh(context.Background(), db); err != nil {
+		slog.Warn("no feed info in database", "err", err)
+	}
+
+	trans := &translationCache{}
+	if err := trans.refresh(context.Background(), db); err != nil {
+		slog.Warn("no translations in database", "err", err)
+	}
+
+	loader := &gtfsLoader{
+		db:        db,
+		src:       *gtfsURL,
+		health:    health,
+		feed:      feed,
+		trans:     trans,
+		shapes:    shapes,
+		stops:     stopIdx,
+		search:    search,
+		patterns:  patterns,
+		events:    events,
+		maxErrors: *maxErrors,
+		frozen:    *frozen,
+	}
+
+	// The database persists whatever was last loaded, so there is
+	// usually something to serve right away while a fresh copy loads.
+	// If there isn't, serve 503s until the first load succeeds rather
+	// than refusing to start.
+	//
+	// A frozen feed is the exception: nothing else may be served, so
+	// unless the database holds the same feed_version, it is loaded
+	// before anything is.
+	if *frozen {
+		if *reloadAt != "" || *checkEvery > 0 {
+			fatal("-gtfs-frozen can't be combined with -gtfs-reload-at or -gtfs-check-interval")
+		}
+		v, err := sourceFeedVersion(context.Background(), *gtfsURL)
+		if cur := feed.get(); err == nil && v != "" && cur != nil && cur.Version == v && loader.checkReady(context.Background()) {
+			slog.Info("database holds frozen GTFS feed", "version", v)
+		} else {
+			slog.Info("loading frozen GTFS feed", "src", redactURL(*gtfsURL))
+			go loader.loadWithRetry(context.Background())
+		}
+	} else if !loader.checkReady(context.Background()) {
+		slog.Warn("no static GTFS data in database, loading", "src", redactURL(*gtfsURL))
+		go loader.loadWithRetry(context.Background())
+	} else if *loadStart {
+		go loader.loadWithRetry(context.Background())
+	}
+	if *reloadAt != "" {
+		hour, minute, err := parseTimeOfDay(*reloadAt)
+		if err != nil {
+			fatal("invalid -gtfs-reload-at", "err", err)
+		}
+		go reloadDaily(loader, hour, minute)
+	}
+	if *checkEvery > 0 {
+		go watchFeedVersion(loader, *checkEvery)
+	}
+
+	http.Handle("/ws", hub)
+	http.HandleFunc("POST /admin/reload", adminAuth(*adminToken, handleReload(loader)))
+	http.HandleFunc("GET /admin/status", adminAuth(*adminToken, handleStatus(db, health, feed)))
+	http.HandleFunc("GET /admin/validation", adminAuth(*adminToken, handleValidation(loader)))
+	http.HandleFunc("GET /admin/gtfs-diff", adminAuth(*adminToken, handleDiff(loader)))
+	http.HandleFunc("GET /admin/store", adminAuth(*adminToken, handleStore(db, loader, accuracy, otp)))
+	http.HandleFunc("/openapi.json", handleOpenAPI)
+	http.HandleFunc("/version", handleVersion)
+	requests := newRequestMetrics()
+	if *statsdAddr != "" {
+		sd, err := newStatsdClient(*statsdAddr, *statsdPref, *statsdTags)
+		if err != nil {
+			fatal("error setting up statsd", "err", err)
+		}
+		requests.statsd = sd
+		go sd.run(events, db, shapes)
+	}
+	http.HandleFunc("GET /metrics", handleMetrics(db, shapes, requests))
+	http.Handle("/ui/", handleUI())
 
 	http.HandleFunc("/agencies", func(rw http.ResponseWriter, req *http.Request) {
 		agencies := []agency{}
-		err := db.Select(&agencies, "SELECT agency_id, agency_name, agency_url FROM agency")
+		err := dbSelect(req.Context(), db, "agencies", &agencies, "SELECT agency_id, agency_name, agency_url FROM agency")
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		rw.Header().Set("Content-Type", "application/json")
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		enc := json.NewEncoder(rw)
 		enc.Encode(agencies)
 	})
 
-	http.HandleFunc("/cota/routes", func(rw http.ResponseWriter, req *http.Request) {
-		routes := []route{}
-		err := db.Select(&routes, "SELECT route_id, route_long_name, route_short_name FROM routes WHERE agency_id = 'COTA' ORDER BY route_short_name*1, route_short_name, route_long_name")
-		if err != nil {
+	http.HandleFunc("/feed_info", handleFeedInfo(feed))
+
+	http.HandleFunc("/cota/routes", handleRoutes(db, spans, trans, responses))
+
+	http.HandleFunc("/cota/stops", handleStops(db, stopIdx, trans, responses))
+
+	http.HandleFunc("/cota/fares", handleFares(db))
+	http.HandleFunc("/cota/levels", handleLevels(db))
+	http.HandleFunc("/cota/shapes", handleShapes(shapes, responses))
+
+	http.HandleFunc("/cota/patterns", handlePatterns(patterns))
+	http.HandleFunc("/cota/stop-routes", handleStopRoutes(patterns))
+
+	http.HandleFunc("/cota/search", handleSearch(search))
+
+	http.HandleFunc("/cota/departures", handleDepartures(db))
+
+	http.HandleFunc("/cota/countdown", handleCountdown(db))
+	http.HandleFunc("POST /cota/voice", handleVoice(db, stopIdx))
+
+	http.HandleFunc("/cota/trip-plans", handleTripPlans(db))
+
+	if *maxHooks > 0 {
+		http.HandleFunc("POST /cota/webhooks", handleAddWebhook(hooks))
+		http.HandleFunc("DELETE /cota/webhooks/{id}", handleDeleteWebhook(hooks))
+	}
+
+	http.HandleFunc("/cota/accuracy", handleAccuracy(accuracy))
+
+	http.HandleFunc("/cota/analytics/otp", handleOTP(otp))
+	http.HandleFunc("/cota/analytics/occupancy", handleOccupancy(occupancy))
+	http.HandleFunc("/cota/pathways", handlePathways(db))
+	http.HandleFunc("/cota/realtime-snapshot", handleRealtimeSnapshot(db, health))
+
+	http.HandleFunc("/cota/transfers", func(rw http.ResponseWriter, req *http.Request) {
+		stop := req.FormValue("stop")
+		if stop == "" {
+			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
+			return
+		}
+
+		transfers := []transfer{}
+
+		const q = `SELECT t.from_stop_id, t.to_stop_id, stops.stop_name AS to_stop_name, t.transfer_type, t.min_transfer_time
+			   FROM transfers AS t
+			   INNER JOIN stops ON t.to_stop_id = stops.stop_id
+			   WHERE t.from_stop_id = ?
+			   ORDER BY stops.stop_name`
+		if err := dbSelect(req.Context(), db, "transfers", &transfers, q, stop); err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		rw.Header().Add("Vary", "Accept-Language")
+		if lang := trans.language(req); lang != "" {
+			for i, t := range transfers {
+				transfers[i].ToStopName = trans.translate(lang, "stops", "stop_name", t.ToStopID, t.ToStopName)
+			}
+			rw.Header().Set("Content-Language", lang)
+		}
+
 		rw.Header().Set("Content-Type", "application/json")
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		enc := json.NewEncoder(rw)
-		enc.Encode(routes)
+		enc.Encode(transfers)
 	})
 
-	http.HandleFunc("/cota/stops", func(rw http.ResponseWriter, req *http.Request) {
-		stops := []stop{}
+	http.HandleFunc("/cota/vehicles", handleVehicles(db, shapes, health))
 
-		q := "SELECT DISTINCT stops.stop_id, stops.stop_name, stops.stop_lat, stops.stop_lon FROM stops"
+	http.HandleFunc("/cota/predictions", handlePredictions(db, health))
 
-		var err error
-		if route := req.FormValue("route"); route != "" {
-			q += ` INNER JOIN stop_times ON stops.stop_id = stop_times.stop_id
-			       INNER JOIN trips ON stop_times.trip_id = trips.trip_id
-			       WHERE trips.route_id = ?`
-			err = db.Select(&stops, q, route)
-		} else {
-			err = db.Select(&stops, q)
+	var mux http.Handler = deprecations(unknownRoutes(http.DefaultServeMux, db, routeIDs, *strictRefs))
+	if *strict {
+		mux = strictParams(mux)
+	}
+	var handler http.Handler = requests.middleware(recoverPanics(loader.requireData(mux)))
+	if *rateLimit > 0 {
+		handler = newRateLimiter(*rateLimit, *rateBurst, proxies, apiKeys).middleware(handler)
+	}
+	policy := &cachePolicy{static: *cacheStat, realtime: *cacheRT, checkEvery: *checkEvery}
+	if *reloadAt != "" {
+		// -gtfs-reload-at was checked when the reloads were started.
+		policy.reloadDaily = true
+		policy.reloadHour, policy.reloadMinute, _ = parseTimeOfDay(*reloadAt)
+	}
+	handler = policy.middleware(handler)
+	handler = versionedPaths(handler)
+	handler = feed.middleware(handler)
+	handler = cors.middleware(handler)
+	handler = traceHandler(handler)
+	handler = requestLogger(handler)
+
+	tlsOpts := tlsOptions{
+		CertFile:        *tlsCert,
+		KeyFile:         *tlsKey,
+		AutocertDomains: splitList(*acDomains),
+		AutocertCache:   *acCache,
+		AutocertEmail:   *acEmail,
+		AutocertHTTP:    *acHTTP,
+	}
+
+	srv := &http.Server{
+		Addr:    *listenAddr,
+		Handler: handler,
+	}
+
+	build := currentBuild()
+	slog.Info("starting server", "addr", srv.Addr, "tls", tlsOpts.enabled(), "version", build.Version, "commit", build.Commit)
+	if err := serve(srv, tlsOpts); err != nil {
+		fatal("server exited", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// handleRoutes lists COTA's routes, with their current service spans.
+// selectRoutes returns COTA's routes with their service spans at now,
+// in their untranslated names.
+func selectRoutes(ctx context.Context, db *sqlx.DB, spans *serviceSpanCache, now time.Time) ([]route, error) {
+	routes := []route{}
+	const q = "SELECT route_id, route_long_name, route_short_name FROM routes WHERE agency_id = 'COTA' ORDER BY route_short_name*1, route_short_name, route_long_name"
+	if err := dbSelect(ctx, db, "routes", &routes, q); err != nil {
+		return nil, err
+	}
+
+	byRoute, err := spans.get(ctx, db, now)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range routes {
+		routes[i].ServiceSpan = byRoute[r.ID]
+		if routes[i].ServiceSpan == nil {
+			routes[i].ServiceSpan = []serviceSpan{}
+		}
+	}
+	return routes, nil
+}
+
+func handleRoutes(db *sqlx.DB, spans *serviceSpanCache, trans *translationCache, responses *jsonCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("Vary", "Accept-Language")
+		lang := trans.language(req)
+		if lang != "" {
+			rw.Header().Set("Content-Language", lang)
+		}
+
+		loadRoutes := func() ([]route, error) {
+			routes, err := selectRoutes(req.Context(), db, spans, feedNow())
+			if err != nil {
+				return nil, err
+			}
+
+			if lang != "" {
+				for i, r := range routes {
+					routes[i].LongName = trans.translate(lang, "routes", "route_long_name", r.ID, r.LongName)
+					routes[i].ShortName = trans.translate(lang, "routes", "route_short_name", r.ID, r.ShortName)
+				}
+			}
+			return routes, nil
 		}
 
+		// Names are matched as they are returned, in the request's
+		// language.
+		if name := req.FormValue("name"); name != "" {
+			routes, err := loadRoutes()
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			routes = slices.DeleteFunc(routes, func(r route) bool {
+				return !nameMatches(r.LongName, name) && !nameMatches(r.ShortName, name)
+			})
+
+			rw.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(rw)
+			enc.Encode(routes)
+			return
+		}
+
+		// Service spans move on when the last of the previous day's
+		// trips finish, so routes are only cached for a minute.
+		body, err := responses.get("routes "+lang, time.Minute, func() (any, error) { return loadRoutes() })
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		writeCachedJSON(rw, body)
+	}
+}
+
+// handleStops lists stops, narrowed by route, stop_code, parent
+// station, area, or name.
+func handleStops(db *sqlx.DB, stopIdx *stopCache, trans *translationCache, responses *jsonCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		area, err := parseSpatialFilter(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stops := []stop{}
+		route := req.FormValue("route")
+		code := req.FormValue("code")
+		parent := req.FormValue("parent_station")
+		name := req.FormValue("name")
+
+		rw.Header().Add("Vary", "Accept-Language")
+		lang := trans.language(req)
+		if lang != "" {
+			rw.Header().Set("Content-Language", lang)
+		}
+		translateStops := func(stops []stop) {
+			if lang != "" {
+				for i, s := range stops {
+					stops[i].Name = trans.translate(lang, "stops", "stop_name", s.ID, s.Name)
+				}
+			}
+		}
+
+		// Every stop is the same list until the next reload.
+		if route == "" && code == "" && parent == "" && area == nil && name == "" {
+			body, err := responses.get("stops "+lang, 0, func() (any, error) {
+				stops := stopIdx.all()
+				translateStops(stops)
+				return stops, nil
+			})
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeCachedJSON(rw, body)
+			return
+		}
+
+		// Code, station, and area lookups come straight from the stop
+		// cache, narrowed to the stops on route if there is one.
+		indexed := code != "" || parent != "" || area != nil
+		if code != "" {
+			stops = stopIdx.byCode(code)
+		} else if parent != "" {
+			stops = stopIdx.children(parent)
+		} else if area != nil {
+			stops = stopIdx.search(area)
+		} else if route == "" {
+			stops = stopIdx.all()
+		}
+
+		if route != "" {
+			q := `SELECT DISTINCT stops.stop_id, stops.stop_name, stops.stop_lat, stops.stop_lon, stops.stop_code, stops.parent_station FROM stops
+			      INNER JOIN stop_times ON stops.stop_id = stop_times.stop_id
+			      INNER JOIN trips ON stop_times.trip_id = trips.trip_id
+			      WHERE trips.route_id = ?
+			      ORDER BY stops.stop_id`
+			routeStops := []stop{}
+			if err := dbSelect(req.Context(), db, "stops", &routeStops, q, route); err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if !indexed {
+				stops = routeStops
+			} else {
+				onRoute := map[string]bool{}
+				for _, s := range routeStops {
+					onRoute[s.ID] = true
+				}
+				stops = slices.DeleteFunc(stops, func(s stop) bool { return !onRoute[s.ID] })
+			}
+		}
+		translateStops(stops)
+
+		// Names are matched as they are returned, in the request's
+		// language.
+		if name != "" {
+			stops = slices.DeleteFunc(stops, func(s stop) bool { return !nameMatches(s.Name, name) })
+		}
 
 		rw.Header().Set("Content-Type", "application/json")
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		enc := json.NewEncoder(rw)
 		enc.Encode(stops)
-	})
-
-	http.HandleFunc("/cota/vehicles", func(rw http.ResponseWriter, req *http.Request) {
-		vehicles := []vehicle{}
+	}
+}
 
-		q := `SELECT vp.vehicle_id, vp.vehicle_label, trips.trip_headsign, trips.route_id, vp.latitude, vp.longitude
-		      FROM vehicle_positions AS vp
-		      INNER JOIN trips ON vp.trip_id = trips.trip_id`
+// handleVehicles lists the vehicles in the vehicle positions feed.
+func handleVehicles(db *sqlx.DB, shapes *shapeCache, health *healthTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		area, err := parseSpatialFilter(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		var err error
-		if route := req.FormValue("route"); route != "" {
-			q += ` WHERE trips.route_id = ?`
-			err = db.Select(&vehicles, q, route)
-		} else {
-			err = db.Select(&vehicles, q)
+		// A route argument starting with ! excludes the comma-separated
+		// routes after it instead.
+		route := req.FormValue("route")
+		var exclude []string
+		if rest, ok := strings.CutPrefix(route, "!"); ok {
+			route, exclude = "", splitList(rest)
 		}
 
+		vehicles, err := selectVehicles(req.Context(), db, shapes, route)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if len(exclude) > 0 {
+			vehicles = slices.DeleteFunc(vehicles, func(v vehicle) bool { return slices.Contains(exclude, v.RouteID) })
+		}
+		if area != nil {
+			vehicles = searchVehicles(vehicles, area)
+		}
+		health.setRealtimeHeaders(rw, "vehicle_positions")
 
 		rw.Header().Set("Content-Type", "application/json")
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		enc := json.NewEncoder(rw)
 		enc.Encode(vehicles)
-	})
+	}
+}
 
-	http.HandleFunc("/cota/predictions", func(rw http.ResponseWriter, req *http.Request) {
+// handlePredictions returns the next arrival at a stop on each route,
+// from the trip updates feed or, for routes it has none for, the
+// schedule.
+func handlePredictions(db *sqlx.DB, health *healthTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
 		stop := req.FormValue("stop")
 		if stop == "" {
 			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
@@ -278,23 +1281,60 @@ func main() {
 
 		predictions := []prediction{}
 
-		const q = `SELECT stu.stop_id, trips.trip_headsign, trips.route_id, min(stu.arrival_time)-? as arrival_time
+		// SQLite takes the other columns from the row with the
+		// minimum arrival time, so scheduled_arrival is that trip's.
+		const q = `SELECT stu.stop_id, trips.trip_headsign, trips.route_id, min(stu.arrival_time) AS arrival_at,
+			          COALESCE(st.arrival_time, '') AS scheduled_arrival
 			   FROM stop_time_updates AS stu
 			   INNER JOIN trips ON stu.trip_id = trips.trip_id
-			   WHERE stu.stop_id = ? AND stu.arrival_time >= ?
+			   LEFT JOIN stop_times AS st ON stu.trip_id = st.trip_id AND stu.stop_id = st.stop_id
+			   WHERE stu.stop_id = ? AND stu.arrival_time BETWEEN ? AND ?
 			   GROUP BY stu.stop_id, trips.route_id`
-		now := time.Now().Unix()
-		if err := db.Select(&predictions, q, now, stop, now); err != nil {
+		now := feedNow()
+		window, err := parseTimeWindow(req, now)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Arrivals are only past once the feed says so, so a stalled
+		// feed's predictions are served marked stale rather than
+		// dropped as the clock passes them.
+		from, stale := window.from, false
+		if !window.from.After(now) {
+			from, stale = health.predictionCutoff(now)
+		}
+		// Realtime predictions aren't limited to scheduleLookahead.
+		until := int64(math.MaxInt64)
+		if !window.to.IsZero() {
+			until = window.to.Unix()
+		}
+		if err := dbSelect(req.Context(), db, "predictions", &predictions, q, stop, from.Unix(), until); err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		loc := agencyLocation(req.Context(), db)
+		for i, p := range predictions {
+			arrival := time.Unix(p.ArrivalAt, 0)
+			predictions[i].ArrivalTime = uint64(max(arrival.Sub(now), 0) / time.Second)
+			predictions[i].Delay = scheduleDelay(arrival, p.ScheduledArrival, loc)
+			predictions[i].Stale = stale
+		}
+
+		realtime := map[string]bool{}
+		for _, p := range predictions {
+			realtime[p.RouteID] = true
+		}
+		scheduled, err := scheduledPredictions(req.Context(), db, stop, now, window, realtime)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		predictions = append(predictions, scheduled...)
+		health.setRealtimeHeaders(rw, "trip_updates")
+
 		rw.Header().Set("Content-Type", "application/json")
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		enc := json.NewEncoder(rw)
 		enc.Encode(predictions)
-	})
-
-	log.Println("Starting server on port 18080")
-	log.Fatal(http.ListenAndServe(":18080", nil))
+	}
 }
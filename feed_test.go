@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// emptyGTFS is a feed with every file we query but no rows in them.
+var emptyGTFS = fstest.MapFS{
+	"agency.txt":         {Data: []byte("agency_id,agency_name,agency_url,agency_timezone\n")},
+	"calendar.txt":       {Data: []byte("service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\n")},
+	"calendar_dates.txt": {Data: []byte("service_id,date,exception_type\n")},
+	"routes.txt":         {Data: []byte("route_id,agency_id,route_short_name,route_long_name,route_type\n")},
+	"shapes.txt":         {Data: []byte("shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n")},
+	"stop_times.txt":     {Data: []byte("trip_id,arrival_time,departure_time,stop_id,stop_sequence\n")},
+	"stops.txt":          {Data: []byte("stop_id,stop_name,stop_lat,stop_lon\n")},
+	"trips.txt":          {Data: []byte("route_id,service_id,trip_id,trip_headsign\n")},
+}
+
+// newTestDB returns an in-memory database with fsys loaded into it and
+// empty realtime tables.
+func newTestDB(t *testing.T, fsys fstest.MapFS) *sqlx.DB {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a different database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	l := &gtfsLoader{db: db}
+	loaded, err := l.importAll(ctx, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.swap(ctx, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := createRealtimeTables(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestEmptyCollections checks that collections with nothing in them
+// are encoded as [] rather than null, which clients would have to
+// special case.
+func TestEmptyCollections(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, emptyGTFS)
+
+	stops := &stopCache{}
+	if err := stops.refresh(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	search := &searchCache{}
+	if err := search.refresh(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	shapes := &shapeCache{}
+	if err := shapes.refresh(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	patterns := &patternCache{}
+	if err := patterns.refresh(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	// The feed has no translations.txt.
+	trans := &translationCache{}
+	trans.refresh(ctx, db)
+	health := newHealthTracker()
+
+	tests := []struct {
+		name    string
+		target  string
+		handler http.Handler
+	}{
+		{"stops", "/cota/stops", handleStops(db, stops, trans, &jsonCache{})},
+		{"stops on route", "/cota/stops?route=2", handleStops(db, stops, trans, &jsonCache{})},
+		{"stops by code", "/cota/stops?code=1234", handleStops(db, stops, trans, &jsonCache{})},
+		{"stops near", "/cota/stops?lat=39.96&lon=-83.0", handleStops(db, stops, trans, &jsonCache{})},
+		{"routes", "/cota/routes", handleRoutes(db, &serviceSpanCache{}, trans, &jsonCache{})},
+		{"routes by name", "/cota/routes?name=high", handleRoutes(db, &serviceSpanCache{}, trans, &jsonCache{})},
+		{"vehicles", "/cota/vehicles", handleVehicles(db, shapes, health)},
+		{"vehicles in bbox", "/cota/vehicles?bbox=39.9,-83.1,40.0,-83.0", handleVehicles(db, shapes, health)},
+		{"vehicles excluding routes", "/cota/vehicles?route=!2,CMAX", handleVehicles(db, shapes, health)},
+		{"predictions", "/cota/predictions?stop=HIGBRON", handlePredictions(db, health)},
+		{"departures", "/cota/departures?stop=HIGBRON", handleDepartures(db)},
+		{"search", "/cota/search?q=high", handleSearch(search)},
+		{"shapes", "/cota/shapes", handleShapes(shapes, &jsonCache{})},
+		{"patterns", "/cota/patterns", handlePatterns(patterns)},
+		{"stop routes", "/cota/stop-routes?stop=HIGBRON", handleStopRoutes(patterns)},
+		{"accuracy", "/cota/accuracy", handleAccuracy(newAccuracyTracker(db))},
+		{"otp", "/cota/analytics/otp", handleOTP(newOTPTracker(db))},
+		{"occupancy", "/cota/analytics/occupancy", handleOccupancy(newOccupancyTracker(db))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+				t.Errorf("body = %s, want []", got)
+			}
+		})
+	}
+}
+
+// TestStopRoutesWithoutHeadsigns checks that a route whose trips have
+// no headsign lists [] for trip_headsigns rather than null.
+func TestStopRoutesWithoutHeadsigns(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	fsys["routes.txt"] = &fstest.MapFile{Data: []byte("route_id,agency_id,route_short_name,route_long_name,route_type\n2,COTA,2,N High St,3\n")}
+	fsys["stops.txt"] = &fstest.MapFile{Data: []byte("stop_id,stop_name,stop_lat,stop_lon\nHIGBRON,High St & Broad St,39.962,-83.0\nHIGGAYN,High St & Gay St,39.965,-83.0\n")}
+	fsys["trips.txt"] = &fstest.MapFile{Data: []byte("route_id,service_id,trip_id,trip_headsign,direction_id\n2,WK,T1,,0\n")}
+	fsys["stop_times.txt"] = &fstest.MapFile{Data: []byte("trip_id,arrival_time,departure_time,stop_id,stop_sequence\nT1,08:00:00,08:00:00,HIGBRON,1\nT1,08:02:00,08:02:00,HIGGAYN,2\n")}
+	db := newTestDB(t, fsys)
+
+	patterns := &patternCache{}
+	if err := patterns.refresh(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleStopRoutes(patterns).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cota/stop-routes?stop=HIGBRON", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Body.String(); !strings.Contains(got, `"trip_headsigns":[]`) {
+		t.Errorf("body = %s, want trip_headsigns []", got)
+	}
+}
+
+// TestSelectRoutes checks that routes of other agencies are left out
+// and that every route has a service span list, as /cota/routes and
+// the dump command return them.
+func TestSelectRoutes(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	fsys["agency.txt"] = &fstest.MapFile{Data: []byte("agency_id,agency_name,agency_url,agency_timezone\nCOTA,COTA,https://www.cota.com,UTC\nLC,Lancaster,https://example.com,UTC\n")}
+	fsys["routes.txt"] = &fstest.MapFile{Data: []byte("route_id,agency_id,route_short_name,route_long_name,route_type\n2,COTA,2,N High St,3\nL1,LC,1,Lancaster,3\n")}
+	db := newTestDB(t, fsys)
+
+	routes, err := selectRoutes(context.Background(), db, &serviceSpanCache{}, time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].ID != "2" || routes[0].ServiceSpan == nil {
+		t.Errorf("routes = %+v, want route 2 with an empty service span", routes)
+	}
+}
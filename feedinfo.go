@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type feedInfo struct {
+	PublisherName string `db:"feed_publisher_name" json:"publisher_name"`
+	PublisherURL  string `db:"feed_publisher_url" json:"publisher_url"`
+	Lang          string `db:"feed_lang" json:"lang"`
+	StartDate     string `db:"feed_start_date" json:"start_date"`
+	EndDate       string `db:"feed_end_date" json:"end_date"`
+	Version       string `db:"feed_version" json:"version"`
+}
+
+// feedInfoCache holds the feed_info of the loaded schedule so it can be
+// attached to every response without a database query.
+type feedInfoCache struct {
+	info atomic.Pointer[feedInfo]
+}
+
+// refresh rereads feed_info from the database.  feed_info.txt is
+// optional, so a feed without one clears the cache.
+func (c *feedInfoCache) refresh(ctx context.Context, db *sqlx.DB) error {
+	infos := []feedInfo{}
+	const q = `SELECT feed_publisher_name, feed_publisher_url, feed_lang, feed_start_date, feed_end_date, feed_version
+		   FROM feed_info LIMIT 1`
+	if err := dbSelect(ctx, db, "feed_info", &infos, q); err != nil {
+		c.info.Store(nil)
+		return err
+	}
+
+	if len(infos) > 0 {
+		c.info.Store(&infos[0])
+	} else {
+		c.info.Store(nil)
+	}
+	return nil
+}
+
+// get returns the current feed info, or nil.  It must not be modified.
+func (c *feedInfoCache) get() *feedInfo {
+	return c.info.Load()
+}
+
+// middleware tags each response with the version and validity of the
+// schedule it was answered from, so clients can tell when a new
+// edition has been loaded.
+func (c *feedInfoCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if info := c.get(); info != nil {
+			if info.Version != "" {
+				rw.Header().Set("X-Feed-Version", info.Version)
+			}
+			if info.StartDate != "" && info.EndDate != "" {
+				rw.Header().Set("X-Feed-Valid", info.StartDate+"-"+info.EndDate)
+			}
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func handleFeedInfo(feed *feedInfoCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		infos := []feedInfo{}
+		if info := feed.get(); info != nil {
+			infos = append(infos, *info)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(infos)
+	}
+}
@@ -7,26 +7,67 @@ sqlite3 -echo cota-gtfs.db <<EOF
 .import cota-gtfs/calendar_dates.txt calendar_dates
 .import cota-gtfs/fare_attributes.txt fare_attributes
 .import cota-gtfs/fare_rules.txt fare_rules
+.import cota-gtfs/feed_info.txt feed_info
 .import cota-gtfs/routes.txt routes
 .import cota-gtfs/shapes.txt shapes
 .import cota-gtfs/stop_times.txt stop_times
 .import cota-gtfs/stops.txt stops
+.import cota-gtfs/transfers.txt transfers
 .import cota-gtfs/trips.txt trips
 
 CREATE INDEX agency_id_idx ON agency (agency_id);
 CREATE INDEX routes_agency_id_idx ON routes (agency_id);
 CREATE INDEX stops_id_idx ON stops (stop_id);
+CREATE INDEX stops_parent_station_idx ON stops (parent_station);
 CREATE INDEX stop_times_stop_id_idx ON stop_times (stop_id);
 CREATE INDEX stop_times_trip_id_idx ON stop_times (trip_id);
+CREATE INDEX transfers_from_stop_id_idx ON transfers (from_stop_id);
 CREATE INDEX trips_id_idx ON trips (trip_id);
 CREATE INDEX trips_route_id_idx ON trips (route_id);
 
+-- levels.txt, pathways.txt, and translations.txt are optional and COTA
+-- doesn't publish them, but the server expects the tables to exist.
+CREATE TABLE IF NOT EXISTS levels (
+    level_id TEXT,
+    level_index TEXT,
+    level_name TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS pathways (
+    pathway_id TEXT,
+    from_stop_id TEXT,
+    to_stop_id TEXT,
+    pathway_mode TEXT,
+    is_bidirectional TEXT,
+    length TEXT NOT NULL DEFAULT '',
+    traversal_time TEXT NOT NULL DEFAULT '',
+    stair_count TEXT NOT NULL DEFAULT '',
+    max_slope TEXT NOT NULL DEFAULT '',
+    min_width TEXT NOT NULL DEFAULT '',
+    signposted_as TEXT NOT NULL DEFAULT '',
+    reversed_signposted_as TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS translations (
+    table_name TEXT,
+    field_name TEXT,
+    language TEXT,
+    translation TEXT,
+    record_id TEXT NOT NULL DEFAULT '',
+    record_sub_id TEXT NOT NULL DEFAULT '',
+    field_value TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX pathways_from_stop_id_idx ON pathways (from_stop_id);
+CREATE INDEX pathways_to_stop_id_idx ON pathways (to_stop_id);
+
 CREATE TABLE vehicle_positions (
     vehicle_id string PRIMARY KEY,
     vehicle_label string,
     trip_id string,
     latitude string,
-    longitude string
+    longitude string,
+    feed_source string NOT NULL DEFAULT ''
 );
 
 CREATE INDEX vehicle_positions_trip_id_idx ON vehicle_positions (trip_id);
@@ -35,7 +76,9 @@ CREATE TABLE stop_time_updates (
     stop_id string,
     trip_id string,
     arrival_time string,
-    vehicle_id string
+    vehicle_id string,
+    feed_source string NOT NULL DEFAULT '',
+    schedule_relationship string NOT NULL DEFAULT ''
 );
 
 CREATE INDEX stop_time_updates_stop_id_idx ON stop_time_updates (stop_id);
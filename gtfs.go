@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// gtfsTables are the static GTFS files we import, in the order
+// gtfs-load.sh imports them.  Each becomes a table of the same name
+// with one TEXT column per CSV column, just like sqlite's .import.
+var gtfsTables = []string{
+	"agency",
+	"calendar",
+	"calendar_dates",
+	"fare_attributes",
+	"fare_rules",
+	"feed_info",
+	"levels",
+	"pathways",
+	"routes",
+	"shapes",
+	"stop_times",
+	"stops",
+	"transfers",
+	"translations",
+	"trips",
+}
+
+// gtfsIndexes mirror the indexes created by gtfs-load.sh, keyed by
+// table.  Dropping the old tables drops their indexes too, so these are
+// recreated after every swap.
+var gtfsIndexes = map[string][]string{
+	"agency":    {`CREATE INDEX agency_id_idx ON agency (agency_id)`},
+	"routes":    {`CREATE INDEX routes_agency_id_idx ON routes (agency_id)`},
+	"transfers": {`CREATE INDEX transfers_from_stop_id_idx ON transfers (from_stop_id)`},
+	"pathways": {
+		`CREATE INDEX pathways_from_stop_id_idx ON pathways (from_stop_id)`,
+		`CREATE INDEX pathways_to_stop_id_idx ON pathways (to_stop_id)`,
+	},
+	"stops": {
+		`CREATE INDEX stops_id_idx ON stops (stop_id)`,
+		`CREATE INDEX stops_parent_station_idx ON stops (parent_station)`,
+	},
+	"stop_times": {
+		`CREATE INDEX stop_times_stop_id_idx ON stop_times (stop_id)`,
+		`CREATE INDEX stop_times_trip_id_idx ON stop_times (trip_id)`,
+	},
+	"trips": {
+		`CREATE INDEX trips_id_idx ON trips (trip_id)`,
+		`CREATE INDEX trips_route_id_idx ON trips (route_id)`,
+	},
+}
+
+// gtfsOptionalColumns are optional columns we query.  Feeds that omit
+// them get them added as empty columns so the queries still work.
+var gtfsOptionalColumns = map[string][]string{
+	"levels": {"level_name"},
+	"pathways": {
+		"length",
+		"traversal_time",
+		"stair_count",
+		"max_slope",
+		"min_width",
+		"signposted_as",
+		"reversed_signposted_as",
+	},
+	"shapes":       {"shape_dist_traveled"},
+	"stops":        {"location_type", "parent_station", "stop_code"},
+	"translations": {"record_id", "record_sub_id", "field_value"},
+	"transfers":    {"min_transfer_time"},
+	"trips":        {"shape_id", "direction_id"},
+}
+
+// gtfsOptionalFiles are the files, with the columns we query that
+// aren't in gtfsOptionalColumns, that COTA doesn't publish.  As in
+// gtfs-load.sh, feeds without them get empty tables so the endpoints
+// that query them return nothing rather than failing.
+var gtfsOptionalFiles = map[string][]string{
+	"levels": {"level_id", "level_index"},
+	"pathways": {
+		"pathway_id",
+		"from_stop_id",
+		"to_stop_id",
+		"pathway_mode",
+		"is_bidirectional",
+	},
+	"translations": {"table_name", "field_name", "language", "translation"},
+}
+
+// gtfsLoader imports static GTFS data into the database.  New data is
+// imported into staging tables and swapped in within a single
+// transaction, so readers never see a half-loaded schedule.
+type gtfsLoader struct {
+	db       *sqlx.DB
+	src      string
+	health   *healthTracker
+	feed     *feedInfoCache
+	trans    *translationCache
+	shapes   *shapeCache
+	stops    *stopCache
+	search   *searchCache
+	patterns *patternCache
+	events   *eventBus
+
+	// maxErrors is the number of validation errors above which a load
+	// is rejected.  Negative values never reject.
+	maxErrors int
+
+	// frozen is set when the loaded feed must never change, so
+	// reloads are refused.
+	frozen bool
+
+	// mu serializes loads.
+	mu sync.Mutex
+
+	// ready is set once the database holds static data to serve.
+	ready atomic.Bool
+
+	// resultMu guards the validation report and diff from the most
+	// recent load.
+	resultMu sync.Mutex
+	report   *validationReport
+	diff     *gtfsDiff
+}
+
+// Load imports the GTFS feed at l.src, replacing the current static
+// data.
+func (l *gtfsLoader) Load(ctx context.Context) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, span := tracer.Start(ctx, "load gtfs")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	start := time.Now()
+	defer func() {
+		l.health.record("static", updateResult{Latency: time.Since(start)}, err)
+	}()
+
+	fsys, closeFeed, err := openGTFS(ctx, l.src)
+	if err != nil {
+		return err
+	}
+	defer closeFeed()
+
+	loaded, err := l.importAll(ctx, fsys)
+	if err != nil {
+		return err
+	}
+	// After a successful swap there are no staging tables left, but
+	// if validation rejects the feed or anything else fails they would
+	// linger until the next load.
+	defer l.dropStaging(context.WithoutCancel(ctx))
+
+	report, err := validateStaging(ctx, l.db, l.src, loaded)
+	if err != nil {
+		return err
+	}
+	report.Rejected = l.maxErrors >= 0 && report.Errors > l.maxErrors
+	l.setValidationReport(report)
+	if report.Rejected {
+		return fmt.Errorf("GTFS failed validation with %d errors", report.Errors)
+	}
+	if report.Errors > 0 || report.Warnings > 0 {
+		slog.Warn("GTFS validation problems", "errors", report.Errors, "warnings", report.Warnings)
+	}
+
+	var oldVersion string
+	if info := l.feed.get(); info != nil {
+		oldVersion = info.Version
+	}
+	diff, err := diffStaging(ctx, l.db, oldVersion, loaded)
+	if err != nil {
+		return err
+	}
+
+	if err := l.swap(ctx, loaded); err != nil {
+		return err
+	}
+
+	l.resultMu.Lock()
+	l.diff = diff
+	l.resultMu.Unlock()
+	slog.Info("GTFS changes",
+		"routes_added", len(diff.RoutesAdded),
+		"routes_removed", len(diff.RoutesRemoved),
+		"stops_added", len(diff.StopsAdded),
+		"stops_removed", len(diff.StopsRemoved),
+		"stops_moved", len(diff.StopsMoved),
+		"trips_added", diff.TripsAdded,
+		"trips_removed", diff.TripsRemoved,
+	)
+
+	if err := l.feed.refresh(ctx, l.db); err != nil {
+		slog.Warn("no feed info in GTFS", "err", err)
+	}
+	if err := l.trans.refresh(ctx, l.db); err != nil {
+		slog.Warn("no translations in GTFS", "err", err)
+	}
+	if err := l.shapes.refresh(ctx, l.db); err != nil {
+		slog.Warn("error loading shapes", "err", err)
+	}
+	if err := l.stops.refresh(ctx, l.db); err != nil {
+		slog.Warn("error indexing stops", "err", err)
+	}
+	if err := l.search.refresh(ctx, l.db); err != nil {
+		slog.Warn("error building search index", "err", err)
+	}
+	if err := l.patterns.refresh(ctx, l.db); err != nil {
+		slog.Warn("error deriving route patterns", "err", err)
+	}
+
+	l.ready.Store(true)
+	l.events.publish(staticReloaded)
+
+	slog.Info("loaded GTFS", "src", redactURL(l.src), "duration", time.Since(start))
+	return nil
+}
+
+// checkReady marks the loader ready if the database already holds
+// static data from an earlier run, and reports whether it does.
+func (l *gtfsLoader) checkReady(ctx context.Context) bool {
+	var n int
+	if err := l.db.GetContext(ctx, &n, `SELECT COUNT(*) FROM routes`); err == nil && n > 0 {
+		l.ready.Store(true)
+	}
+	return l.ready.Load()
+}
+
+// loadWithRetry calls Load until it succeeds, backing off between
+// attempts so a feed outage doesn't turn into a flood of requests.
+func (l *gtfsLoader) loadWithRetry(ctx context.Context) {
+	delay := 10 * time.Second
+	for {
+		err := l.Load(ctx)
+		if err == nil {
+			return
+		}
+
+		slog.Error("error loading GTFS, retrying", "err", err, "delay", delay)
+		time.Sleep(delay)
+		delay = min(delay*2, 10*time.Minute)
+	}
+}
+
+// requireData answers requests with a 503 until there is static data
+// to serve them from.  The admin endpoints, API document, version,
+// metrics, and map page are always available.
+func (l *gtfsLoader) requireData(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !l.ready.Load() && !strings.HasPrefix(req.URL.Path, "/admin/") && req.URL.Path != "/openapi.json" && req.URL.Path != "/version" &&
+			req.URL.Path != "/metrics" && !strings.HasPrefix(req.URL.Path, "/ui/") {
+			rw.Header().Set("Retry-After", "60")
+			writeError(rw, http.StatusServiceUnavailable, "Schedule data is still loading")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (l *gtfsLoader) setValidationReport(r *validationReport) {
+	l.resultMu.Lock()
+	defer l.resultMu.Unlock()
+	l.report = r
+}
+
+// validationReport returns the report from the most recent load, or nil
+// if there hasn't been one.
+func (l *gtfsLoader) validationReport() *validationReport {
+	l.resultMu.Lock()
+	defer l.resultMu.Unlock()
+	return l.report
+}
+
+// lastDiff returns what changed in the most recent load, or nil if no
+// load has replaced existing data.
+func (l *gtfsLoader) lastDiff() *gtfsDiff {
+	l.resultMu.Lock()
+	defer l.resultMu.Unlock()
+	return l.diff
+}
+
+// importAll reads every GTFS file in fsys into staging tables,
+// returning the tables it loaded.  Missing files in gtfsOptionalFiles
+// are staged as empty tables; other missing files are skipped, and swap
+// empties their tables.  If it fails, no staging tables are left.
+func (l *gtfsLoader) importAll(ctx context.Context, fsys fs.FS) ([]string, error) {
+	var loaded []string
+	for _, t := range gtfsTables {
+		n, err := l.importFile(ctx, fsys, t)
+		if _, optional := gtfsOptionalFiles[t]; optional && errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("optional GTFS file missing, creating empty table", "file", t+".txt")
+			n, err = 0, l.createEmptyStaging(ctx, t)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("GTFS file missing, skipping", "file", t+".txt")
+			continue
+		}
+		if err != nil {
+			l.dropStaging(context.WithoutCancel(ctx))
+			return nil, fmt.Errorf("%s.txt: %w", t, err)
+		}
+		slog.Debug("imported GTFS file", "file", t+".txt", "rows", n)
+		loaded = append(loaded, t)
+	}
+	return loaded, nil
+}
+
+// maxInsertParams is the most parameters bound to a single INSERT,
+// which is SQLite's default limit before 3.32.
+const maxInsertParams = 999
+
+func stagingTable(t string) string {
+	return t + "_staging"
+}
+
+// dropStaging drops any staging tables, logging rather than returning
+// errors since it only cleans up after a load.
+func (l *gtfsLoader) dropStaging(ctx context.Context) {
+	for _, t := range gtfsTables {
+		if _, err := l.db.ExecContext(ctx, `DROP TABLE IF EXISTS `+stagingTable(t)); err != nil {
+			slog.Warn("error dropping GTFS staging table", "table", stagingTable(t), "err", err)
+		}
+	}
+}
+
+// createEmptyStaging creates an empty staging table for an optional
+// file the feed doesn't have, with the columns in gtfsOptionalFiles and
+// gtfsOptionalColumns.
+func (l *gtfsLoader) createEmptyStaging(ctx context.Context, table string) error {
+	var cols []string
+	for _, c := range gtfsOptionalFiles[table] {
+		cols = append(cols, `"`+c+`" TEXT`)
+	}
+	for _, c := range gtfsOptionalColumns[table] {
+		cols = append(cols, `"`+c+`" TEXT NOT NULL DEFAULT ''`)
+	}
+
+	staging := stagingTable(table)
+	if _, err := l.db.ExecContext(ctx, `DROP TABLE IF EXISTS `+staging); err != nil {
+		return err
+	}
+	_, err := l.db.ExecContext(ctx, `CREATE TABLE `+staging+` (`+strings.Join(cols, ", ")+`)`)
+	return err
+}
+
+// importFile reads table.txt from fsys into a fresh staging table,
+// returning the number of rows imported.
+func (l *gtfsLoader) importFile(ctx context.Context, fsys fs.FS, table string) (int, error) {
+	f, err := fsys.Open(table + ".txt")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, len(header))
+	cols := make([]string, len(header))
+	have := map[string]bool{}
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		names[i] = `"` + h + `"`
+		cols[i] = names[i] + ` TEXT`
+		have[h] = true
+	}
+	for _, c := range gtfsOptionalColumns[table] {
+		if !have[c] {
+			cols = append(cols, `"`+c+`" TEXT NOT NULL DEFAULT ''`)
+		}
+	}
+	r.FieldsPerRecord = len(header)
+
+	staging := stagingTable(table)
+
+	tx, err := l.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + staging); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`CREATE TABLE ` + staging + ` (` + strings.Join(cols, ", ") + `)`); err != nil {
+		return 0, err
+	}
+
+	// Rows are inserted several at a time, as many as fit under
+	// SQLite's limit on bound parameters, rather than one per
+	// statement.
+	batch := max(1, maxInsertParams/len(header))
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(header)), ", ") + ")"
+	insert := `INSERT INTO ` + staging + ` (` + strings.Join(names, ", ") + `) VALUES `
+	prepare := func(rows int) (*sql.Stmt, error) {
+		return tx.PrepareContext(ctx, insert+strings.TrimSuffix(strings.Repeat(row+", ", rows), ", "))
+	}
+
+	stmt, err := prepare(batch)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 0, batch*len(header))
+	var n int
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		for _, v := range rec {
+			args = append(args, v)
+		}
+		n++
+
+		if len(args) == cap(args) {
+			if _, err := stmt.ExecContext(ctx, args...); err != nil {
+				return 0, err
+			}
+			args = args[:0]
+		}
+	}
+
+	if len(args) > 0 {
+		tail, err := prepare(len(args) / len(header))
+		if err != nil {
+			return 0, err
+		}
+		defer tail.Close()
+		if _, err := tail.ExecContext(ctx, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+// swap replaces the live tables with their staging copies and rebuilds
+// their indexes, all in one transaction.  Live tables for files the new
+// feed doesn't have are emptied, so that data from an older feed, like
+// its transfers or translations, doesn't outlive it.
+func (l *gtfsLoader) swap(ctx context.Context, tables []string) error {
+	tx, err := l.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range gtfsTables {
+		if slices.Contains(tables, t) {
+			continue
+		}
+		var n int
+		if err := tx.GetContext(ctx, &n, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, t); err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM ` + t); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range tables {
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + t); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`ALTER TABLE ` + stagingTable(t) + ` RENAME TO ` + t); err != nil {
+			return err
+		}
+		for _, q := range gtfsIndexes[t] {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestSwapEmptiesMissingFiles checks that a table from an earlier feed
+// is emptied when a new feed doesn't have its file.
+func TestSwapEmptiesMissingFiles(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	fsys["transfers.txt"] = &fstest.MapFile{Data: []byte("from_stop_id,to_stop_id,transfer_type\nHIGBRON,HIGGAYN,0\n")}
+	db := newTestDB(t, fsys)
+
+	l := &gtfsLoader{db: db}
+	loaded, err := l.importAll(ctx, emptyGTFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.swap(ctx, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM transfers`); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("transfers has %d rows from the old feed, want 0", n)
+	}
+}
+
+// TestImportFailureDropsStaging checks that a failed import doesn't
+// leave staging tables behind.
+func TestImportFailureDropsStaging(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, emptyGTFS)
+
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	// A row with too many fields fails the import after the earlier
+	// files were staged.
+	fsys["stops.txt"] = &fstest.MapFile{Data: []byte("stop_id,stop_name,stop_lat,stop_lon\nHIGBRON,High St,39.962,-83.0,extra\n")}
+
+	l := &gtfsLoader{db: db}
+	if _, err := l.importAll(ctx, fsys); err == nil {
+		t.Fatal("importAll succeeded with a malformed stops.txt")
+	}
+
+	var staged []string
+	if err := db.Select(&staged, `SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE '%\_staging' ESCAPE '\'`); err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) > 0 {
+		t.Errorf("staging tables left after a failed import: %v", staged)
+	}
+}
+
+// TestMissingOptionalFiles checks that the endpoints for files COTA
+// doesn't publish return nothing, rather than failing, for a feed
+// without them.
+func TestMissingOptionalFiles(t *testing.T) {
+	db := newTestDB(t, emptyGTFS)
+
+	for path, h := range map[string]http.HandlerFunc{
+		"/cota/levels":          handleLevels(db),
+		"/cota/pathways?stop=x": handlePathways(db),
+	} {
+		rw := httptest.NewRecorder()
+		h(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != "[]" {
+			t.Errorf("%s = %d %s, want 200 []", path, rw.Code, rw.Body)
+		}
+	}
+
+	var n int
+	if err := db.Get(&n, `SELECT COUNT(*) FROM translations`); err != nil {
+		t.Errorf("translations: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// openGTFS opens a static GTFS feed for reading.  src may be a
+// directory of .txt files, a zip file, a file:// URL to either, or an
+// http(s), s3, or gs URL to a zip file.  The returned function releases any
+// resources held by the feed.
+func openGTFS(ctx context.Context, src string) (fs.FS, func() error, error) {
+	nop := func() error { return nil }
+
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") || isObjectURL(src) {
+		d, err := fetchURLBody(ctx, src)
+		if err != nil {
+			return nil, nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+		if err != nil {
+			return nil, nil, err
+		}
+		recordStaticFeed(src, zr, d, time.Now())
+		return zr, nop, nil
+	}
+
+	path := src
+	if strings.HasPrefix(src, "file://") {
+		u, err := url.Parse(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		path = u.Path
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return os.DirFS(path), nop, nil
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zr, zr.Close, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gtfsTime is a stop time from the static schedule: the number of
+// seconds after "noon minus 12h" on the service day.  That's midnight
+// except on days with a daylight saving time change, and trips that run
+// past midnight have times like 25:15:00.
+type gtfsTime int
+
+func parseGTFSTime(s string) (gtfsTime, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid GTFS time %q", s)
+	}
+
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid GTFS time %q", s)
+		}
+		n[i] = v
+	}
+	if n[1] > 59 || n[2] > 59 {
+		return 0, fmt.Errorf("invalid GTFS time %q", s)
+	}
+
+	return gtfsTime(n[0]*3600 + n[1]*60 + n[2]), nil
+}
+
+func (t gtfsTime) String() string {
+	return fmt.Sprintf("%02d:%02d:%02d", t/3600, t/60%60, t%60)
+}
+
+// On returns the time t on the service day of date.
+func (t gtfsTime) On(date time.Time) time.Time {
+	return serviceDayStart(date).Add(time.Duration(t) * time.Second)
+}
+
+// Near returns t on the service day of at or the day before, whichever
+// is closer to at.  Realtime data doesn't say which service day a trip
+// belongs to, and trips that run past midnight belong to the day
+// before.
+func (t gtfsTime) Near(at time.Time) time.Time {
+	today := t.On(at)
+	if prev := t.On(at.AddDate(0, 0, -1)); at.Sub(prev).Abs() < at.Sub(today).Abs() {
+		return prev
+	}
+	return today
+}
+
+// scheduleDelay returns how many seconds actual is behind the stop time
+// sched, or nil if sched isn't a valid stop time.  loc is the time zone
+// of the schedule.
+func scheduleDelay(actual time.Time, sched string, loc *time.Location) *int {
+	t, err := parseGTFSTime(sched)
+	if err != nil {
+		return nil
+	}
+	actual = actual.In(loc)
+	d := int(actual.Sub(t.Near(actual)) / time.Second)
+	return &d
+}
+
+// Scan lets stop times be read straight from the database.
+func (t *gtfsTime) Scan(v interface{}) error {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into gtfsTime", v)
+	}
+
+	var err error
+	*t, err = parseGTFSTime(s)
+	return err
+}
+
+func (t gtfsTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + t.String() + `"`), nil
+}
+
+// serviceDays returns the service days that can have trips running at
+// t: the day before, for trips that run past midnight with times like
+// 25:10:00, and t's own day.
+func serviceDays(t time.Time) []time.Time {
+	return []time.Time{t.AddDate(0, 0, -1), t}
+}
+
+// serviceDayStart returns noon minus 12h on date's day, in date's
+// location, which is what GTFS stop times count from.
+func serviceDayStart(date time.Time) time.Time {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 12, 0, 0, 0, date.Location()).Add(-12 * time.Hour)
+}
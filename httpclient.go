@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// feedClient makes the server's outbound requests: static and realtime
+// feeds, object storage, feed discovery, and a followed instance's
+// snapshots.  It shares one pool of connections, so polling reuses
+// them, and is configured with the -outbound-* flags.
+var feedClient = mustHTTPClient(httpClientOptions{
+	Timeout:     60 * time.Second,
+	Retries:     2,
+	RetryWait:   time.Second,
+	MaxIdleHost: 4,
+})
+
+type httpClientOptions struct {
+	// Timeout bounds a whole request, including reading the body, so
+	// a stalled upstream can't hold up an update cycle indefinitely.
+	Timeout time.Duration
+
+	// Retries is how many times a GET, HEAD, or PUT is retried after
+	// a network error or a 429 or 5xx response, waiting RetryWait
+	// and then twice as long each time.
+	Retries   int
+	RetryWait time.Duration
+
+	// Proxy is the URL of a proxy for every request.  If empty, the
+	// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables
+	// are used.
+	Proxy string
+
+	// MaxIdleHost is how many idle connections to keep to each host.
+	MaxIdleHost int
+}
+
+func newHTTPClient(o httpClientOptions) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = o.MaxIdleHost
+	t.DialContext = (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.ResponseHeaderTimeout = o.Timeout
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", o.Proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	var rt http.RoundTripper = t
+	if o.Retries > 0 {
+		rt = &retryTransport{next: t, retries: o.Retries, wait: o.RetryWait}
+	}
+	return &http.Client{Transport: rt, Timeout: o.Timeout}, nil
+}
+
+func mustHTTPClient(o httpClientOptions) *http.Client {
+	c, err := newHTTPClient(o)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// retryTransport retries idempotent requests that fail in ways that
+// might not happen again.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	wait    time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodPut
+	if !idempotent || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return t.next.RoundTrip(req)
+	}
+
+	wait := t.wait
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		retry := err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+		if err == nil {
+			retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		}
+		if !retry || attempt == t.retries {
+			return resp, err
+		}
+
+		d := wait
+		if resp != nil {
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				d = time.Duration(s) * time.Second
+			}
+			resp.Body.Close()
+		}
+		slog.Debug("retrying request", "url", redactURL(req.URL.String()), "attempt", attempt+1, "wait", d, "err", err)
+
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCachedResponses bounds how many responses a jsonCache holds, since
+// arguments like route come from clients.
+const maxCachedResponses = 1000
+
+// jsonCache holds marshaled responses for collections that only change
+// when static data is reloaded, so requests for them don't each encode
+// the whole collection again.
+type jsonCache struct {
+	mu      sync.Mutex
+	gen     int
+	entries map[string]cachedJSON
+}
+
+type cachedJSON struct {
+	body    []byte
+	expires time.Time // zero if it lasts until a reload
+}
+
+// watch forgets the cached responses whenever static data is reloaded.
+func (c *jsonCache) watch(events *eventBus) {
+	ch := events.subscribe(staticReloaded)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		c.mu.Lock()
+		c.gen++
+		c.entries = nil
+		c.mu.Unlock()
+	}
+}
+
+// get returns the response cached under key, or marshals the result of
+// build and caches that.  A ttl other than zero also expires it after
+// that long on the feed clock, for responses that change over the day.
+func (c *jsonCache) get(key string, ttl time.Duration, build func() (any, error)) ([]byte, error) {
+	now := feedNow()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && (e.expires.IsZero() || now.Before(e.expires)) {
+		return e.body, nil
+	}
+
+	v, err := build()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Match json.Encoder, which the uncached responses are written
+	// with.
+	body = append(body, '\n')
+
+	e = cachedJSON{body: body}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	c.mu.Lock()
+	// A response built from data a reload has since replaced isn't
+	// kept.
+	_, exists := c.entries[key]
+	if gen == c.gen && (exists || len(c.entries) < maxCachedResponses) {
+		if c.entries == nil {
+			c.entries = map[string]cachedJSON{}
+		}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	return body, nil
+}
+
+func writeCachedJSON(rw http.ResponseWriter, body []byte) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
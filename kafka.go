@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// kafkaClient publishes messages to Kafka through a Confluent REST
+// Proxy.  Each kind of data goes to its own topic, keyed by the route
+// or stop it is for, so a compacted topic keeps the latest message for
+// each.
+type kafkaClient struct {
+	proxy string
+}
+
+func (c *kafkaClient) String() string { return c.proxy }
+
+// topic joins the prefix and kind with a dot to name the Kafka topic,
+// and appends the rest as the message key after a slash, which can't
+// appear in topic names.  Characters topic names can't have are
+// replaced.
+func (c *kafkaClient) topic(parts ...string) string {
+	valid := func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}
+	topic := strings.Map(valid, parts[0]+"."+parts[1])
+	return topic + "/" + strings.Join(parts[2:], "/")
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (c *kafkaClient) publish(msgs []streamMessage) error {
+	byTopic := map[string][]kafkaRecord{}
+	for _, m := range msgs {
+		topic, key, _ := strings.Cut(m.topic, "/")
+		byTopic[topic] = append(byTopic[topic], kafkaRecord{Key: key, Value: m.payload})
+	}
+
+	for topic, records := range byTopic {
+		d, err := json.Marshal(map[string][]kafkaRecord{"records": records})
+		if err != nil {
+			return err
+		}
+		u := strings.TrimSuffix(c.proxy, "/") + "/topics/" + url.PathEscape(topic)
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(d))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+		req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+		resp, err := feedClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("producing to %s: %s", topic, resp.Status)
+		}
+	}
+	return nil
+}
+
+// ping does nothing, since the proxy is reached over plain HTTP
+// requests.
+func (c *kafkaClient) ping() error { return nil }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKafkaPublish(t *testing.T) {
+	got := map[string][]kafkaRecord{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var body struct {
+			Records []kafkaRecord `json:"records"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		got[req.URL.Path] = append(got[req.URL.Path], body.Records...)
+	}))
+	defer srv.Close()
+
+	c := &kafkaClient{proxy: srv.URL + "/"}
+	msgs := []streamMessage{
+		{c.topic("cota", "vehicles", "2"), []byte(`[{"id":"1"}]`)},
+		{c.topic("cota", "vehicles", "CMAX"), []byte(`[]`)},
+		{c.topic("cota", "predictions", "HIG/BRON"), []byte(`[]`)},
+	}
+	if err := c.publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs := got["/topics/cota.vehicles"]; len(rs) != 2 || rs[0].Key != "2" || string(rs[0].Value) != `[{"id":"1"}]` || rs[1].Key != "CMAX" {
+		t.Errorf("cota.vehicles records = %+v", rs)
+	}
+	if rs := got["/topics/cota.predictions"]; len(rs) != 1 || rs[0].Key != "HIG/BRON" {
+		t.Errorf("cota.predictions records = %+v", rs)
+	}
+}
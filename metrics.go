@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// bunchingMeters is how close two vehicles on the same shape have to be
+// to count as bunched.
+const bunchingMeters = 300
+
+type requestMetricKey struct {
+	pattern string
+	status  int
+}
+
+type requestMetric struct {
+	count   uint64
+	seconds float64
+}
+
+// requestMetrics counts requests by the mux pattern that served them,
+// rather than by path, so arguments and IDs in paths don't each get
+// their own series.
+type requestMetrics struct {
+	mu       sync.Mutex
+	requests map[requestMetricKey]*requestMetric
+
+	// statsd, if set, is also sent every request.
+	statsd *statsdClient
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{requests: map[requestMetricKey]*requestMetric{}}
+}
+
+// middleware records each request.  It has to wrap the mux directly
+// (or handlers that pass the request on unchanged) to see the pattern
+// the mux matched.
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec, ok := rw.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: rw}
+		}
+		next.ServeHTTP(rec, req)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		pattern := req.Pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		m.observe(pattern, status, time.Since(start))
+	})
+}
+
+func (m *requestMetrics) observe(pattern string, status int, d time.Duration) {
+	m.mu.Lock()
+	k := requestMetricKey{pattern, status}
+	r := m.requests[k]
+	if r == nil {
+		r = &requestMetric{}
+		m.requests[k] = r
+	}
+	r.count++
+	r.seconds += d.Seconds()
+	m.mu.Unlock()
+
+	if m.statsd != nil {
+		code := strconv.Itoa(status)
+		m.statsd.count("http.requests", 1, "pattern", pattern, "code", code)
+		m.statsd.timing("http.request_duration", d, "pattern", pattern)
+	}
+}
+
+// snapshot returns a copy of the request counts, sorted by pattern and
+// status.
+func (m *requestMetrics) snapshot() ([]requestMetricKey, []requestMetric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestMetricKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pattern != keys[j].pattern {
+			return keys[i].pattern < keys[j].pattern
+		}
+		return keys[i].status < keys[j].status
+	})
+	vals := make([]requestMetric, len(keys))
+	for i, k := range keys {
+		vals[i] = *m.requests[k]
+	}
+	return keys, vals
+}
+
+// routeGauge is the current state of service on one route.
+type routeGauge struct {
+	RouteID string
+
+	Vehicles    int
+	Predictions int
+
+	// Delayed is how many vehicles have a delay, and DelaySeconds the
+	// sum of their delays.
+	Delayed      int
+	DelaySeconds int
+
+	// Bunched is how many pairs of vehicles on the same shape are
+	// within bunchingMeters of each other.
+	Bunched int
+}
+
+// routeGauges returns a gauge for every route with vehicles or
+// predictions, sorted by route.
+func routeGauges(ctx context.Context, db *sqlx.DB, shapes *shapeCache) ([]*routeGauge, error) {
+	byRoute := map[string]*routeGauge{}
+	gauge := func(route string) *routeGauge {
+		g := byRoute[route]
+		if g == nil {
+			g = &routeGauge{RouteID: route}
+			byRoute[route] = g
+		}
+		return g
+	}
+
+	vehicles, err := selectVehicles(ctx, db, shapes, "")
+	if err != nil {
+		return nil, err
+	}
+	byShape := map[string][]vehicle{}
+	for _, v := range vehicles {
+		g := gauge(v.RouteID)
+		g.Vehicles++
+		if v.Delay != nil {
+			g.Delayed++
+			g.DelaySeconds += *v.Delay
+		}
+		if v.ShapeID != "" {
+			byShape[v.ShapeID] = append(byShape[v.ShapeID], v)
+		}
+	}
+	for _, vs := range byShape {
+		for i := range vs {
+			for j := i + 1; j < len(vs); j++ {
+				d := distanceMeters(float64(vs[i].Latitude), float64(vs[i].Longitude), float64(vs[j].Latitude), float64(vs[j].Longitude))
+				if d < bunchingMeters {
+					gauge(vs[i].RouteID).Bunched++
+				}
+			}
+		}
+	}
+
+	var counts []struct {
+		RouteID string `db:"route_id"`
+		N       int    `db:"n"`
+	}
+	const q = `SELECT trips.route_id, COUNT(*) AS n
+		   FROM stop_time_updates AS stu
+		   INNER JOIN trips ON stu.trip_id = trips.trip_id
+		   WHERE stu.arrival_time >= ?
+		   GROUP BY trips.route_id`
+	if err := dbSelect(ctx, db, "prediction counts", &counts, q, feedNow().Unix()); err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		gauge(c.RouteID).Predictions = c.N
+	}
+
+	out := make([]*routeGauge, 0, len(byRoute))
+	for _, g := range byRoute {
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].RouteID < out[j].RouteID })
+	return out, nil
+}
+
+// handleMetrics serves request counts and per-route service gauges in
+// the Prometheus text format.
+func handleMetrics(db *sqlx.DB, shapes *shapeCache, requests *requestMetrics) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := &strings.Builder{}
+
+		keys, vals := requests.snapshot()
+		writeMetricHeader(w, "cota_bus_http_requests_total", "counter", "Requests served, by mux pattern and status code.")
+		for i, k := range keys {
+			writeMetric(w, "cota_bus_http_requests_total", float64(vals[i].count), "pattern", k.pattern, "code", strconv.Itoa(k.status))
+		}
+
+		// Durations are summed across statuses.
+		type duration struct {
+			count   uint64
+			seconds float64
+		}
+		var patterns []string
+		durations := map[string]*duration{}
+		for i, k := range keys {
+			d := durations[k.pattern]
+			if d == nil {
+				d = &duration{}
+				durations[k.pattern] = d
+				patterns = append(patterns, k.pattern)
+			}
+			d.count += vals[i].count
+			d.seconds += vals[i].seconds
+		}
+		writeMetricHeader(w, "cota_bus_http_request_duration_seconds", "summary", "Time spent serving requests, by mux pattern.")
+		for _, p := range patterns {
+			writeMetric(w, "cota_bus_http_request_duration_seconds_sum", durations[p].seconds, "pattern", p)
+			writeMetric(w, "cota_bus_http_request_duration_seconds_count", float64(durations[p].count), "pattern", p)
+		}
+
+		gauges, err := routeGauges(req.Context(), db, shapes)
+		if err != nil {
+			// Request metrics are still worth scraping without them.
+			slog.Error("error computing route gauges", "err", err)
+			gauges = nil
+		}
+		writeMetricHeader(w, "cota_bus_route_active_vehicles", "gauge", "Vehicles currently reporting positions on the route.")
+		for _, g := range gauges {
+			writeMetric(w, "cota_bus_route_active_vehicles", float64(g.Vehicles), "route", g.RouteID)
+		}
+		writeMetricHeader(w, "cota_bus_route_average_delay_seconds", "gauge", "Average predicted delay of the route's vehicles, negative if ahead of schedule.")
+		for _, g := range gauges {
+			if g.Delayed > 0 {
+				writeMetric(w, "cota_bus_route_average_delay_seconds", float64(g.DelaySeconds)/float64(g.Delayed), "route", g.RouteID)
+			}
+		}
+		writeMetricHeader(w, "cota_bus_route_predictions", "gauge", "Upcoming stop arrival predictions for the route.")
+		for _, g := range gauges {
+			writeMetric(w, "cota_bus_route_predictions", float64(g.Predictions), "route", g.RouteID)
+		}
+		writeMetricHeader(w, "cota_bus_route_bunching_incidents", "gauge", fmt.Sprintf("Pairs of vehicles on the same shape within %d meters of each other.", bunchingMeters))
+		for _, g := range gauges {
+			writeMetric(w, "cota_bus_route_bunching_incidents", float64(g.Bunched), "route", g.RouteID)
+		}
+
+		io.WriteString(rw, w.String())
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetric writes one sample, with labels given as name, value
+// pairs.
+func writeMetric(w io.Writer, name string, value float64, labels ...string) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+)
+
+// requestID returns the ID assigned to the request by requestLogger,
+// or the empty string.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder captures the status code and number of bytes written
+// by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Hijack lets the websocket endpoint take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestLogger assigns each request an ID, echoes it in the
+// X-Request-ID response header, and writes an access log line when the
+// request completes.  A well-formed X-Request-ID sent by the client (or
+// a proxy in front of us) is reused.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		rw.Header().Set("X-Request-ID", id)
+
+		rec := &statusRecorder{ResponseWriter: rw}
+		ctx := context.WithValue(req.Context(), requestIDKey, id)
+		next.ServeHTTP(rec, req.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		slog.Info("request",
+			"request_id", id,
+			"method", req.Method,
+			"path", redactedRequestURI(req),
+			"status", rec.status,
+			"duration", time.Since(start),
+			"bytes", rec.bytes,
+			"remote", req.RemoteAddr,
+		)
+	})
+}
+
+// redactedRequestURI is the request's path and query, with the query's
+// values hidden, since clients can pass their API key as api_key.
+func redactedRequestURI(req *http.Request) string {
+	u := url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: redactQuery(req.URL.RawQuery)}
+	return u.RequestURI()
+}
+
+// recoverPanics turns a panic in a handler into a logged stack trace
+// and a 500 response instead of a dropped connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rec, ok := rw.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: rw}
+		}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			slog.Error("panic serving request",
+				"request_id", requestID(req.Context()),
+				"method", req.Method,
+				"path", redactedRequestURI(req),
+				"panic", v,
+				"stack", string(debug.Stack()),
+			)
+
+			// If the handler already started writing its response
+			// there is nothing useful we can add to it.
+			if rec.status == 0 {
+				writeError(rec, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+
+		next.ServeHTTP(rec, req)
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestLogsRedactQuery checks that API keys passed in the query don't
+// end up in the access and panic logs.
+func TestLogsRedactQuery(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	h := requestLogger(recoverPanics(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cota/stops?route=2&api_key=secret", nil))
+
+	logs := buf.String()
+	if strings.Contains(logs, "secret") {
+		t.Errorf("API key logged:\n%s", logs)
+	}
+	if n := strings.Count(logs, "/cota/stops?route=xxxxx&api_key=xxxxx"); n != 2 {
+		t.Errorf("redacted path logged %d times, want 2:\n%s", n, logs)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttKeepAlive is the keep alive interval sent to the broker.
+const mqttKeepAlive = 30 * time.Second
+
+var errMQTTNotConnected = errors.New("not connected to MQTT broker")
+
+// mqttClient publishes messages at QoS 0 to an MQTT broker.
+type mqttClient struct {
+	addr   string
+	client mqtt.Client
+}
+
+// newMQTTClient returns a client for the broker at addr, which is
+// either host:port or a tcp://, ssl://, ws://, or wss:// URL.  It
+// connects in the background, reconnecting whenever the connection is
+// lost, and messages published while it isn't connected are dropped.
+func newMQTTClient(addr, clientID, username, password string) *mqttClient {
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(addr).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetKeepAlive(mqttKeepAlive).
+		SetConnectTimeout(10 * time.Second).
+		SetWriteTimeout(10 * time.Second).
+		SetConnectRetry(true).
+		SetAutoReconnect(true)
+
+	c := &mqttClient{addr: addr, client: mqtt.NewClient(opts)}
+	c.client.Connect()
+	return c
+}
+
+func (c *mqttClient) String() string { return c.addr }
+
+// topic joins parts with slashes.  Wildcards can't be published to, so
+// they are replaced, as are slashes in any part but the prefix.
+func (c *mqttClient) topic(parts ...string) string {
+	r := strings.NewReplacer("/", "_", "+", "_", "#", "_")
+	topic := parts[0]
+	for _, p := range parts[1:] {
+		topic += "/" + r.Replace(p)
+	}
+	return topic
+}
+
+func (c *mqttClient) publish(msgs []streamMessage) error {
+	if !c.client.IsConnectionOpen() {
+		return errMQTTNotConnected
+	}
+
+	// QoS 0, retained, so new subscribers get the latest data right
+	// away.
+	tokens := make([]mqtt.Token, len(msgs))
+	for i, m := range msgs {
+		tokens[i] = c.client.Publish(m.topic, 0, true, m.payload)
+	}
+	for _, t := range tokens {
+		if !t.WaitTimeout(10 * time.Second) {
+			return errors.New("timed out publishing to MQTT broker")
+		}
+		if err := t.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ping reports whether the client is connected.  The client keeps the
+// connection alive itself.
+func (c *mqttClient) ping() error {
+	if !c.client.IsConnectionOpen() {
+		return errMQTTNotConnected
+	}
+	return nil
+}
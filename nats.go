@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsClient publishes messages to a NATS server.
+type natsClient struct {
+	addr string
+	conn *nats.Conn
+}
+
+// newNATSClient returns a client for the NATS server at addr, which is
+// either host:port or a nats:// or tls:// URL, optionally with a
+// username and password.  It connects in the background if the server
+// can't be reached yet, and reconnects whenever the connection is
+// lost.
+func newNATSClient(addr, token string) (*natsClient, error) {
+	opts := []nats.Option{
+		nats.Name("cota-bus"),
+		nats.Timeout(10 * time.Second),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+	conn, err := nats.Connect(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsClient{addr: addr, conn: conn}, nil
+}
+
+func (c *natsClient) String() string { return c.addr }
+
+// topic joins parts with dots.  Subject tokens can't contain dots,
+// wildcards, or whitespace, so they are replaced in any part but the
+// prefix.
+func (c *natsClient) topic(parts ...string) string {
+	r := strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_")
+	subject := parts[0]
+	for _, p := range parts[1:] {
+		subject += "." + r.Replace(p)
+	}
+	return subject
+}
+
+func (c *natsClient) publish(msgs []streamMessage) error {
+	for _, m := range msgs {
+		if err := c.conn.Publish(m.topic, m.payload); err != nil {
+			return err
+		}
+	}
+	return c.conn.FlushTimeout(10 * time.Second)
+}
+
+func (c *natsClient) ping() error {
+	return c.conn.FlushTimeout(10 * time.Second)
+}
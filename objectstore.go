@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Static feeds, recordings, and archives can live in S3 or Google Cloud
+// Storage, named by s3://bucket/key and gs://bucket/object URLs.
+// Credentials are found the way the AWS SDK and Google's application
+// default credentials find them.  With no credentials, requests are
+// sent unsigned, which works for public buckets.
+
+// gcsScope is the OAuth scope GCS requests are authorized with.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// isObjectURL reports whether s names an object in S3 or GCS.
+func isObjectURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+// objectJoin appends path elements to an object URL.
+func objectJoin(base string, elem ...string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(elem, "/")
+}
+
+// parseObjectURL splits an object URL into its scheme, bucket, and key.
+func parseObjectURL(u string) (scheme, bucket, key string, err error) {
+	scheme, rest, _ := strings.Cut(u, "://")
+	bucket, key, _ = strings.Cut(rest, "/")
+	if (scheme != "s3" && scheme != "gs") || bucket == "" || key == "" {
+		return "", "", "", fmt.Errorf("invalid object URL %q", u)
+	}
+	return scheme, bucket, key, nil
+}
+
+// getObject returns the contents of the object at u.
+func getObject(ctx context.Context, u string) ([]byte, error) {
+	scheme, bucket, key, err := parseObjectURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "s3" {
+		client, err := s3Client()
+		if err != nil {
+			return nil, err
+		}
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+		if err != nil {
+			return nil, err
+		}
+		defer out.Body.Close()
+		return io.ReadAll(out.Body)
+	}
+
+	resp, err := gcsDo(ctx, http.MethodGet, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// putObject writes d to the object at u.
+func putObject(ctx context.Context, u string, d []byte) error {
+	scheme, bucket, key, err := parseObjectURL(u)
+	if err != nil {
+		return err
+	}
+
+	if scheme == "s3" {
+		client, err := s3Client()
+		if err != nil {
+			return err
+		}
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{Bucket: &bucket, Key: &key, Body: bytes.NewReader(d)})
+		return err
+	}
+
+	resp, err := gcsDo(ctx, http.MethodPut, bucket, key, d)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Client returns a client configured from the environment, shared
+// config and credentials files, and the ECS and EC2 metadata
+// endpoints.  AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL point it at an
+// S3-compatible service instead, using path-style URLs.
+var s3Client = sync.OnceValues(func() (*s3.Client, error) {
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		slog.Info("no AWS credentials found, sending S3 requests unsigned", "err", err)
+		cfg.Credentials = aws.AnonymousCredentials{}
+	}
+
+	custom := os.Getenv("AWS_ENDPOINT_URL_S3") != "" || os.Getenv("AWS_ENDPOINT_URL") != ""
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = custom
+	}), nil
+})
+
+// gcsClient returns a client that authorizes requests with the
+// application default credentials, or sends them unsigned if there
+// are none.
+var gcsClient = sync.OnceValue(func() *http.Client {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, feedClient)
+	client, err := google.DefaultClient(ctx, gcsScope)
+	if err != nil {
+		slog.Info("no Google credentials found, sending GCS requests unsigned", "err", err)
+		return feedClient
+	}
+	return client
+})
+
+// gcsDo sends a request for a GCS object through its XML API, returning
+// an error unless it succeeds.
+func gcsDo(ctx context.Context, method, bucket, object string, body []byte) (*http.Response, error) {
+	u := "https://storage.googleapis.com/" + bucket + "/" + objectPathEscape(object)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gcsClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+// objectPathEscape escapes an object name for a URL path, leaving its
+// slashes alone.
+func objectPathEscape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// occupancyWindow is how long occupancy observations are kept for.
+const occupancyWindow = 7 * 24 * time.Hour
+
+// occupancyLevels are the GTFS-realtime occupancy statuses, as stored
+// in vehicle_positions, from least to most crowded.
+var occupancyLevels = [...]string{
+	"empty",
+	"many_seats_available",
+	"few_seats_available",
+	"standing_room_only",
+	"crushed_standing_room_only",
+	"full",
+	"not_accepting_passengers",
+}
+
+type occupancyCounts [len(occupancyLevels)]int
+
+type occupancyRow struct {
+	RouteID string `json:"route_id"`
+	StopID  string `json:"stop_id"`
+	Hour    int    `json:"hour"`
+
+	// Observations is how many vehicles were seen approaching the
+	// stop, and Counts how many of them reported each status.
+	Observations int            `json:"observations"`
+	Counts       map[string]int `json:"counts"`
+
+	// Typical is the status reported most often, or the more crowded
+	// of those tied for it.
+	Typical string `json:"typical"`
+}
+
+// occupancyTracker records how crowded vehicles are as they approach
+// each stop, keeping counts of each occupancy status by route, stop,
+// and hour of the day for occupancyWindow.  The counts are kept in the
+// occupancy_counts table, so they survive restarts.
+type occupancyTracker struct {
+	db *sqlx.DB
+
+	// mu guards approaching.
+	mu sync.Mutex
+
+	// approaching is the trip and stop each vehicle was last counted
+	// approaching, so a vehicle is only counted once per stop.
+	approaching map[string]tripStop
+}
+
+func newOccupancyTracker(db *sqlx.DB) *occupancyTracker {
+	return &occupancyTracker{
+		db:          db,
+		approaching: map[string]tripStop{},
+	}
+}
+
+// run records occupancy from each vehicle positions snapshot as it
+// arrives.
+func (o *occupancyTracker) run(events *eventBus) {
+	ch := events.subscribe(vehiclesUpdated)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		if err := o.record(context.Background(), feedNow()); err != nil {
+			slog.Error("error recording occupancy", "err", err)
+		}
+	}
+}
+
+// record counts the occupancy of every vehicle reporting one against
+// the next stop on its trip, as given by the trip updates feed.
+func (o *occupancyTracker) record(ctx context.Context, now time.Time) error {
+	var rows []struct {
+		VehicleID string `db:"vehicle_id"`
+		TripID    string `db:"trip_id"`
+		RouteID   string `db:"route_id"`
+		StopID    string `db:"stop_id"`
+		Occupancy string `db:"occupancy_status"`
+	}
+	// Vehicles without an occupancy are selected too, so that one
+	// that stops reporting it for a snapshot isn't forgotten and
+	// counted again at the same stop.
+	const q = `SELECT vp.vehicle_id, vp.trip_id, trips.route_id, vp.occupancy_status,
+		          COALESCE((SELECT stu.stop_id FROM stop_time_updates AS stu
+		                    WHERE stu.trip_id = vp.trip_id AND stu.arrival_time >= ?
+		                    ORDER BY stu.arrival_time LIMIT 1), '') AS stop_id
+		   FROM vehicle_positions AS vp
+		   INNER JOIN trips ON vp.trip_id = trips.trip_id`
+	if err := dbSelect(ctx, o.db, "vehicle occupancy", &rows, q, now.Unix()); err != nil {
+		return err
+	}
+
+	local := now.In(agencyLocation(ctx, o.db))
+	day := local.Format("2006-01-02")
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	type count struct {
+		route, stop, status string
+	}
+	counts := map[count]int{}
+	seen := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		seen[r.VehicleID] = true
+		at := tripStop{r.TripID, r.StopID}
+		if r.StopID == "" || !slices.Contains(occupancyLevels[:], r.Occupancy) || o.approaching[r.VehicleID] == at {
+			continue
+		}
+		o.approaching[r.VehicleID] = at
+		counts[count{r.RouteID, r.StopID, r.Occupancy}]++
+	}
+	for id := range o.approaching {
+		if !seen[id] {
+			delete(o.approaching, id)
+		}
+	}
+
+	realtimeWrites.Lock()
+	defer realtimeWrites.Unlock()
+
+	tx, err := o.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const upsert = `INSERT INTO occupancy_counts (day, route_id, stop_id, hour, occupancy_status, n)
+		        VALUES (?, ?, ?, ?, ?, ?)
+		        ON CONFLICT (day, route_id, stop_id, hour, occupancy_status) DO UPDATE SET n = n + excluded.n`
+	for c, n := range counts {
+		if _, err := tx.ExecContext(ctx, upsert, day, c.route, c.stop, local.Hour(), c.status, n); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM occupancy_counts WHERE day < ?`, occupancyCutoff(local)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// occupancyCutoff is the first service day still in the window as of
+// now, as stored in occupancy_counts.
+func occupancyCutoff(now time.Time) string {
+	return now.Add(-occupancyWindow).Format("2006-01-02")
+}
+
+// get returns the occupancy seen over the window by route, stop, and
+// hour of the day, for route and stop, or every one if they are empty.
+func (o *occupancyTracker) get(ctx context.Context, route, stop string) ([]occupancyRow, error) {
+	var counts []struct {
+		RouteID string `db:"route_id"`
+		StopID  string `db:"stop_id"`
+		Hour    int    `db:"hour"`
+		Status  string `db:"occupancy_status"`
+		N       int    `db:"n"`
+	}
+	now := feedNow().In(agencyLocation(ctx, o.db))
+	const q = `SELECT route_id, stop_id, hour, occupancy_status, SUM(n) AS n
+		   FROM occupancy_counts
+		   WHERE day >= ? AND (? = '' OR route_id = ?) AND (? = '' OR stop_id = ?)
+		   GROUP BY route_id, stop_id, hour, occupancy_status
+		   ORDER BY route_id, stop_id, hour`
+	if err := dbSelect(ctx, o.db, "occupancy counts", &counts, q, occupancyCutoff(now), route, route, stop, stop); err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		route, stop string
+		hour        int
+	}
+	var order []group
+	totals := map[group]*occupancyCounts{}
+	for _, c := range counts {
+		level := slices.Index(occupancyLevels[:], c.Status)
+		if level < 0 {
+			continue
+		}
+		g := group{c.RouteID, c.StopID, c.Hour}
+		t := totals[g]
+		if t == nil {
+			t = &occupancyCounts{}
+			totals[g] = t
+			order = append(order, g)
+		}
+		t[level] += c.N
+	}
+
+	rows := make([]occupancyRow, 0, len(order))
+	for _, g := range order {
+		t := totals[g]
+		row := occupancyRow{RouteID: g.route, StopID: g.stop, Hour: g.hour, Counts: map[string]int{}}
+		typical := 0
+		for i, n := range t {
+			if n == 0 {
+				continue
+			}
+			row.Observations += n
+			row.Counts[occupancyLevels[i]] = n
+			if n >= t[typical] {
+				typical = i
+			}
+		}
+		row.Typical = occupancyLevels[typical]
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func handleOccupancy(o *occupancyTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rows, err := o.get(req.Context(), req.FormValue("route"), req.FormValue("stop"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(rows)
+	}
+}
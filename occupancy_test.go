@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestOccupancyCounts(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{}
+	for name, f := range emptyGTFS {
+		fsys[name] = f
+	}
+	fsys["agency.txt"] = &fstest.MapFile{Data: []byte("agency_id,agency_name,agency_url,agency_timezone\nCOTA,COTA,https://www.cota.com,UTC\n")}
+	fsys["routes.txt"] = &fstest.MapFile{Data: []byte("route_id,agency_id,route_short_name,route_long_name,route_type\n2,COTA,2,N High St,3\n")}
+	fsys["trips.txt"] = &fstest.MapFile{Data: []byte("route_id,service_id,trip_id,trip_headsign\n2,WK,T1,Downtown\n")}
+	db := newTestDB(t, fsys)
+
+	now := time.Now().UTC()
+	if _, err := db.Exec(`INSERT INTO stop_time_updates (stop_id, trip_id, arrival_time, vehicle_id) VALUES ('HIGBRON', 'T1', ?, '1001')`, now.Add(2*time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	o := newOccupancyTracker(db)
+	// The vehicle stops reporting its occupancy for a snapshot while
+	// still approaching the same stop, which mustn't count it twice.
+	for _, status := range []string{"few_seats_available", "", "few_seats_available"} {
+		if _, err := db.Exec(`INSERT OR REPLACE INTO vehicle_positions (vehicle_id, trip_id, occupancy_status) VALUES ('1001', 'T1', ?)`, status); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.record(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The counts outlive the tracker.
+	rows, err := newOccupancyTracker(db).get(ctx, "2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].StopID != "HIGBRON" || rows[0].Hour != now.Hour() || rows[0].Observations != 1 || rows[0].Typical != "few_seats_available" {
+		t.Errorf("occupancy = %+v, want one observation of few_seats_available at HIGBRON at %d", rows, now.Hour())
+	}
+}
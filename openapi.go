@@ -0,0 +1,607 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiParam describes a query parameter accepted by an endpoint.
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+	Deprecated  *deprecation
+}
+
+// apiEndpoint describes one of the JSON endpoints.  The response is
+// always an array of Schema.
+type apiEndpoint struct {
+	Path        string
+	Summary     string
+	Params      []apiParam
+	Schema      interface{}
+	SchemaName  string
+	Description string
+	Deprecated  *deprecation
+}
+
+var apiEndpoints = []apiEndpoint{
+	{
+		Path:       "/agencies",
+		Summary:    "List transit agencies",
+		Schema:     agency{},
+		SchemaName: "Agency",
+	},
+	{
+		Path:        "/feed_info",
+		Summary:     "Publisher and version of the loaded schedule",
+		Schema:      feedInfo{},
+		SchemaName:  "FeedInfo",
+		Description: "Empty if the GTFS feed has no feed_info.txt.  start_date and end_date are YYYYMMDD.  Every response also carries the version in an X-Feed-Version header and the valid date range in an X-Feed-Valid header.",
+	},
+	{
+		Path:    "/cota/routes",
+		Summary: "List COTA routes",
+		Params: []apiParam{
+			{Name: "name", Description: "Only return routes whose long or short name contains this, ignoring case"},
+			{Name: "lang", Description: "Language to return names in, overriding Accept-Language"},
+		},
+		Schema:      route{},
+		SchemaName:  "Route",
+		Description: "Names are localized from translations.txt according to the lang argument or the Accept-Language header.  service_span gives the first and last scheduled departure in each direction on the current service day, which runs until the previous day's last trips past midnight have left, and is empty for routes not running.",
+	},
+	{
+		Path:    "/cota/stops",
+		Summary: "List stops",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return stops served by this route_id"},
+			{Name: "code", Description: "Only return stops with this stop_code, as posted at the stop"},
+			{Name: "parent_station", Description: "Only return the stops that are part of this station's stop_id"},
+			{Name: "lat", Description: "Only return stops near this latitude, closest first; requires lon"},
+			{Name: "lon", Description: "Only return stops near this longitude; requires lat"},
+			{Name: "radius", Description: "Meters from lat and lon to search, up to 5000 (default 500)"},
+			{Name: "bbox", Description: "Only return stops in this south,west,north,east bounding box, at most a degree on each side"},
+			{Name: "name", Description: "Only return stops whose name contains this, ignoring case"},
+			{Name: "lang", Description: "Language to return names in, overriding Accept-Language"},
+		},
+		Schema:      stop{},
+		SchemaName:  "Stop",
+		Description: "Names are localized from translations.txt according to the lang argument or the Accept-Language header.  distance, in meters, is only set for lat and lon searches.",
+	},
+	{
+		Path:    "/cota/fares",
+		Summary: "List fares and the routes and zones they apply to",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return fares, and fare rules, for this route_id"},
+		},
+		Schema:      fare{},
+		SchemaName:  "Fare",
+		Description: "Fields are as defined for fare_attributes.txt and fare_rules.txt in the GTFS reference.  A fare with no rules applies to every trip.",
+	},
+	{
+		Path:        "/cota/levels",
+		Summary:     "List station levels",
+		Schema:      level{},
+		SchemaName:  "Level",
+		Description: "Empty unless the GTFS feed includes levels.txt.",
+	},
+	{
+		Path:    "/cota/pathways",
+		Summary: "Pathways within a station",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id of the station; pathways to or from it or any stop whose parent_station it is are returned", Required: true},
+		},
+		Schema:      pathway{},
+		SchemaName:  "Pathway",
+		Description: "Empty unless the GTFS feed includes pathways.txt.  mode is pathway_mode as defined in the GTFS reference (1 walkway, 2 stairs, 3 moving sidewalk, 4 escalator, 5 elevator, 6 fare gate, 7 exit gate).",
+	},
+	{
+		Path:    "/cota/shapes",
+		Summary: "List route shapes",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return shapes used by trips on this route_id"},
+			{Name: "tolerance", Description: "Simplify shapes so no dropped point is further than this from the line: low (2 m), medium (10 m), high (50 m), or a number of meters"},
+			{Name: "fields", Description: "Comma-separated optional fields to include; points adds the points array"},
+		},
+		Schema:      shape{},
+		SchemaName:  "Shape",
+		Description: "polyline is in Google's encoded polyline format.  Shapes are returned at full detail unless a tolerance is given.  The presets are computed and encoded when the schedule is loaded and are much cheaper than an arbitrary tolerance.",
+	},
+	{
+		Path:    "/cota/patterns",
+		Summary: "List route patterns",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return patterns of this route_id"},
+		},
+		Schema:      routePattern{},
+		SchemaName:  "RoutePattern",
+		Description: "A pattern is a distinct sequence of stops served by a route in one direction.  Patterns are listed by route and direction, most-used first.  The headsign and shape are those of the representative trip.",
+	},
+	{
+		Path:    "/cota/stop-routes",
+		Summary: "List the routes serving a stop in each direction",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id of the stop", Required: true},
+		},
+		Schema:      stopRoute{},
+		SchemaName:  "StopRoute",
+		Description: "Routes and directions with trips that board at the stop, derived from route patterns.  A stop that is only the end of the line for a route in a direction doesn't list it.",
+	},
+	{
+		Path:    "/cota/search",
+		Summary: "Search stops, routes, and headsigns",
+		Params: []apiParam{
+			{Name: "q", Description: "Words to search for; each must start a word in the name", Required: true},
+			{Name: "limit", Description: "Most results to return, up to 100 (default 20)"},
+		},
+		Schema:      searchResult{},
+		SchemaName:  "SearchResult",
+		Description: "Results with more exact word matches come first.  Words of four or more letters that match nothing also match words one typo away.  Headsign results carry the route_id of their route.",
+	},
+	{
+		Path:    "/cota/accuracy",
+		Summary: "Prediction accuracy by route",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return scores for this route_id"},
+		},
+		Schema:      routeAccuracy{},
+		SchemaName:  "RouteAccuracy",
+		Description: "Realtime predictions are scored against the last prediction made before the stop dropped out of the trip updates feed, which is taken as the arrival.  Scores are grouped by how far ahead of the arrival the prediction was made and accumulate from server startup.  mean_abs_error is in seconds.",
+	},
+	{
+		Path:    "/cota/analytics/otp",
+		Summary: "On-time performance by route, direction, and time of day",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return performance for this route_id"},
+		},
+		Schema:      otpRow{},
+		SchemaName:  "OnTimePerformance",
+		Description: "Arrivals observed in the trip updates feed over the last seven days, compared with the schedule.  Arrivals more than a minute ahead of schedule are early and more than five minutes behind it are late.  period is early (before 6am), am_peak, midday, pm_peak, evening (6pm to 10pm), or night, by scheduled arrival.",
+	},
+	{
+		Path:    "/cota/analytics/occupancy",
+		Summary: "Typical crowding by route, stop, and hour of the day",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return occupancy for this route_id"},
+			{Name: "stop", Description: "Only return occupancy at this stop_id"},
+		},
+		Schema:      occupancyRow{},
+		SchemaName:  "Occupancy",
+		Description: "The occupancy_status vehicles reported over the last seven days as they approached each stop, by the next stop on their trip in the trip updates feed, counted once per vehicle per stop.  hour is the local hour of the day.  Statuses are the GTFS-realtime occupancy statuses in lowercase, from empty to not_accepting_passengers; typical is the one reported most often, or the more crowded of a tie.  Vehicles that don't report occupancy aren't counted.",
+	},
+	{
+		Path:    "/cota/transfers",
+		Summary: "Transfers from a stop",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id to list transfers from", Required: true},
+			{Name: "lang", Description: "Language to return names in, overriding Accept-Language"},
+		},
+		Schema:      transfer{},
+		SchemaName:  "Transfer",
+		Description: "transfer_type and min_transfer_time are as defined for transfers.txt in the GTFS reference.",
+	},
+	{
+		Path:    "/cota/vehicles",
+		Summary: "List vehicle positions",
+		Params: []apiParam{
+			{Name: "route", Description: "Only return vehicles on this route_id, or with a leading !, on any route but the comma-separated route_ids after it (!CMAX,2)"},
+			{Name: "lat", Description: "Only return vehicles near this latitude, closest first; requires lon"},
+			{Name: "lon", Description: "Only return vehicles near this longitude; requires lat"},
+			{Name: "radius", Description: "Meters from lat and lon to search, up to 5000 (default 500)"},
+			{Name: "bbox", Description: "Only return vehicles in this south,west,north,east bounding box, at most a degree on each side"},
+		},
+		Schema:      vehicle{},
+		SchemaName:  "Vehicle",
+		Description: "off_route is set for vehicles further from their trip's shape than the server's -off-route-meters, 150 by default.  delay is how many seconds behind schedule the vehicle is predicted to reach its next stop, negative if ahead.  distance, in meters, is only set for lat and lon searches.  The X-Realtime-Updated header gives when vehicle positions were last updated, and X-Realtime-Feed-Timestamp the timestamp of the feed they came from.",
+	},
+	{
+		Path:    "/cota/predictions",
+		Summary: "Next predicted arrival per route at a stop",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id to return predictions for", Required: true},
+			{Name: "min_time", Description: "Only return arrivals from this time on, as a duration from now such as 10m or an RFC 3339 time"},
+			{Name: "max_time", Description: "Only return arrivals up to this time, as a duration from now such as 30m or an RFC 3339 time, up to a day ahead"},
+		},
+		Schema:      prediction{},
+		SchemaName:  "Prediction",
+		Description: "arrival_time is the number of seconds from now until the vehicle arrives.  Routes with no realtime prediction fall back to their next scheduled arrival in the next two hours, with scheduled set.  delay is how many seconds behind schedule a realtime prediction is, negative if ahead.  Predictions are dropped once the feed's own timestamp passes them, not the clock; stale is set when the trip updates feed hasn't been updated in three minutes, and arrival_time is then 0 for arrivals the clock has passed.  The X-Realtime-Updated header gives when predictions were last updated, and X-Realtime-Feed-Timestamp the timestamp of the feed they came from.",
+	},
+	{
+		Path:    "/cota/departures",
+		Summary: "Departure board for a stop",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id to return departures for", Required: true},
+			{Name: "limit", Description: "Most departures to return, up to 100 (default 20)"},
+			{Name: "min_time", Description: "Only return arrivals from this time on, as a duration from now such as 10m or an RFC 3339 time"},
+			{Name: "max_time", Description: "Only return arrivals up to this time, as a duration from now such as 30m or an RFC 3339 time, up to a day ahead"},
+		},
+		Schema:      departure{},
+		SchemaName:  "Departure",
+		Description: "Every trip arriving at the stop in the next two hours, soonest first.  Trips with a realtime prediction use it and have source realtime; the rest come from the schedule and have source scheduled.",
+	},
+	{
+		Path:    "/cota/countdown",
+		Summary: "Minutes until the next arrivals at a stop, for signs",
+		Params: []apiParam{
+			{Name: "stop", Description: "stop_id to count down to", Required: true},
+			{Name: "n", Description: "Number of arrivals, up to 10 (default 3)"},
+			{Name: "format", Description: "text for one \"route headsign minutes\" line per arrival instead of JSON"},
+		},
+		Schema:      countdownRow{},
+		SchemaName:  "Countdown",
+		Description: "r is the route's short name, h the headsign, and m the whole minutes until arrival.  s is 1 for arrivals from the schedule; in text format they end in *.",
+	},
+	{
+		Path:    "/cota/trip-plans",
+		Summary: "Plan a trip between two stops",
+		Params: []apiParam{
+			{Name: "from", Description: "stop_id to start from", Required: true},
+			{Name: "to", Description: "stop_id to go to", Required: true},
+			{Name: "time", Description: "Earliest time to leave, in RFC 3339 format (default now)"},
+		},
+		Schema:      tripPlan{},
+		SchemaName:  "TripPlan",
+		Description: "Up to five itineraries leaving within two hours of time, soonest arrival first.  Itineraries ride one trip directly or change once, at the same stop or one listed in transfers.txt.  Plans use the schedule only; duration is in seconds.",
+	},
+}
+
+// apiOperation describes an endpoint that isn't a GET of an array,
+// such as the POST and DELETE endpoints and the admin ones.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Params      []apiParam // in the query, or in the path if named in it
+
+	// Request, if set, is the JSON request body.
+	Request     interface{}
+	RequestName string
+
+	// Status is the response's status on success.  Response, if
+	// set, is the JSON object returned; otherwise ContentType, if
+	// set, is the type of what is returned.
+	Status       int
+	Response     interface{}
+	ResponseName string
+	ContentType  string
+
+	// Admin endpoints require the -admin-token as a bearer token.
+	Admin bool
+
+	Deprecated *deprecation
+}
+
+var apiOperations = []apiOperation{
+	{
+		Method:      http.MethodPost,
+		Path:        "/cota/voice",
+		Summary:     "Answer a voice assistant's question about the next buses at a stop",
+		Description: "Accepts an Alexa skill request or a Dialogflow fulfillment request, with a stop slot holding the stop code or stop_id and an optional route slot, and replies in the same format: an Alexa response with outputSpeech, or an object with fulfillmentText.",
+		Request:     voiceRequest{},
+		RequestName: "VoiceRequest",
+		Status:      http.StatusOK,
+		ContentType: "application/json",
+	},
+	{
+		Method:       http.MethodPost,
+		Path:         "/cota/webhooks",
+		Summary:      "Register a webhook for arrivals at a stop",
+		Description:  "The url is POSTed a notice when a realtime prediction puts the route within threshold_minutes of the stop.  It must be an http or https URL on a public host.  id and expires_at are set in the response; registrations lapse after a day.  Only available when the server runs with -max-webhooks.",
+		Request:      webhook{},
+		RequestName:  "Webhook",
+		Status:       http.StatusCreated,
+		Response:     webhook{},
+		ResponseName: "Webhook",
+	},
+	{
+		Method:  http.MethodDelete,
+		Path:    "/cota/webhooks/{id}",
+		Summary: "Remove a webhook",
+		Params: []apiParam{
+			{Name: "id", Description: "id returned when the webhook was registered", Required: true},
+		},
+		Status: http.StatusNoContent,
+	},
+	{
+		Method:  http.MethodGet,
+		Path:    "/cota/realtime-snapshot",
+		Summary: "Contents of a realtime table, for other instances to follow",
+		Params: []apiParam{
+			{Name: "table", Description: "vehicle_positions or stop_time_updates", Required: true},
+		},
+		Description:  "fetched_at is when the table was last updated.  Each row has a value for each of columns, in order.",
+		Status:       http.StatusOK,
+		Response:     realtimeSnapshot{},
+		ResponseName: "RealtimeSnapshot",
+	},
+	{
+		Method:       http.MethodGet,
+		Path:         "/version",
+		Summary:      "Build the server was compiled from",
+		Status:       http.StatusOK,
+		Response:     buildInfo{},
+		ResponseName: "BuildInfo",
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/metrics",
+		Summary:     "Request and service metrics",
+		Description: "In the Prometheus text exposition format.",
+		Status:      http.StatusOK,
+		ContentType: "text/plain",
+	},
+	{
+		Method:      http.MethodPost,
+		Path:        "/admin/reload",
+		Summary:     "Reload the static GTFS feed",
+		Description: "Responds once the load finishes, with status ok and how long it took.  Fails with 409 if the feed is frozen with -gtfs-frozen.",
+		Status:      http.StatusOK,
+		ContentType: "application/json",
+		Admin:       true,
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/admin/status",
+		Summary:     "Server uptime, updater health, table row counts, feed, and build",
+		Status:      http.StatusOK,
+		ContentType: "application/json",
+		Admin:       true,
+	},
+	{
+		Method:       http.MethodGet,
+		Path:         "/admin/validation",
+		Summary:      "Validation report for the last static GTFS load",
+		Status:       http.StatusOK,
+		Response:     validationReport{},
+		ResponseName: "ValidationReport",
+		Admin:        true,
+	},
+	{
+		Method:       http.MethodGet,
+		Path:         "/admin/gtfs-diff",
+		Summary:      "What changed in the last static GTFS reload",
+		Status:       http.StatusOK,
+		Response:     gtfsDiff{},
+		ResponseName: "GTFSDiff",
+		Admin:        true,
+	},
+	{
+		Method:      http.MethodGet,
+		Path:        "/admin/store",
+		Summary:     "Sizes of the database tables, in-memory caches, and Go heap",
+		Status:      http.StatusOK,
+		ContentType: "application/json",
+		Admin:       true,
+	},
+}
+
+// schemaFor builds an OpenAPI schema object from the json tags of a
+// struct, so the document can't drift from the types we encode.
+func schemaFor(v interface{}) map[string]interface{} {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		// Encoded as null when unset.
+		schema := typeSchema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Struct:
+		// Described field by field below.
+	default:
+		return map[string]interface{}{"type": "object"}
+	}
+
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		props[name] = typeSchema(f.Type)
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+}
+
+func openAPIDocument() map[string]interface{} {
+	paths := map[string]interface{}{}
+	schemas := map[string]interface{}{}
+
+	for _, e := range apiEndpoints {
+		schemas[e.SchemaName] = schemaFor(e.Schema)
+
+		params := []interface{}{}
+		for _, p := range e.Params {
+			param := map[string]interface{}{
+				"name":        p.Name,
+				"in":          "query",
+				"required":    p.Required,
+				"description": p.Description,
+				"schema":      map[string]interface{}{"type": "string"},
+			}
+			if p.Deprecated != nil {
+				param["deprecated"] = true
+				param["description"] = p.Description + ".  " + p.Deprecated.message(p.Name)
+			}
+			params = append(params, param)
+		}
+
+		op := map[string]interface{}{
+			"summary":    e.Summary,
+			"parameters": params,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":  "array",
+								"items": map[string]interface{}{"$ref": "#/components/schemas/" + e.SchemaName},
+							},
+						},
+					},
+				},
+			},
+		}
+		if e.Description != "" {
+			op["description"] = e.Description
+		}
+		if e.Deprecated != nil {
+			op["deprecated"] = true
+			op["description"] = strings.TrimSpace(e.Description + "  " + e.Deprecated.message(e.Path))
+		}
+
+		paths[e.Path] = map[string]interface{}{"get": op}
+	}
+
+	for _, o := range apiOperations {
+		params := []interface{}{}
+		for _, p := range o.Params {
+			in := "query"
+			if strings.Contains(o.Path, "{"+p.Name+"}") {
+				in = "path"
+			}
+			param := map[string]interface{}{
+				"name":        p.Name,
+				"in":          in,
+				"required":    p.Required,
+				"description": p.Description,
+				"schema":      map[string]interface{}{"type": "string"},
+			}
+			if p.Deprecated != nil {
+				param["deprecated"] = true
+				param["description"] = p.Description + ".  " + p.Deprecated.message(p.Name)
+			}
+			params = append(params, param)
+		}
+
+		resp := map[string]interface{}{"description": http.StatusText(o.Status)}
+		switch {
+		case o.Response != nil:
+			schemas[o.ResponseName] = schemaFor(o.Response)
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/" + o.ResponseName},
+				},
+			}
+		case o.ContentType == "application/json":
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "object"},
+				},
+			}
+		case o.ContentType != "":
+			resp["content"] = map[string]interface{}{
+				o.ContentType: map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			}
+		}
+
+		op := map[string]interface{}{
+			"summary":    o.Summary,
+			"parameters": params,
+			"responses":  map[string]interface{}{strconv.Itoa(o.Status): resp},
+		}
+		if o.Description != "" {
+			op["description"] = o.Description
+		}
+		if o.Request != nil {
+			schemas[o.RequestName] = schemaFor(o.Request)
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/" + o.RequestName},
+					},
+				},
+			}
+		}
+		if o.Deprecated != nil {
+			op["deprecated"] = true
+			op["description"] = strings.TrimSpace(o.Description + "  " + o.Deprecated.message(o.Method+" "+o.Path))
+		}
+		if o.Admin {
+			op["security"] = []interface{}{map[string]interface{}{"adminToken": []interface{}{}}}
+		}
+
+		item, _ := paths[o.Path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[o.Path] = item
+		}
+		item[strings.ToLower(o.Method)] = op
+	}
+
+	paths["/ws"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Websocket stream of vehicle position changes",
+			"description": "Upgrade to a websocket.  Each message is an object with a vehicles array of new or changed vehicles and a removed array of vehicle IDs.",
+			"parameters": []interface{}{
+				map[string]interface{}{
+					"name":        "route",
+					"in":          "query",
+					"description": "Only stream vehicles on this route_id",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"responses": map[string]interface{}{
+				"101": map[string]interface{}{"description": "Switching Protocols"},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "COTA bus API",
+			"version": strconv.Itoa(currentAPIVersion),
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "/v" + strconv.Itoa(currentAPIVersion)},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The server's -admin-token.  Admin endpoints are disabled without one.",
+				},
+			},
+		},
+	}
+}
+
+func handleOpenAPI(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.Encode(openAPIDocument())
+}
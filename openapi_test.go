@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestOpenAPIPaths checks that every route registered in serveCommand
+// is documented.
+func TestOpenAPIPaths(t *testing.T) {
+	doc := openAPIDocument()
+	paths := doc["paths"].(map[string]interface{})
+
+	for _, route := range []string{
+		"POST /cota/voice",
+		"POST /cota/webhooks",
+		"DELETE /cota/webhooks/{id}",
+		"GET /cota/realtime-snapshot",
+		"POST /admin/reload",
+		"GET /admin/status",
+		"GET /admin/validation",
+		"GET /admin/gtfs-diff",
+		"GET /admin/store",
+		"GET /metrics",
+		"GET /version",
+		"GET /cota/vehicles",
+	} {
+		method, path, _ := strings.Cut(route, " ")
+		item, _ := paths[path].(map[string]interface{})
+		if item[strings.ToLower(method)] == nil {
+			t.Errorf("%s isn't documented", route)
+		}
+	}
+
+	del := paths["/cota/webhooks/{id}"].(map[string]interface{})["delete"].(map[string]interface{})
+	if p := del["parameters"].([]interface{})[0].(map[string]interface{}); p["in"] != "path" {
+		t.Errorf("id parameter is in %v, want path", p["in"])
+	}
+	if _, ok := del["responses"].(map[string]interface{})["204"]; !ok {
+		t.Errorf("DELETE /cota/webhooks/{id} responses = %v, want 204", del["responses"])
+	}
+}
+
+func TestOpenAPINullable(t *testing.T) {
+	doc := openAPIDocument()
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	props := schemas["Vehicle"].(map[string]interface{})["properties"].(map[string]interface{})
+	if delay := props["delay"].(map[string]interface{}); delay["nullable"] != true {
+		t.Errorf("Vehicle.delay = %v, want nullable", delay)
+	}
+	if id := props["vehicle_id"].(map[string]interface{}); id["nullable"] != nil {
+		t.Errorf("Vehicle.vehicle_id = %v, want not nullable", id)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// otpWindow is how long on-time performance is kept for.
+	otpWindow = 7 * 24 * time.Hour
+
+	// Arrivals more than otpEarly ahead of schedule are early, and
+	// more than otpLate behind it are late.
+	otpEarly = 1 * time.Minute
+	otpLate  = 5 * time.Minute
+)
+
+// otpPeriods divide the service day by the scheduled hour of arrival.
+var otpPeriods = []struct {
+	Name  string
+	Until int // hour
+}{
+	{"early", 6},
+	{"am_peak", 9},
+	{"midday", 15},
+	{"pm_peak", 18},
+	{"evening", 22},
+	{"night", 24},
+}
+
+func otpPeriod(hour int) string {
+	for _, p := range otpPeriods {
+		if hour < p.Until {
+			return p.Name
+		}
+	}
+	return otpPeriods[len(otpPeriods)-1].Name
+}
+
+type otpKey struct {
+	bin       time.Time // hour the arrivals fell in
+	route     string
+	direction string
+	period    string
+}
+
+type otpCounts struct {
+	early, onTime, late int
+}
+
+type otpRow struct {
+	RouteID     string  `json:"route_id"`
+	DirectionID string  `json:"direction_id"`
+	Period      string  `json:"period"`
+	Early       int     `json:"early"`
+	OnTime      int     `json:"on_time"`
+	Late        int     `json:"late"`
+	Total       int     `json:"total"`
+	OnTimePct   float64 `json:"on_time_pct"`
+}
+
+// otpTracker compares observed arrivals against the schedule, keeping
+// counts of early, on-time, and late arrivals in hourly bins for
+// otpWindow.
+type otpTracker struct {
+	db *sqlx.DB
+
+	mu   sync.Mutex
+	bins map[otpKey]*otpCounts
+}
+
+func newOTPTracker(db *sqlx.DB) *otpTracker {
+	return &otpTracker{db: db, bins: map[otpKey]*otpCounts{}}
+}
+
+// record scores arrivals against their scheduled stop times.
+// Arrivals at stops without a scheduled time aren't counted.
+func (o *otpTracker) record(ctx context.Context, arrivals []observedArrival) error {
+	if len(arrivals) == 0 {
+		return nil
+	}
+
+	trips := map[string]bool{}
+	var tripIDs []string
+	for _, a := range arrivals {
+		if !trips[a.TripID] {
+			trips[a.TripID] = true
+			tripIDs = append(tripIDs, a.TripID)
+		}
+	}
+
+	var rows []struct {
+		TripID      string   `db:"trip_id"`
+		StopID      string   `db:"stop_id"`
+		DirectionID string   `db:"direction_id"`
+		ArrivalTime gtfsTime `db:"arrival_time"`
+	}
+	q, args, err := sqlx.In(`SELECT st.trip_id, st.stop_id, trips.direction_id, st.arrival_time
+	      FROM stop_times AS st
+	      INNER JOIN trips ON st.trip_id = trips.trip_id
+	      WHERE st.trip_id IN (?) AND st.arrival_time != ''`, tripIDs)
+	if err != nil {
+		return err
+	}
+	if err := dbSelect(ctx, o.db, "scheduled stop times", &rows, o.db.Rebind(q), args...); err != nil {
+		return err
+	}
+
+	type scheduled struct {
+		direction string
+		arrival   gtfsTime
+	}
+	sched := make(map[tripStop]scheduled, len(rows))
+	for _, r := range rows {
+		sched[tripStop{r.TripID, r.StopID}] = scheduled{r.DirectionID, r.ArrivalTime}
+	}
+
+	loc := agencyLocation(ctx, o.db)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, a := range arrivals {
+		s, ok := sched[tripStop{a.TripID, a.StopID}]
+		if !ok {
+			continue
+		}
+
+		at := a.At.In(loc)
+		want := s.arrival.Near(at)
+
+		k := otpKey{
+			bin:       at.Truncate(time.Hour),
+			route:     a.RouteID,
+			direction: s.direction,
+			period:    otpPeriod(want.Hour()),
+		}
+		c := o.bins[k]
+		if c == nil {
+			c = &otpCounts{}
+			o.bins[k] = c
+		}
+		switch delay := at.Sub(want); {
+		case delay < -otpEarly:
+			c.early++
+		case delay > otpLate:
+			c.late++
+		default:
+			c.onTime++
+		}
+	}
+
+	cutoff := feedNow().Add(-otpWindow)
+	for k := range o.bins {
+		if k.bin.Before(cutoff) {
+			delete(o.bins, k)
+		}
+	}
+	return nil
+}
+
+// get returns on-time performance over the window for route, or every
+// route if it is empty, by direction and period of the day.
+func (o *otpTracker) get(route string) []otpRow {
+	type group struct{ route, direction, period string }
+
+	o.mu.Lock()
+	totals := map[group]otpCounts{}
+	for k, c := range o.bins {
+		if route != "" && k.route != route {
+			continue
+		}
+		g := group{k.route, k.direction, k.period}
+		t := totals[g]
+		t.early += c.early
+		t.onTime += c.onTime
+		t.late += c.late
+		totals[g] = t
+	}
+	o.mu.Unlock()
+
+	periodOrder := map[string]int{}
+	for i, p := range otpPeriods {
+		periodOrder[p.Name] = i
+	}
+
+	rows := make([]otpRow, 0, len(totals))
+	for g, t := range totals {
+		total := t.early + t.onTime + t.late
+		rows = append(rows, otpRow{
+			RouteID:     g.route,
+			DirectionID: g.direction,
+			Period:      g.period,
+			Early:       t.early,
+			OnTime:      t.onTime,
+			Late:        t.late,
+			Total:       total,
+			OnTimePct:   100 * float64(t.onTime) / float64(total),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.RouteID != b.RouteID {
+			return a.RouteID < b.RouteID
+		}
+		if a.DirectionID != b.DirectionID {
+			return a.DirectionID < b.DirectionID
+		}
+		return periodOrder[a.Period] < periodOrder[b.Period]
+	})
+	return rows
+}
+
+func handleOTP(o *otpTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(o.get(req.FormValue("route")))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// globalParams are accepted by every endpoint.
+var globalParams = []string{"api_key"}
+
+// strictParams rejects requests to the endpoints in apiEndpoints that
+// give query parameters the endpoint doesn't document, so a typo like
+// rotue=2 is an error rather than silently returning every route.
+func strictParams(next http.Handler) http.Handler {
+	allowed := map[string][]string{}
+	for _, e := range apiEndpoints {
+		names := slices.Clone(globalParams)
+		for _, p := range e.Params {
+			names = append(names, p.Name)
+		}
+		allowed[e.Path] = names
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		names, ok := allowed[req.URL.Path]
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		var unknown []string
+		for name := range req.URL.Query() {
+			if !slices.Contains(names, name) {
+				unknown = append(unknown, name)
+			}
+		}
+		if len(unknown) == 0 {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		sort.Strings(unknown)
+		supported := strings.Join(names, ", ")
+		var errs []apiError
+		for _, name := range unknown {
+			errs = append(errs, apiError{
+				Status: "400",
+				Title:  http.StatusText(http.StatusBadRequest),
+				Detail: fmt.Sprintf("%s does not support the %s parameter; it supports %s", req.URL.Path, name, supported),
+				Source: &apiErrorSource{Parameter: name},
+			})
+		}
+		writeErrors(rw, http.StatusBadRequest, errs)
+	})
+}
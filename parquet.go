@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Just enough of the Parquet format to write the realtime archive: one
+// row group of required, flat columns, each a single PLAIN-encoded,
+// gzipped data page.  The file metadata is encoded with Thrift's
+// compact protocol, as the format requires.  Field IDs and enum values
+// are from parquet.thrift.
+
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0 // ConvertedType
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0 // Encoding
+	parquetRLE   = 3
+	parquetGzip  = 2 // CompressionCodec
+)
+
+// parquetColumn is a column of the rows passed to writeParquet.
+type parquetColumn struct {
+	name      string
+	field     int
+	typ       int32
+	converted int32 // -1 if none
+}
+
+// parquetColumns returns the columns of t, a struct whose exported
+// fields are strings, int64s, float64s, or time.Times, named by their
+// json tags.
+func parquetColumns(t reflect.Type) ([]parquetColumn, error) {
+	var cols []parquetColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			name = f.Name
+		}
+		c := parquetColumn{name: name, field: i, converted: -1}
+		switch {
+		case f.Type == reflect.TypeOf(time.Time{}):
+			c.typ, c.converted = parquetInt64, parquetTimestampMillis
+		case f.Type.Kind() == reflect.String:
+			c.typ, c.converted = parquetByteArray, parquetUTF8
+		case f.Type.Kind() == reflect.Int64:
+			c.typ = parquetInt64
+		case f.Type.Kind() == reflect.Float64:
+			c.typ = parquetDouble
+		default:
+			return nil, fmt.Errorf("can't write %s field %s to Parquet", f.Type, f.Name)
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// plain returns the PLAIN encoding of column c of rows.
+func (c parquetColumn) plain(rows reflect.Value) []byte {
+	var b []byte
+	for i := 0; i < rows.Len(); i++ {
+		v := rows.Index(i).Field(c.field)
+		switch {
+		case c.converted == parquetTimestampMillis:
+			b = binary.LittleEndian.AppendUint64(b, uint64(v.Interface().(time.Time).UnixMilli()))
+		case c.typ == parquetByteArray:
+			b = binary.LittleEndian.AppendUint32(b, uint32(v.Len()))
+			b = append(b, v.String()...)
+		case c.typ == parquetInt64:
+			b = binary.LittleEndian.AppendUint64(b, uint64(v.Int()))
+		case c.typ == parquetDouble:
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+		}
+	}
+	return b
+}
+
+// writeParquet writes rows as a Parquet file.
+func writeParquet[T any](w io.Writer, rows []T) error {
+	rv := reflect.ValueOf(rows)
+	cols, err := parquetColumns(rv.Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	type chunk struct {
+		offset, uncompressed, compressed int64
+	}
+	var chunks []chunk
+
+	out := bytes.NewBufferString("PAR1")
+	if len(rows) > 0 {
+		for _, c := range cols {
+			raw := c.plain(rv)
+			var page bytes.Buffer
+			zw := gzip.NewWriter(&page)
+			zw.Write(raw)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+
+			var h thriftWriter
+			h.i32(1, 0) // DATA_PAGE
+			h.i32(2, int32(len(raw)))
+			h.i32(3, int32(page.Len()))
+			h.structField(5, func() {
+				h.i32(1, int32(len(rows)))
+				h.i32(2, parquetPlain)
+				h.i32(3, parquetRLE)
+				h.i32(4, parquetRLE)
+			})
+			h.stop()
+
+			chunks = append(chunks, chunk{
+				offset:       int64(out.Len()),
+				uncompressed: int64(h.Len() + len(raw)),
+				compressed:   int64(h.Len() + page.Len()),
+			})
+			out.Write(h.Bytes())
+			out.Write(page.Bytes())
+		}
+	}
+
+	var m thriftWriter
+	m.i32(1, 1)
+	m.listField(2, thriftStruct, len(cols)+1)
+	m.structElem(func() {
+		m.binary(4, "schema")
+		m.i32(5, int32(len(cols)))
+	})
+	for _, c := range cols {
+		m.structElem(func() {
+			m.i32(1, c.typ)
+			m.i32(3, 0) // REQUIRED
+			m.binary(4, c.name)
+			if c.converted >= 0 {
+				m.i32(6, c.converted)
+			}
+		})
+	}
+	m.i64(3, int64(len(rows)))
+	if len(rows) == 0 {
+		m.listField(4, thriftStruct, 0)
+	} else {
+		m.listField(4, thriftStruct, 1)
+		m.structElem(func() {
+			var total int64
+			m.listField(1, thriftStruct, len(cols))
+			for i, c := range cols {
+				ch := chunks[i]
+				total += ch.uncompressed
+				m.structElem(func() {
+					m.i64(2, ch.offset)
+					m.structField(3, func() {
+						m.i32(1, c.typ)
+						m.listField(2, thriftI32, 1)
+						m.varint(zigzag(parquetPlain))
+						m.listField(3, thriftBinary, 1)
+						m.varint(uint64(len(c.name)))
+						m.WriteString(c.name)
+						m.i32(4, parquetGzip)
+						m.i64(5, int64(len(rows)))
+						m.i64(6, ch.uncompressed)
+						m.i64(7, ch.compressed)
+						m.i64(9, ch.offset)
+					})
+				})
+			}
+			m.i64(2, total)
+			m.i64(3, int64(len(rows)))
+		})
+	}
+	m.binary(6, "cota-bus")
+	m.stop()
+
+	out.Write(m.Bytes())
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(m.Len())))
+	out.WriteString("PAR1")
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with Thrift's compact protocol.
+// Fields must be written in increasing order of ID.
+type thriftWriter struct {
+	bytes.Buffer
+
+	// last is the ID of the last field written in each struct being
+	// written, innermost last.
+	last []int16
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if len(t.last) == 0 {
+		t.last = []int16{0}
+	}
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.WriteString(s)
+}
+
+// listField starts a list of n elements of type typ, which the caller
+// then writes.
+func (t *thriftWriter) listField(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | typ)
+	} else {
+		t.WriteByte(0xf0 | typ)
+		t.varint(uint64(n))
+	}
+}
+
+// structField writes a struct field whose fields body writes.
+func (t *thriftWriter) structField(id int16, body func()) {
+	t.field(id, thriftStruct)
+	t.structElem(body)
+}
+
+// structElem writes a struct, as a list element, whose fields body
+// writes.
+func (t *thriftWriter) structElem(body func()) {
+	t.last = append(t.last, 0)
+	body()
+	t.stop()
+	t.last = t.last[:len(t.last)-1]
+}
+
+// stop ends the top-level struct.
+func (t *thriftWriter) stop() {
+	t.WriteByte(0)
+}
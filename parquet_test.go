@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/uber/jaeger-client-go/thrift"
+)
+
+// readThrift decodes b with Apache Thrift's compact protocol, rather
+// than anything of ours, so a misreading of the encoding in
+// thriftWriter would show up here.  Structs decode to maps from field
+// ID to value.  It returns the value and the bytes after it.
+func readThrift(t *testing.T, b []byte) (map[int16]any, []byte) {
+	t.Helper()
+	buf := thrift.NewTMemoryBuffer()
+	buf.Write(b)
+	p := thrift.NewTCompactProtocol(buf)
+
+	var read func(typ thrift.TType) any
+	read = func(typ thrift.TType) any {
+		ctx := context.Background()
+		var (
+			v   any
+			err error
+		)
+		switch typ {
+		case thrift.I32:
+			var n int32
+			n, err = p.ReadI32(ctx)
+			v = int64(n)
+		case thrift.I64:
+			v, err = p.ReadI64(ctx)
+		case thrift.STRING:
+			var s []byte
+			s, err = p.ReadBinary(ctx)
+			v = string(s)
+		case thrift.LIST:
+			var (
+				elem thrift.TType
+				n    int
+			)
+			if elem, n, err = p.ReadListBegin(ctx); err == nil {
+				l := []any{}
+				for i := 0; i < n; i++ {
+					l = append(l, read(elem))
+				}
+				v, err = l, p.ReadListEnd(ctx)
+			}
+		case thrift.STRUCT:
+			m := map[int16]any{}
+			if _, err = p.ReadStructBegin(ctx); err != nil {
+				break
+			}
+			for {
+				_, ft, id, ferr := p.ReadFieldBegin(ctx)
+				if ferr != nil {
+					t.Fatal(ferr)
+				}
+				if ft == thrift.STOP {
+					break
+				}
+				m[id] = read(ft)
+				p.ReadFieldEnd(ctx)
+			}
+			v, err = m, p.ReadStructEnd(ctx)
+		default:
+			t.Fatalf("unexpected thrift type %v", typ)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	m := read(thrift.STRUCT).(map[int16]any)
+	return m, b[len(b)-buf.Len():]
+}
+
+// parquetFooter returns the file metadata of the Parquet file d.
+func parquetFooter(t *testing.T, d []byte) map[int16]any {
+	t.Helper()
+	if !bytes.HasPrefix(d, []byte("PAR1")) || !bytes.HasSuffix(d, []byte("PAR1")) {
+		t.Fatal("missing magic")
+	}
+	n := binary.LittleEndian.Uint32(d[len(d)-8:])
+	meta, rest := readThrift(t, d[len(d)-8-int(n):len(d)-8])
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left after the file metadata", len(rest))
+	}
+	return meta
+}
+
+func TestWriteParquet(t *testing.T) {
+	fetched := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	rows := []archivedStopTimeUpdate{
+		{FetchedAt: fetched, StopID: "HIGBRON", TripID: "T1", ArrivalTime: 1714568520, Feed: "cota"},
+		{FetchedAt: fetched, StopID: "", TripID: "T2", Feed: "cota", ScheduleRelationship: "canceled"},
+	}
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	d := buf.Bytes()
+
+	// Field IDs are those of FileMetaData, SchemaElement, RowGroup,
+	// ColumnChunk, ColumnMetaData, PageHeader, and DataPageHeader in
+	// parquet.thrift.
+	meta := parquetFooter(t, d)
+	if meta[1] != int64(1) || meta[3] != int64(2) {
+		t.Errorf("version = %v, num_rows = %v", meta[1], meta[3])
+	}
+
+	schema := meta[2].([]any)
+	if root := schema[0].(map[int16]any); root[4] != "schema" || root[5] != int64(7) {
+		t.Errorf("schema root = %v", root)
+	}
+	want := []string{"fetched_at", "stop_id", "trip_id", "arrival_time", "vehicle_id", "feed_source", "schedule_relationship"}
+	if len(schema) != len(want)+1 {
+		t.Fatalf("schema = %v", schema)
+	}
+	for i, name := range want {
+		e := schema[i+1].(map[int16]any)
+		if e[4] != name || e[3] != int64(0) {
+			t.Errorf("column %d = %v, want required %s", i, e, name)
+		}
+	}
+	if e := schema[1].(map[int16]any); e[1] != int64(parquetInt64) || e[6] != int64(parquetTimestampMillis) {
+		t.Errorf("fetched_at = %v, want INT64 TIMESTAMP_MILLIS", e)
+	}
+
+	groups := meta[4].([]any)
+	if len(groups) != 1 || groups[0].(map[int16]any)[3] != int64(2) {
+		t.Fatalf("row groups = %v", groups)
+	}
+	chunks := groups[0].(map[int16]any)[1].([]any)
+	page := func(i int) []byte {
+		cm := chunks[i].(map[int16]any)[3].(map[int16]any)
+		if cm[3].([]any)[0] != want[i] || cm[4] != int64(parquetGzip) || cm[5] != int64(2) {
+			t.Errorf("column %d metadata = %v", i, cm)
+		}
+		off := cm[9].(int64)
+		h, rest := readThrift(t, d[off:])
+		if h[1] != int64(0) || h[5].(map[int16]any)[1] != int64(2) {
+			t.Errorf("column %d page header = %v", i, h)
+		}
+		if int64(len(d[off:])-len(rest))+h[3].(int64) != cm[7].(int64) {
+			t.Errorf("column %d page is %d bytes with its header, metadata says %d", i, int64(len(d[off:])-len(rest))+h[3].(int64), cm[7])
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(rest[:h[3].(int64)]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(raw)) != h[2].(int64) {
+			t.Errorf("column %d page is %d bytes uncompressed, header says %d", i, len(raw), h[2])
+		}
+		return raw
+	}
+
+	if got := int64(binary.LittleEndian.Uint64(page(0))); got != fetched.UnixMilli() {
+		t.Errorf("fetched_at = %d, want %d", got, fetched.UnixMilli())
+	}
+	stops := page(1)
+	if l := binary.LittleEndian.Uint32(stops); l != 7 || string(stops[4:11]) != "HIGBRON" || binary.LittleEndian.Uint32(stops[11:]) != 0 {
+		t.Errorf("stop_id page = %q", stops)
+	}
+	if got := binary.LittleEndian.Uint64(page(3)); got != 1714568520 {
+		t.Errorf("arrival_time = %d", got)
+	}
+}
+
+func TestWriteParquetDouble(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, []archivedVehicle{{Latitude: 39.962, Longitude: -83.0}}); err != nil {
+		t.Fatal(err)
+	}
+	d := buf.Bytes()
+	meta := parquetFooter(t, d)
+	if e := meta[2].([]any)[5].(map[int16]any); e[4] != "latitude" || e[1] != int64(parquetDouble) {
+		t.Errorf("latitude = %v, want DOUBLE", e)
+	}
+
+	cm := meta[4].([]any)[0].(map[int16]any)[1].([]any)[4].(map[int16]any)[3].(map[int16]any)
+	h, rest := readThrift(t, d[cm[9].(int64):])
+	zr, err := gzip.NewReader(bytes.NewReader(rest[:h[3].(int64)]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := math.Float64frombits(binary.LittleEndian.Uint64(raw)); got != 39.962 {
+		t.Errorf("latitude = %v, want 39.962", got)
+	}
+}
+
+func TestWriteParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, []archivedVehicle{}); err != nil {
+		t.Fatal(err)
+	}
+	d := buf.Bytes()
+	n := binary.LittleEndian.Uint32(d[len(d)-8:])
+	if 4+int(n)+8 != len(d) {
+		t.Errorf("%d byte file with a %d byte footer has data in it", len(d), n)
+	}
+	meta := parquetFooter(t, d)
+	if meta[3] != int64(0) || len(meta[4].([]any)) != 0 {
+		t.Errorf("num_rows = %v, row_groups = %v", meta[3], meta[4])
+	}
+	if cols := meta[2].([]any); len(cols) != 9 {
+		t.Errorf("schema = %v", cols)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type level struct {
+	ID    string `db:"level_id" json:"level_id"`
+	Index string `db:"level_index" json:"index"`
+	Name  string `db:"level_name" json:"name"`
+}
+
+type pathway struct {
+	ID                   string `db:"pathway_id" json:"pathway_id"`
+	FromStopID           string `db:"from_stop_id" json:"from_stop_id"`
+	FromStopName         string `db:"from_stop_name" json:"from_stop_name"`
+	ToStopID             string `db:"to_stop_id" json:"to_stop_id"`
+	ToStopName           string `db:"to_stop_name" json:"to_stop_name"`
+	Mode                 string `db:"pathway_mode" json:"mode"`
+	Bidirectional        string `db:"is_bidirectional" json:"is_bidirectional"`
+	Length               string `db:"length" json:"length"`
+	TraversalTime        string `db:"traversal_time" json:"traversal_time"`
+	StairCount           string `db:"stair_count" json:"stair_count"`
+	MaxSlope             string `db:"max_slope" json:"max_slope"`
+	MinWidth             string `db:"min_width" json:"min_width"`
+	SignpostedAs         string `db:"signposted_as" json:"signposted_as"`
+	ReversedSignpostedAs string `db:"reversed_signposted_as" json:"reversed_signposted_as"`
+}
+
+// handlePathways lists the pathways inside a station: those that start
+// or end at the station itself or at any stop, entrance, or node whose
+// parent_station it is.
+func handlePathways(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		station := req.FormValue("stop")
+		if station == "" {
+			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
+			return
+		}
+
+		pathways := []pathway{}
+
+		const q = `WITH station_stops AS (
+			       SELECT stop_id FROM stops WHERE stop_id = ? OR parent_station = ?
+			   )
+			   SELECT p.pathway_id, p.from_stop_id, f.stop_name AS from_stop_name,
+			          p.to_stop_id, t.stop_name AS to_stop_name, p.pathway_mode,
+			          p.is_bidirectional, p.length, p.traversal_time, p.stair_count,
+			          p.max_slope, p.min_width, p.signposted_as, p.reversed_signposted_as
+			   FROM pathways AS p
+			   INNER JOIN stops AS f ON p.from_stop_id = f.stop_id
+			   INNER JOIN stops AS t ON p.to_stop_id = t.stop_id
+			   WHERE p.from_stop_id IN (SELECT stop_id FROM station_stops)
+			      OR p.to_stop_id IN (SELECT stop_id FROM station_stops)
+			   ORDER BY p.pathway_id`
+		if err := dbSelect(req.Context(), db, "pathways", &pathways, q, station, station); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(pathways)
+	}
+}
+
+func handleLevels(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		levels := []level{}
+
+		const q = `SELECT level_id, level_index, level_name FROM levels ORDER BY level_index*1`
+		if err := dbSelect(req.Context(), db, "levels", &levels, q); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(levels)
+	}
+}
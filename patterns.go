@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// routePattern is a distinct sequence of stops served by trips on a
+// route in one direction, like a branch or a short turn.
+type routePattern struct {
+	ID             string `json:"pattern_id"`
+	RouteID        string `json:"route_id"`
+	RouteShortName string `json:"route_short_name"`
+	DirectionID    string `json:"direction_id"`
+
+	// Headsign, TripID, and ShapeID are those of a representative
+	// trip.
+	Headsign string `json:"trip_headsign"`
+	TripID   string `json:"representative_trip_id"`
+	ShapeID  string `json:"shape_id"`
+
+	StopIDs   []string `json:"stop_ids"`
+	TripCount int      `json:"trip_count"`
+}
+
+// patternCache holds the patterns of every route, most-used first
+// within each route and direction.  The map is replaced on refresh
+// and never modified.
+type patternCache struct {
+	byRoute atomic.Pointer[map[string][]routePattern]
+}
+
+// refresh derives patterns from the trips and stop_times in the
+// database.  stop_times is the biggest table by far, so it is
+// streamed a trip at a time rather than read into memory.
+func (c *patternCache) refresh(ctx context.Context, db *sqlx.DB) (err error) {
+	ctx, span := tracer.Start(ctx, "db.select stop patterns")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	rows, err := db.QueryxContext(ctx, `SELECT trips.route_id, COALESCE(routes.route_short_name, '') AS route_short_name,
+		    trips.direction_id, trips.trip_id, trips.shape_id, trips.trip_headsign, st.stop_id
+		FROM stop_times AS st
+		INNER JOIN trips ON st.trip_id = trips.trip_id
+		LEFT JOIN routes ON trips.route_id = routes.route_id
+		ORDER BY trips.trip_id, CAST(st.stop_sequence AS INTEGER)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type row struct {
+		RouteID        string `db:"route_id"`
+		RouteShortName string `db:"route_short_name"`
+		DirectionID    string `db:"direction_id"`
+		TripID         string `db:"trip_id"`
+		ShapeID        string `db:"shape_id"`
+		Headsign       string `db:"trip_headsign"`
+		StopID         string `db:"stop_id"`
+	}
+
+	patterns := map[string]*routePattern{}
+	var cur row
+	var stops []string
+	finish := func() {
+		if len(stops) == 0 {
+			return
+		}
+		key := cur.RouteID + "\x00" + cur.DirectionID + "\x00" + strings.Join(stops, "\x00")
+		p := patterns[key]
+		if p == nil {
+			p = &routePattern{
+				RouteID:        cur.RouteID,
+				RouteShortName: cur.RouteShortName,
+				DirectionID:    cur.DirectionID,
+				Headsign:       cur.Headsign,
+				TripID:         cur.TripID,
+				ShapeID:        cur.ShapeID,
+				StopIDs:        stops,
+			}
+			patterns[key] = p
+		}
+		p.TripCount++
+		stops = nil
+	}
+
+	for rows.Next() {
+		var r row
+		if err := rows.StructScan(&r); err != nil {
+			return err
+		}
+		if r.TripID != cur.TripID {
+			finish()
+			cur = r
+		}
+		stops = append(stops, r.StopID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	finish()
+
+	byRoute := map[string][]routePattern{}
+	for _, p := range patterns {
+		byRoute[p.RouteID] = append(byRoute[p.RouteID], *p)
+	}
+	for route, ps := range byRoute {
+		sort.Slice(ps, func(i, j int) bool {
+			if ps[i].DirectionID != ps[j].DirectionID {
+				return ps[i].DirectionID < ps[j].DirectionID
+			}
+			if ps[i].TripCount != ps[j].TripCount {
+				return ps[i].TripCount > ps[j].TripCount
+			}
+			return ps[i].TripID < ps[j].TripID
+		})
+
+		n := map[string]int{}
+		for i := range ps {
+			n[ps[i].DirectionID]++
+			ps[i].ID = fmt.Sprintf("%s-%s-%d", route, ps[i].DirectionID, n[ps[i].DirectionID])
+		}
+	}
+
+	c.byRoute.Store(&byRoute)
+	return nil
+}
+
+// get returns the patterns of route, or of every route if route is
+// empty.
+func (c *patternCache) get(route string) []routePattern {
+	out := []routePattern{}
+	p := c.byRoute.Load()
+	if p == nil {
+		return out
+	}
+	if route != "" {
+		return append(out, (*p)[route]...)
+	}
+
+	routes := make([]string, 0, len(*p))
+	for r := range *p {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	for _, r := range routes {
+		out = append(out, (*p)[r]...)
+	}
+	return out
+}
+
+// stopRoute is a route serving a stop in one direction.
+type stopRoute struct {
+	RouteID        string `json:"route_id"`
+	RouteShortName string `json:"route_short_name"`
+	DirectionID    string `json:"direction_id"`
+
+	// Headsigns are those of the patterns serving the stop, most-used
+	// first.
+	Headsigns []string `json:"trip_headsigns"`
+}
+
+// atStop returns the routes and directions whose patterns serve stop.
+// A pattern's last stop only drops riders off, so it doesn't count.
+func (c *patternCache) atStop(stop string) []stopRoute {
+	out := []stopRoute{}
+	idx := map[string]int{}
+	for _, p := range c.get("") {
+		if i := slices.Index(p.StopIDs, stop); i < 0 || i == len(p.StopIDs)-1 {
+			continue
+		}
+		key := p.RouteID + "\x00" + p.DirectionID
+		i, ok := idx[key]
+		if !ok {
+			i = len(out)
+			idx[key] = i
+			out = append(out, stopRoute{
+				RouteID:        p.RouteID,
+				RouteShortName: p.RouteShortName,
+				DirectionID:    p.DirectionID,
+				Headsigns:      []string{},
+			})
+		}
+		if p.Headsign != "" && !slices.Contains(out[i].Headsigns, p.Headsign) {
+			out[i].Headsigns = append(out[i].Headsigns, p.Headsign)
+		}
+	}
+	return out
+}
+
+func handlePatterns(patterns *patternCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(patterns.get(req.FormValue("route")))
+	}
+}
+
+func handleStopRoutes(patterns *patternCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		stop := req.FormValue("stop")
+		if stop == "" {
+			http.Error(rw, "Missing stop argument", http.StatusBadRequest)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(patterns.atStop(stop))
+	}
+}
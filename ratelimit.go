@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a classic token bucket: it holds up to burst tokens
+// and refills at rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// proxyConfig says whether there are proxies in front of the server,
+// and so whether X-Forwarded-For can be believed.
+type proxyConfig struct {
+	trust bool
+
+	// trusted are the addresses of proxies that forward to each other
+	// before the one that talks to the server.  The one that talks to
+	// the server is always trusted.
+	trusted []netip.Prefix
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDR prefixes
+// or addresses.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, p := range splitList(s) {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func (p proxyConfig) isTrusted(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent req.  Behind a
+// proxy, that is the rightmost X-Forwarded-For entry that isn't one of
+// our own proxies: everything to the left of it was written by the
+// client and can't be believed.
+func (p proxyConfig) clientIP(req *http.Request) string {
+	if p.trust {
+		hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && !p.isTrusted(hop) {
+				return hop
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return host
+}
+
+// readAPIKeys reads API keys from a file, one per line, ignoring blank
+// lines and lines starting with #.
+func readAPIKeys(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys[line] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no API keys in %s", path)
+	}
+	return keys, nil
+}
+
+// rateLimiter hands out a token bucket per client key.
+type rateLimiter struct {
+	rate    float64
+	burst   int
+	proxies proxyConfig
+
+	// keys are the API keys that get a bucket of their own.
+	keys map[string]bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int, proxies proxyConfig, keys map[string]bool) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:      rate,
+		burst:     burst,
+		proxies:   proxies,
+		keys:      keys,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// clientKey identifies the caller, preferring an API key if one of
+// the configured ones was sent and falling back to the client's IP.
+// Any other key is ignored, so clients can't get a fresh bucket by
+// making one up.
+func (rl *rateLimiter) clientKey(req *http.Request) string {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		key = req.URL.Query().Get("api_key")
+	}
+	if rl.keys[key] {
+		return "key:" + key
+	}
+	return "ip:" + rl.proxies.clientIP(req)
+}
+
+// take removes a token from the client's bucket, returning whether
+// the request is allowed, how many tokens are left, and how long until
+// the bucket is full again.
+func (rl *rateLimiter) take(key string, now time.Time) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	b := rl.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rl.burst), b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	reset := time.Duration((float64(rl.burst) - b.tokens) / rl.rate * float64(time.Second))
+	return allowed, int(b.tokens), reset
+}
+
+// sweep drops buckets that have been idle long enough to have refilled
+// completely, so the map doesn't grow without bound.  Must be called
+// with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+
+	full := time.Duration(float64(rl.burst) / rl.rate * float64(time.Second))
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		allowed, remaining, reset := rl.take(rl.clientKey(req), time.Now())
+
+		resetSecs := int(math.Ceil(reset.Seconds()))
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(rl.burst))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		rw.Header().Set("RateLimit-Reset", strconv.Itoa(resetSecs))
+
+		if !allowed {
+			retry := int(math.Ceil((1 - float64(remaining)) / rl.rate))
+			if retry < 1 {
+				retry = 1
+			}
+			rw.Header().Set("Retry-After", strconv.Itoa(retry))
+			writeError(rw, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
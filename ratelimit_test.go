@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientKey(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bool{"good": true}
+
+	tests := []struct {
+		name    string
+		proxies proxyConfig
+		key     string
+		fwd     string
+		want    string
+	}{
+		{"remote address", proxyConfig{}, "", "", "ip:203.0.113.9"},
+		{"configured key", proxyConfig{}, "good", "", "key:good"},
+		{"made up key", proxyConfig{}, "made-up", "", "ip:203.0.113.9"},
+		{"untrusted forwarded for", proxyConfig{}, "", "198.51.100.7", "ip:203.0.113.9"},
+		{"one proxy", proxyConfig{trust: true}, "", "1.2.3.4, 198.51.100.7", "ip:198.51.100.7"},
+		{"proxy chain", proxyConfig{trust: true, trusted: trusted}, "", "1.2.3.4, 198.51.100.7, 10.1.2.3, 192.168.1.1", "ip:198.51.100.7"},
+		{"no forwarded for", proxyConfig{trust: true}, "", "", "ip:203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/cota/routes", nil)
+			req.RemoteAddr = "203.0.113.9:51234"
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			if tt.fwd != "" {
+				req.Header.Set("X-Forwarded-For", tt.fwd)
+			}
+
+			rl := newRateLimiter(1, 1, tt.proxies, keys)
+			if got := rl.clientKey(req); got != tt.want {
+				t.Errorf("clientKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
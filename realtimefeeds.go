@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// realtimeFeed is one of the GTFS-realtime feeds polled for a kind of
+// data.  Agencies sometimes publish several, such as fixed-route and
+// on-demand service separately, and their entities are merged into the
+// same table with Name recorded in its feed_source column.
+type realtimeFeed struct {
+	Name string
+	URL  string
+
+	// Source, if set, is fetched instead of URL.
+	Source feedSource
+}
+
+func (f realtimeFeed) source() feedSource {
+	if f.Source != nil {
+		return f.Source
+	}
+	return newFeedSource(f.URL)
+}
+
+// parseRealtimeFeeds parses a comma-separated list of feed URLs, each
+// optionally named with a name= prefix.  Unnamed feeds are named after
+// their host.
+func parseRealtimeFeeds(s string) ([]realtimeFeed, error) {
+	var feeds []realtimeFeed
+	names := map[string]bool{}
+	for _, entry := range splitList(s) {
+		var f realtimeFeed
+		// A name can't contain ":", and a URL has one before any "=".
+		if name, u, ok := strings.Cut(entry, "="); ok && !strings.Contains(name, ":") {
+			f = realtimeFeed{Name: name, URL: u}
+		} else {
+			f.URL = entry
+			if u, err := url.Parse(entry); err == nil && u.Host != "" {
+				f.Name = u.Hostname()
+			} else {
+				f.Name = entry
+			}
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("more than one feed named %q; name them with name=URL", f.Name)
+		}
+		names[f.Name] = true
+		feeds = append(feeds, f)
+	}
+	if len(feeds) == 0 {
+		return nil, errors.New("no feeds given")
+	}
+	return feeds, nil
+}
+
+type fetchedFeed struct {
+	feed realtimeFeed
+	msg  *FeedMessage
+}
+
+// fetchRealtimeFeeds fetches each of feeds at once, returning those it
+// could, in order.  It only fails if none could be fetched: a feed that
+// fails keeps its rows from the last time it was fetched, like a single
+// feed does.
+func fetchRealtimeFeeds(ctx context.Context, feeds []realtimeFeed) ([]fetchedFeed, updateResult, error) {
+	type result struct {
+		msg     *FeedMessage
+		latency time.Duration
+		err     error
+	}
+	results := make([]result, len(feeds))
+	var wg sync.WaitGroup
+	for i, f := range feeds {
+		wg.Go(func() {
+			start := time.Now()
+			msg, err := f.source().FetchFeed(ctx)
+			results[i] = result{msg, time.Since(start), err}
+		})
+	}
+	wg.Wait()
+
+	var res updateResult
+	var fetched []fetchedFeed
+	var errs []error
+	for i, f := range feeds {
+		msg, err := results[i].msg, results[i].err
+		res.Latency = max(res.Latency, results[i].latency)
+		if err != nil {
+			if len(feeds) > 1 {
+				slog.Error("error fetching realtime feed", "feed", f.Name, "err", err)
+				err = fmt.Errorf("%s: %w", f.Name, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		res.Entities += len(msg.Entity)
+		if ts := msg.GetHeader().GetTimestamp(); ts > 0 {
+			if t := time.Unix(int64(ts), 0); res.FeedTime.IsZero() || t.Before(res.FeedTime) {
+				res.FeedTime = t
+			}
+		}
+		fetched = append(fetched, fetchedFeed{f, msg})
+	}
+	if len(fetched) == 0 {
+		return nil, res, errors.Join(errs...)
+	}
+	return fetched, res, nil
+}
+
+// clearRemovedFeeds deletes the rows of table that came from feeds no
+// longer polled, or from before feeds were attributed.
+func clearRemovedFeeds(tx *sqlx.Tx, table string, feeds []realtimeFeed) error {
+	var names []string
+	for _, f := range feeds {
+		names = append(names, f.Name)
+	}
+	q, args, err := sqlx.In(`DELETE FROM `+table+` WHERE feed_source NOT IN (?)`, names)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(q), args...)
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// feedSource is somewhere realtime feed messages come from.  The
+// updaters only see this, so sources other than polled URLs, such as
+// streams or canned messages, can be put in a realtimeFeed's Source.
+type feedSource interface {
+	FetchFeed(ctx context.Context) (*FeedMessage, error)
+}
+
+// newFeedSource returns the source for a feed given on the command
+// line: an http(s), s3, or gs URL to fetch, or a local file (or file://
+// URL) to reread, as openGTFS accepts for static feeds.
+func newFeedSource(src string) feedSource {
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") || isObjectURL(src) {
+		return urlSource(src)
+	}
+	if strings.HasPrefix(src, "file://") {
+		if u, err := url.Parse(src); err == nil {
+			return fileSource(u.Path)
+		}
+	}
+	return fileSource(src)
+}
+
+// urlSource fetches a feed over HTTP or from object storage, with any
+// headers, recording, and replay configured for the URL.
+type urlSource string
+
+func (s urlSource) FetchFeed(ctx context.Context) (*FeedMessage, error) {
+	msg, _, err := fetchProtobuf(ctx, string(s))
+	return msg, err
+}
+
+// fileSource rereads a feed from a local file each time, for feeds
+// written by another process.
+type fileSource string
+
+func (s fileSource) FetchFeed(ctx context.Context) (*FeedMessage, error) {
+	d, err := os.ReadFile(string(s))
+	if err != nil {
+		return nil, err
+	}
+	var msg FeedMessage
+	if err := proto.Unmarshal(d, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
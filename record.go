@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recordDir is where fetched feeds are saved when recording is
+// enabled with -record-dir.  It may be an s3 or gs URL.
+var recordDir string
+
+// recordTimeFormat names recorded feeds so that sorting the names
+// sorts them by when they were fetched.
+const recordTimeFormat = "20060102T150405.000Z"
+
+// recordName is what recordings of the feed at u are named after: its
+// host and a hash of the rest of the URL.  The hash keeps feeds on the
+// same host apart, and leaves out the query so API keys in it don't
+// end up in file names.
+func recordName(u string) string {
+	host := "feed"
+	if p, err := url.Parse(u); err == nil {
+		if p.Host != "" {
+			host = p.Host
+		}
+		p.RawQuery, p.Fragment = "", ""
+		u = p.String()
+	}
+	sum := sha256.Sum256([]byte(u))
+	return host + "-" + hex.EncodeToString(sum[:6])
+}
+
+// recordFeed saves the body fetched from url to recordDir, named after
+// the time it was fetched and recordName(url), like
+// 20240501T130000.000Z-gtfs-rt.example.com-3fa85f64b1c2.  Errors are
+// logged rather than returned so that recording never interrupts
+// serving.
+func recordFeed(url string, d []byte, fetched time.Time) {
+	if recordDir == "" || replay != nil {
+		return
+	}
+
+	name := fetched.UTC().Format(recordTimeFormat) + "-" + recordName(url)
+	if isObjectURL(recordDir) {
+		// Uploading is slow enough that it shouldn't hold up the
+		// update that fetched the feed.
+		go func() {
+			if err := putObject(context.Background(), objectJoin(recordDir, name), d); err != nil {
+				slog.Error("error recording feed", "url", redactURL(url), "err", err)
+			}
+		}()
+		return
+	}
+	if err := os.WriteFile(filepath.Join(recordDir, name), d, 0644); err != nil {
+		slog.Error("error recording feed", "url", redactURL(url), "err", err)
+	}
+}
+
+var (
+	staticRecordedMu sync.Mutex
+	staticRecorded   = map[string]string{}
+)
+
+// recordStaticFeed records a static GTFS zip downloaded from url, but
+// only when its feed_version differs from the last one recorded, so
+// that checking for a new version doesn't save the same feed every
+// time.  A feed without a feed_version is recorded when its contents
+// change.
+func recordStaticFeed(url string, fsys fs.FS, d []byte, fetched time.Time) {
+	if recordDir == "" || replay != nil {
+		return
+	}
+
+	version, err := fsFeedVersion(fsys)
+	if err != nil || version == "" {
+		sum := sha256.Sum256(d)
+		version = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	staticRecordedMu.Lock()
+	same := staticRecorded[url] == version
+	staticRecorded[url] = version
+	staticRecordedMu.Unlock()
+	if !same {
+		recordFeed(url, d, fetched)
+	}
+}
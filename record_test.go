@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordName(t *testing.T) {
+	vehicles := recordName("https://example.com/a/VehiclePositions.pb?api_key=secret")
+	other := recordName("https://example.com/b/VehiclePositions.pb?api_key=secret")
+	if vehicles == other {
+		t.Errorf("feeds with the same last element are both recorded as %s", vehicles)
+	}
+	if strings.Contains(vehicles, "secret") {
+		t.Errorf("recordName = %s, which has the API key in it", vehicles)
+	}
+	if got := recordName("https://example.com/a/VehiclePositions.pb?api_key=rotated"); got != vehicles {
+		t.Errorf("changing the query changed the name from %s to %s", vehicles, got)
+	}
+	if !strings.HasPrefix(vehicles, "example.com-") || strings.Count(vehicles, "-") != 1 {
+		t.Errorf("recordName = %s, want example.com-<hash>", vehicles)
+	}
+}
+
+// TestReplayRecording checks that a feed recorded with recordFeed is
+// what replay serves for its URL.
+func TestReplayRecording(t *testing.T) {
+	dir := t.TempDir()
+	const u = "https://example.com/gtfs-rt/VehiclePositions.pb?api_key=secret"
+	at := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+
+	recordDir = dir
+	defer func() { recordDir = "" }()
+	recordFeed(u, []byte("recorded"), at)
+
+	r, err := openReplay(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := r.fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d) != "recorded" {
+		t.Errorf("replayed %q, want %q", d, "recorded")
+	}
+}
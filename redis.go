@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient returns a client for the Redis server at addr, which
+// is either host:port or a redis:// or rediss:// (TLS) URL.  username
+// and password, if set, override any in the URL.
+func newRedisClient(addr, username, password string) (*redis.Client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	opts, err := redis.ParseURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		opts.Username = username
+	}
+	if password != "" {
+		opts.Password = password
+	}
+	return redis.NewClient(opts), nil
+}
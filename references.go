@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// routeIDCache holds the route_ids in the static data, read on first
+// use after each load.
+type routeIDCache struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+// watch forgets the route_ids whenever static data is reloaded.
+func (c *routeIDCache) watch(events *eventBus) {
+	ch := events.subscribe(staticReloaded)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		c.mu.Lock()
+		c.ids = nil
+		c.mu.Unlock()
+	}
+}
+
+func (c *routeIDCache) get(ctx context.Context, db *sqlx.DB) (map[string]bool, error) {
+	c.mu.Lock()
+	ids := c.ids
+	c.mu.Unlock()
+	if ids != nil {
+		return ids, nil
+	}
+
+	var rows []string
+	if err := dbSelect(ctx, db, "route ids", &rows, "SELECT route_id FROM routes"); err != nil {
+		return nil, err
+	}
+	ids = make(map[string]bool, len(rows))
+	for _, id := range rows {
+		ids[id] = true
+	}
+	c.mu.Lock()
+	c.ids = ids
+	c.mu.Unlock()
+	return ids, nil
+}
+
+// unknownRoutes checks the route argument of the endpoints in
+// apiEndpoints that take one, so a typo like route=999 isn't mistaken
+// for a route with nothing on it.  Responses to requests naming routes
+// that don't exist carry a Warning, or if notFound is set, are a 404.
+func unknownRoutes(next http.Handler, db *sqlx.DB, routes *routeIDCache, notFound bool) http.Handler {
+	takesRoute := map[string]bool{}
+	for _, e := range apiEndpoints {
+		takesRoute[e.Path] = slices.ContainsFunc(e.Params, func(p apiParam) bool { return p.Name == "route" })
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		arg := req.URL.Query().Get("route")
+		if !takesRoute[req.URL.Path] || arg == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		ids, err := routes.get(req.Context(), db)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// /cota/vehicles also takes !A,B to exclude routes.
+		var unknown []string
+		for _, id := range strings.Split(strings.TrimPrefix(arg, "!"), ",") {
+			if id != "" && !ids[id] {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) == 0 {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if notFound {
+			var errs []apiError
+			for _, id := range unknown {
+				errs = append(errs, apiError{
+					Status: "404",
+					Title:  http.StatusText(http.StatusNotFound),
+					Detail: fmt.Sprintf("there is no route %s", id),
+					Source: &apiErrorSource{Parameter: "route"},
+				})
+			}
+			writeErrors(rw, http.StatusNotFound, errs)
+			return
+		}
+		for _, id := range unknown {
+			rw.Header().Add("Warning", fmt.Sprintf("299 - %q", "there is no route "+id))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// parseTimeOfDay parses a 24-hour HH:MM time.
+func parseTimeOfDay(s string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// nextTimeOfDay returns the first time after now that is hour:minute in
+// now's location.
+func nextTimeOfDay(now time.Time, hour, minute int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// reloadDaily reloads static GTFS every day at hour:minute local time,
+// typically in the middle of the night when few buses are running.
+func reloadDaily(loader *gtfsLoader, hour, minute int) {
+	for {
+		next := nextTimeOfDay(time.Now(), hour, minute)
+		slog.Debug("next scheduled GTFS reload", "at", next)
+		time.Sleep(time.Until(next))
+
+		if err := loader.Load(context.Background()); err != nil {
+			slog.Error("error in scheduled GTFS reload", "err", err)
+		}
+	}
+}
+
+// watchFeedVersion checks the GTFS source every interval and reloads
+// when its feed_info.txt has a different feed_version than the loaded
+// data.
+func watchFeedVersion(loader *gtfsLoader, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		v, err := sourceFeedVersion(context.Background(), loader.src)
+		if err != nil {
+			slog.Warn("error checking GTFS feed version", "err", err)
+			continue
+		}
+		if v == "" {
+			continue
+		}
+		if cur := loader.feed.get(); cur != nil && cur.Version == v {
+			continue
+		}
+
+		slog.Info("new GTFS feed version available", "version", v)
+		if err := loader.Load(context.Background()); err != nil {
+			slog.Error("error reloading GTFS for new feed version", "err", err)
+		}
+	}
+}
+
+// sourceFeedVersion returns the feed_version in src's feed_info.txt, or
+// the empty string if it doesn't have one.
+func sourceFeedVersion(ctx context.Context, src string) (string, error) {
+	fsys, closeFeed, err := openGTFS(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	defer closeFeed()
+	return fsFeedVersion(fsys)
+}
+
+// fsFeedVersion returns the feed_version in fsys's feed_info.txt, or
+// the empty string if it doesn't have one.
+func fsFeedVersion(fsys fs.FS) (string, error) {
+	f, err := fsys.Open("feed_info.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return "", err
+	}
+	rec, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		if h == "feed_version" && i < len(rec) {
+			return rec[i], nil
+		}
+	}
+	return "", nil
+}
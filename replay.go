@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// realtimeInterval is how often the realtime feeds are fetched.
+const realtimeInterval = 60 * time.Second
+
+// replay, when set with -replay-dir, serves feeds saved by -record-dir
+// in place of fetching them, on a clock that starts at the first
+// recording.
+var replay *feedReplay
+
+type recording struct {
+	at   time.Time
+	path string
+}
+
+type feedReplay struct {
+	// files holds the recordings of each feed, by the recordName of
+	// its URL, oldest first.
+	files map[string][]recording
+
+	start time.Time // time of the first recording
+	began time.Time // when the replay started
+	speed float64
+}
+
+func openReplay(dir string, speed float64) (*feedReplay, error) {
+	if speed <= 0 {
+		return nil, errors.New("replay speed must be positive")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &feedReplay{files: map[string][]recording{}, began: time.Now(), speed: speed}
+	for _, e := range entries {
+		ts, name, ok := strings.Cut(e.Name(), "-")
+		if !ok || e.IsDir() {
+			continue
+		}
+		at, err := time.Parse(recordTimeFormat, ts)
+		if err != nil {
+			continue
+		}
+		r.files[name] = append(r.files[name], recording{at, filepath.Join(dir, e.Name())})
+		if r.start.IsZero() || at.Before(r.start) {
+			r.start = at
+		}
+	}
+	if len(r.files) == 0 {
+		return nil, fmt.Errorf("no recorded feeds in %s", dir)
+	}
+
+	for _, recs := range r.files {
+		sort.Slice(recs, func(i, j int) bool { return recs[i].at.Before(recs[j].at) })
+	}
+	return r, nil
+}
+
+// now returns the time on the replay clock.
+func (r *feedReplay) now() time.Time {
+	return r.start.Add(time.Duration(float64(time.Since(r.began)) * r.speed))
+}
+
+// fetch returns the most recent recording of url's feed as of the
+// replay clock.  Past the last recording, the last one is served.
+func (r *feedReplay) fetch(url string) ([]byte, error) {
+	name := recordName(url)
+	recs := r.files[name]
+	now := r.now()
+
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].at.After(now) })
+	if i == 0 {
+		return nil, fmt.Errorf("no recording of %s (%s) as of %s", redactURL(url), name, now.UTC().Format(time.RFC3339))
+	}
+	return os.ReadFile(recs[i-1].path)
+}
+
+// feedNow returns the current time, or the replay clock when replaying,
+// for anything compared against realtime data.
+func feedNow() time.Time {
+	if replay != nil {
+		return replay.now()
+	}
+	return time.Now()
+}
+
+// feedSleep sleeps for d on the replay clock, if there is one.
+func feedSleep(d time.Duration) {
+	if replay != nil {
+		d = time.Duration(float64(d) / replay.speed)
+	}
+	time.Sleep(d)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scheduleLookahead is how far ahead scheduled arrivals are used to
+// fill in for routes with no realtime prediction.
+const scheduleLookahead = 2 * time.Hour
+
+// maxTimeWindow bounds how far ahead max_time can reach.
+const maxTimeWindow = 24 * time.Hour
+
+// timeWindow is the span of arrivals a request asks for with its
+// min_time and max_time arguments.
+type timeWindow struct {
+	from time.Time
+
+	// to is zero if the request gave no max_time.
+	to time.Time
+}
+
+// until returns the end of the window, or lookahead past its start if
+// the request didn't give one.
+func (w timeWindow) until(lookahead time.Duration) time.Time {
+	if w.to.IsZero() {
+		return w.from.Add(lookahead)
+	}
+	return w.to
+}
+
+// parseTimeWindow returns the window of arrivals req asks for, starting
+// now by default.  Each bound is either a duration from now, such as
+// 30m, or an RFC 3339 time.  Arrivals that have passed aren't served,
+// so the window never starts before now.
+func parseTimeWindow(req *http.Request, now time.Time) (timeWindow, error) {
+	parse := func(name string) (time.Time, error) {
+		v := req.FormValue(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		if d, err := time.ParseDuration(v); err == nil {
+			return now.Add(d), nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s must be a duration from now, such as 30m, or an RFC 3339 time", name)
+		}
+		return t, nil
+	}
+
+	w := timeWindow{from: now}
+	from, err := parse("min_time")
+	if err != nil {
+		return w, err
+	}
+	if from.After(now) {
+		w.from = from
+	}
+	if w.to, err = parse("max_time"); err != nil {
+		return w, err
+	}
+	if !w.to.IsZero() && !w.to.After(w.from) {
+		return w, errors.New("max_time must be after min_time and now")
+	}
+	if w.until(0).Sub(now) > maxTimeWindow {
+		return w, errors.New("min_time and max_time must be within a day from now")
+	}
+	return w, nil
+}
+
+// agencyLocation returns the time zone the schedule is written in.
+func agencyLocation(ctx context.Context, db *sqlx.DB) *time.Location {
+	var tz string
+	if err := db.GetContext(ctx, &tz, `SELECT agency_timezone FROM agency LIMIT 1`); err != nil {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// activeServiceIDs returns the service_ids that run on date: those
+// whose calendar covers date's weekday, plus those added by
+// calendar_dates, less those removed by it.
+func activeServiceIDs(ctx context.Context, db *sqlx.DB, date time.Time) ([]string, error) {
+	day := date.Format("20060102")
+	weekday := strings.ToLower(date.Weekday().String())
+
+	q := `SELECT service_id FROM calendar
+	      WHERE start_date <= ? AND end_date >= ? AND ` + weekday + ` = '1'
+	      UNION
+	      SELECT service_id FROM calendar_dates WHERE date = ? AND exception_type = '1'
+	      EXCEPT
+	      SELECT service_id FROM calendar_dates WHERE date = ? AND exception_type = '2'`
+	services := []string{}
+	if err := dbSelect(ctx, db, "active services", &services, q, day, day, day, day); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+type scheduledArrival struct {
+	StopID         string   `db:"stop_id"`
+	TripID         string   `db:"trip_id"`
+	RouteID        string   `db:"route_id"`
+	RouteShortName string   `db:"route_short_name"`
+	TripHeadsign   string   `db:"trip_headsign"`
+	ArrivalTime    gtfsTime `db:"arrival_time"`
+
+	// At is ArrivalTime on the trip's service day.
+	At time.Time `db:"-"`
+}
+
+// scheduledArrivals returns the arrivals at stop scheduled within
+// window of now, soonest first.
+func scheduledArrivals(ctx context.Context, db *sqlx.DB, stop string, now time.Time, window time.Duration) ([]scheduledArrival, error) {
+	now = now.In(agencyLocation(ctx, db))
+
+	var all []scheduledArrival
+
+	for _, date := range serviceDays(now) {
+		start := serviceDayStart(date)
+		from := gtfsTime(now.Sub(start) / time.Second)
+		to := gtfsTime(now.Add(window).Sub(start) / time.Second)
+
+		services, err := activeServiceIDs(ctx, db, date)
+		if err != nil {
+			return nil, err
+		}
+		if len(services) == 0 {
+			continue
+		}
+
+		arrivals := []scheduledArrival{}
+		q, args, err := sqlx.In(`SELECT st.stop_id, st.trip_id, trips.route_id, routes.route_short_name, trips.trip_headsign, st.arrival_time
+		      FROM stop_times AS st
+		      INNER JOIN trips ON st.trip_id = trips.trip_id
+		      INNER JOIN routes ON trips.route_id = routes.route_id
+		      WHERE st.stop_id = ?
+		        AND trips.service_id IN (?)
+		        AND st.arrival_time != ''
+		        AND `+gtfsSeconds("st.arrival_time")+` BETWEEN ? AND ?`,
+			stop, services, int(from), int(to))
+		if err != nil {
+			return nil, err
+		}
+		if err := dbSelect(ctx, db, "scheduled arrivals", &arrivals, db.Rebind(q), args...); err != nil {
+			return nil, err
+		}
+
+		for i := range arrivals {
+			arrivals[i].At = arrivals[i].ArrivalTime.On(date)
+		}
+		all = append(all, arrivals...)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].At.Before(all[j].At) })
+	return all, nil
+}
+
+// scheduledPredictions returns the next scheduled arrival at stop for
+// each route not in exclude, for routes running within w, or within
+// scheduleLookahead of its start if it has no end.
+func scheduledPredictions(ctx context.Context, db *sqlx.DB, stop string, now time.Time, w timeWindow, exclude map[string]bool) ([]prediction, error) {
+	arrivals, err := scheduledArrivals(ctx, db, stop, w.from, w.until(scheduleLookahead).Sub(w.from))
+	if err != nil {
+		return nil, err
+	}
+	canceled, err := canceledTrips(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Canceled arrivals before a route's next one are listed too, so
+	// riders know the bus they were expecting isn't coming.
+	predictions := []prediction{}
+	seen := map[string]bool{}
+	for _, a := range arrivals {
+		if exclude[a.RouteID] || seen[a.RouteID] {
+			continue
+		}
+		seen[a.RouteID] = !canceled[a.TripID]
+		predictions = append(predictions, prediction{
+			StopID:       a.StopID,
+			RouteID:      a.RouteID,
+			TripHeadsign: a.TripHeadsign,
+			ArrivalTime:  uint64(a.At.Sub(now) / time.Second),
+			Scheduled:    true,
+			Canceled:     canceled[a.TripID],
+		})
+	}
+	return predictions, nil
+}
+
+// canceledTrips returns the trips the trip updates feed has canceled.
+func canceledTrips(ctx context.Context, db *sqlx.DB) (map[string]bool, error) {
+	var ids []string
+	const q = `SELECT DISTINCT trip_id FROM stop_time_updates WHERE schedule_relationship = 'canceled'`
+	if err := dbSelect(ctx, db, "canceled trips", &ids, q); err != nil {
+		return nil, err
+	}
+	canceled := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		canceled[id] = true
+	}
+	return canceled, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// maxSearchResults bounds the limit argument to /cota/search.
+const maxSearchResults = 100
+
+type searchResult struct {
+	// Type is "stop", "route", or "headsign".
+	Type string `json:"type"`
+
+	// ID is the stop_id or route_id.  Headsigns are identified by the
+	// route they're on.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// ShortName is the route_short_name of route results.
+	ShortName string `json:"short_name,omitempty"`
+}
+
+// searchIndex is an inverted index from the words in stop names, route
+// names, and headsigns to the results they appear in.  It is never
+// modified once built.
+type searchIndex struct {
+	results []searchResult
+
+	// words is sorted so that prefix matches are a contiguous range.
+	words    []string
+	postings map[string][]int
+}
+
+// searchTokens splits s into lowercase words, dropping punctuation, so
+// "N High St & E 5th Ave" and "high st" share words.
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// nameMatches reports whether q appears anywhere in name, ignoring
+// case, for the simple name filters on stops and routes.
+func nameMatches(name, q string) bool {
+	return strings.Contains(strings.ToLower(name), strings.ToLower(q))
+}
+
+func newSearchIndex(results []searchResult) *searchIndex {
+	ix := &searchIndex{results: results, postings: map[string][]int{}}
+	for i, r := range results {
+		seen := map[string]bool{}
+		for _, w := range searchTokens(r.Name + " " + r.ShortName) {
+			if seen[w] {
+				continue
+			}
+			seen[w] = true
+			if _, ok := ix.postings[w]; !ok {
+				ix.words = append(ix.words, w)
+			}
+			ix.postings[w] = append(ix.postings[w], i)
+		}
+	}
+	sort.Strings(ix.words)
+	return ix
+}
+
+// matches returns the results containing a word that starts with w,
+// along with whether each one contains w exactly.  If nothing starts
+// with w, words within one edit of it match instead, to forgive typos.
+func (ix *searchIndex) matches(w string) map[int]bool {
+	out := map[int]bool{}
+	add := func(word string) {
+		for _, i := range ix.postings[word] {
+			out[i] = out[i] || word == w
+		}
+	}
+
+	for i := sort.SearchStrings(ix.words, w); i < len(ix.words) && strings.HasPrefix(ix.words[i], w); i++ {
+		add(ix.words[i])
+	}
+	if len(out) > 0 || len(w) < 4 {
+		return out
+	}
+
+	for _, word := range ix.words {
+		if withinOneEdit(w, word) {
+			add(word)
+		}
+	}
+	return out
+}
+
+// search returns up to limit results containing every word of q,
+// results with more exact word matches first.
+func (ix *searchIndex) search(q string, limit int) []searchResult {
+	words := searchTokens(q)
+	if len(words) == 0 {
+		return []searchResult{}
+	}
+
+	var found map[int]int
+	for _, w := range words {
+		m := ix.matches(w)
+		next := map[int]int{}
+		for i, exact := range m {
+			score, ok := found[i]
+			if found != nil && !ok {
+				continue
+			}
+			if exact {
+				score++
+			}
+			next[i] = score
+		}
+		found = next
+		if len(found) == 0 {
+			break
+		}
+	}
+
+	hits := make([]int, 0, len(found))
+	for i := range found {
+		hits = append(hits, i)
+	}
+	sort.Slice(hits, func(a, b int) bool {
+		if found[hits[a]] != found[hits[b]] {
+			return found[hits[a]] > found[hits[b]]
+		}
+		ra, rb := ix.results[hits[a]], ix.results[hits[b]]
+		if ra.Name != rb.Name {
+			return ra.Name < rb.Name
+		}
+		return ra.ID < rb.ID
+	})
+
+	out := make([]searchResult, 0, min(len(hits), limit))
+	for _, i := range hits[:min(len(hits), limit)] {
+		out = append(out, ix.results[i])
+	}
+	return out
+}
+
+// withinOneEdit reports whether a can be turned into b by inserting,
+// deleting, or changing at most one character.
+func withinOneEdit(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+	if i == len(a) {
+		return true
+	}
+	if len(a) == len(b) {
+		return a[i+1:] == b[i+1:]
+	}
+	return a[i:] == b[i+1:]
+}
+
+// searchCache holds the current searchIndex.
+type searchCache struct {
+	index atomic.Pointer[searchIndex]
+}
+
+// refresh rereads stop names, route names, and headsigns from the
+// database and rebuilds the index.
+func (c *searchCache) refresh(ctx context.Context, db *sqlx.DB) error {
+	var results []searchResult
+
+	stops := []stop{}
+	if err := dbSelect(ctx, db, "stops", &stops, `SELECT stop_id, stop_name FROM stops`); err != nil {
+		return err
+	}
+	for _, s := range stops {
+		results = append(results, searchResult{Type: "stop", ID: s.ID, Name: s.Name})
+	}
+
+	routes := []route{}
+	const rq = `SELECT route_id, route_long_name, route_short_name FROM routes WHERE agency_id = 'COTA'`
+	if err := dbSelect(ctx, db, "routes", &routes, rq); err != nil {
+		return err
+	}
+	for _, r := range routes {
+		results = append(results, searchResult{Type: "route", ID: r.ID, Name: r.LongName, ShortName: r.ShortName})
+	}
+
+	var headsigns []struct {
+		RouteID  string `db:"route_id"`
+		Headsign string `db:"trip_headsign"`
+	}
+	const hq = `SELECT DISTINCT route_id, trip_headsign FROM trips WHERE trip_headsign != ''`
+	if err := dbSelect(ctx, db, "headsigns", &headsigns, hq); err != nil {
+		return err
+	}
+	for _, h := range headsigns {
+		results = append(results, searchResult{Type: "headsign", ID: h.RouteID, Name: h.Headsign})
+	}
+
+	c.index.Store(newSearchIndex(results))
+	return nil
+}
+
+func (c *searchCache) search(q string, limit int) []searchResult {
+	ix := c.index.Load()
+	if ix == nil {
+		return []searchResult{}
+	}
+	return ix.search(q, limit)
+}
+
+func handleSearch(search *searchCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		q := req.FormValue("q")
+		if strings.TrimSpace(q) == "" {
+			http.Error(rw, "Missing q argument", http.StatusBadRequest)
+			return
+		}
+
+		limit := 20
+		if l := req.FormValue("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxSearchResults {
+				http.Error(rw, "limit must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(search.search(q, limit))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// serviceSpan is when a route runs in one direction on a service day.
+type serviceSpan struct {
+	DirectionID    string    `json:"direction_id"`
+	FirstDeparture time.Time `json:"first_departure"`
+	LastDeparture  time.Time `json:"last_departure"`
+}
+
+// serviceSpanCache holds the service spans of every route for recent
+// service days.  They take a pass over stop_times to compute, so each
+// day's are only computed once per load of static data.
+type serviceSpanCache struct {
+	mu    sync.Mutex
+	byDay map[string]map[string][]serviceSpan
+}
+
+// watch forgets the cached spans whenever static data is reloaded.
+func (c *serviceSpanCache) watch(events *eventBus) {
+	ch := events.subscribe(staticReloaded)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		c.mu.Lock()
+		c.byDay = nil
+		c.mu.Unlock()
+	}
+}
+
+// get returns the current service span of every route in each
+// direction.  Until the last trip of the previous service day has
+// left, that day's span is current, so at 1am a route still running
+// last night's late trips reports when those end rather than when
+// today's service starts.
+func (c *serviceSpanCache) get(ctx context.Context, db *sqlx.DB, now time.Time) (map[string][]serviceSpan, error) {
+	now = now.In(agencyLocation(ctx, db))
+	days := serviceDays(now)
+
+	var byDay []map[string][]serviceSpan
+	for _, date := range days {
+		spans, err := c.on(ctx, db, date)
+		if err != nil {
+			return nil, err
+		}
+		byDay = append(byDay, spans)
+	}
+	yesterday, today := byDay[0], byDay[1]
+
+	// Older days won't be asked for again.
+	c.mu.Lock()
+	for key := range c.byDay {
+		if key != days[0].Format("20060102") && key != days[1].Format("20060102") {
+			delete(c.byDay, key)
+		}
+	}
+	c.mu.Unlock()
+
+	current := map[string][]serviceSpan{}
+	for route, spans := range today {
+		current[route] = append(current[route], spans...)
+	}
+	for route, spans := range yesterday {
+		for _, ys := range spans {
+			if !ys.LastDeparture.After(now) {
+				continue
+			}
+			i := slices.IndexFunc(current[route], func(s serviceSpan) bool { return s.DirectionID == ys.DirectionID })
+			if i >= 0 {
+				current[route][i] = ys
+			} else {
+				current[route] = append(current[route], ys)
+			}
+		}
+	}
+	for _, spans := range current {
+		sort.Slice(spans, func(i, j int) bool { return spans[i].DirectionID < spans[j].DirectionID })
+	}
+	return current, nil
+}
+
+// on returns the service spans of every route on the service day of
+// date.
+func (c *serviceSpanCache) on(ctx context.Context, db *sqlx.DB, date time.Time) (map[string][]serviceSpan, error) {
+	key := date.Format("20060102")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if spans, ok := c.byDay[key]; ok {
+		return spans, nil
+	}
+
+	services, err := activeServiceIDs(ctx, db, date)
+	if err != nil {
+		return nil, err
+	}
+
+	byRoute := map[string][]serviceSpan{}
+	if len(services) > 0 {
+		var rows []struct {
+			RouteID     string `db:"route_id"`
+			DirectionID string `db:"direction_id"`
+			First       int    `db:"first_departure"`
+			Last        int    `db:"last_departure"`
+		}
+		secs := gtfsSeconds("st.departure_time")
+		q, args, err := sqlx.In(`SELECT trips.route_id, trips.direction_id,
+		          MIN(`+secs+`) AS first_departure, MAX(`+secs+`) AS last_departure
+		      FROM stop_times AS st
+		      INNER JOIN trips ON st.trip_id = trips.trip_id
+		      WHERE trips.service_id IN (?) AND st.departure_time != ''
+		      GROUP BY trips.route_id, trips.direction_id
+		      ORDER BY trips.route_id, trips.direction_id`, services)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbSelect(ctx, db, "service spans", &rows, db.Rebind(q), args...); err != nil {
+			return nil, err
+		}
+
+		for _, r := range rows {
+			byRoute[r.RouteID] = append(byRoute[r.RouteID], serviceSpan{
+				DirectionID:    r.DirectionID,
+				FirstDeparture: gtfsTime(r.First).On(date),
+				LastDeparture:  gtfsTime(r.Last).On(date),
+			})
+		}
+	}
+
+	if c.byDay == nil {
+		c.byDay = map[string]map[string][]serviceSpan{}
+	}
+	c.byDay[key] = byRoute
+	return byRoute, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type shapePoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	// Dist is the distance along the shape to this point, from
+	// shape_dist_traveled if the feed has it or measured in meters if
+	// not.
+	Dist float64 `json:"-"`
+}
+
+type shape struct {
+	ID       string       `json:"shape_id"`
+	Polyline string       `json:"polyline"`
+	Points   []shapePoint `json:"points,omitempty"`
+}
+
+// shapeTolerances are the preset simplification levels accepted by the
+// tolerance argument, in meters.  Shapes are simplified to each of them
+// once per load.
+var shapeTolerances = map[string]float64{
+	"none":   0,
+	"low":    2,
+	"medium": 10,
+	"high":   50,
+}
+
+// shapeSnapshot is every shape at each of the preset tolerances, along
+// with which shapes each route uses.  The shapes are stored with their
+// polylines already encoded.  A snapshot is never modified once built.
+type shapeSnapshot struct {
+	byTolerance map[string]map[string]shape
+	routeShapes map[string][]string
+}
+
+// shapeCache holds the current shapeSnapshot.
+type shapeCache struct {
+	snap atomic.Pointer[shapeSnapshot]
+}
+
+// refresh rereads shapes from the database and simplifies them.
+func (c *shapeCache) refresh(ctx context.Context, db *sqlx.DB) error {
+	var rows []struct {
+		ID   string          `db:"shape_id"`
+		Lat  float64         `db:"lat"`
+		Lon  float64         `db:"lon"`
+		Dist sql.NullFloat64 `db:"dist"`
+	}
+	const q = `SELECT shape_id, CAST(shape_pt_lat AS REAL) AS lat, CAST(shape_pt_lon AS REAL) AS lon,
+		          CAST(NULLIF(shape_dist_traveled, '') AS REAL) AS dist
+		   FROM shapes
+		   ORDER BY shape_id, CAST(shape_pt_sequence AS INTEGER)`
+	if err := dbSelect(ctx, db, "shapes", &rows, q); err != nil {
+		return err
+	}
+
+	var routes []struct {
+		RouteID string `db:"route_id"`
+		ShapeID string `db:"shape_id"`
+	}
+	const rq = `SELECT DISTINCT route_id, shape_id FROM trips WHERE shape_id != '' ORDER BY route_id, shape_id`
+	if err := dbSelect(ctx, db, "route shapes", &routes, rq); err != nil {
+		return err
+	}
+
+	full := map[string][]shapePoint{}
+	measured := map[string]bool{}
+	for _, r := range rows {
+		pts := full[r.ID]
+		p := shapePoint{Latitude: r.Lat, Longitude: r.Lon, Dist: r.Dist.Float64}
+		if !r.Dist.Valid {
+			measured[r.ID] = true
+		}
+		full[r.ID] = append(pts, p)
+	}
+
+	// shape_dist_traveled is optional, and only useful if every point
+	// in a shape has it.  Otherwise measure the shape ourselves.
+	for id := range measured {
+		pts := full[id]
+		for i := range pts {
+			pts[i].Dist = 0
+			if i > 0 {
+				pts[i].Dist = pts[i-1].Dist + distanceMeters(pts[i-1].Latitude, pts[i-1].Longitude, pts[i].Latitude, pts[i].Longitude)
+			}
+		}
+	}
+
+	byTolerance := map[string]map[string]shape{}
+	for name, tol := range shapeTolerances {
+		m := make(map[string]shape, len(full))
+		for id, pts := range full {
+			if tol > 0 {
+				pts = simplifyShape(pts, tol)
+			}
+			m[id] = shape{ID: id, Polyline: encodePolyline(pts), Points: pts}
+		}
+		byTolerance[name] = m
+	}
+
+	routeShapes := map[string][]string{}
+	for _, r := range routes {
+		routeShapes[r.RouteID] = append(routeShapes[r.RouteID], r.ShapeID)
+	}
+
+	c.snap.Store(&shapeSnapshot{byTolerance: byTolerance, routeShapes: routeShapes})
+	return nil
+}
+
+// snapshot returns the current shapes, or an empty snapshot before the
+// first refresh.
+func (c *shapeCache) snapshot() *shapeSnapshot {
+	if snap := c.snap.Load(); snap != nil {
+		return snap
+	}
+	return &shapeSnapshot{}
+}
+
+// get returns the shapes used by route, or every shape if route is
+// empty.  tolerance is either one of the presets or a number of
+// meters; ok is false if it is neither.  Points are only included if
+// withPoints is set; otherwise just the encoded polyline is.
+func (c *shapeCache) get(route, tolerance string, withPoints bool) (shapes []shape, ok bool) {
+	snap := c.snapshot()
+
+	if tolerance == "" {
+		tolerance = "none"
+	}
+	set, ok := snap.byTolerance[tolerance]
+	meters := 0.0
+	if !ok {
+		m, err := strconv.ParseFloat(tolerance, 64)
+		if err != nil || m < 0 {
+			return nil, false
+		}
+		set, meters = snap.byTolerance["none"], m
+	}
+
+	var ids []string
+	if route != "" {
+		ids = snap.routeShapes[route]
+	} else {
+		for id := range set {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+
+	shapes = []shape{}
+	for _, id := range ids {
+		sh, found := set[id]
+		if !found {
+			continue
+		}
+		if meters > 0 {
+			sh.Points = simplifyShape(sh.Points, meters)
+			sh.Polyline = encodePolyline(sh.Points)
+		}
+		if !withPoints {
+			sh.Points = nil
+		}
+		shapes = append(shapes, sh)
+	}
+	return shapes, true
+}
+
+// simplifyShape reduces the points in a line with the Douglas-Peucker
+// algorithm, so no removed point was more than tolerance meters from
+// the simplified line.
+func simplifyShape(pts []shapePoint, tolerance float64) []shapePoint {
+	if len(pts) < 3 {
+		return pts
+	}
+
+	keep := make([]bool, len(pts))
+	keep[0], keep[len(pts)-1] = true, true
+
+	// Work through the spans still to be simplified with a stack rather
+	// than recursion; shapes can have thousands of points.
+	type span struct{ first, last int }
+	stack := []span{{0, len(pts) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		maxDist, maxIdx := 0.0, -1
+		for i := s.first + 1; i < s.last; i++ {
+			if d := segmentDistance(pts[i], pts[s.first], pts[s.last]); d > maxDist {
+				maxDist, maxIdx = d, i
+			}
+		}
+		if maxIdx >= 0 && maxDist > tolerance {
+			keep[maxIdx] = true
+			stack = append(stack, span{s.first, maxIdx}, span{maxIdx, s.last})
+		}
+	}
+
+	out := make([]shapePoint, 0, len(pts))
+	for i, p := range pts {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// locate finds the point on a shape closest to lat, lon and returns how
+// far along the shape it is, in the shape's distance units, and as a
+// fraction of the shape's length, along with how far lat, lon is from
+// it in meters.
+func (c *shapeCache) locate(shapeID string, lat, lon float64) (dist, progress, offset float64, ok bool) {
+	sh, ok := c.snapshot().byTolerance["none"][shapeID]
+	if !ok || len(sh.Points) < 2 {
+		return 0, 0, 0, false
+	}
+
+	pts := sh.Points
+	p := shapePoint{Latitude: lat, Longitude: lon}
+	offset = math.Inf(1)
+	for i := 0; i < len(pts)-1; i++ {
+		t, d := segmentProjection(p, pts[i], pts[i+1])
+		if d < offset {
+			offset = d
+			dist = pts[i].Dist + t*(pts[i+1].Dist-pts[i].Dist)
+		}
+	}
+
+	if total := pts[len(pts)-1].Dist; total > 0 {
+		progress = math.Round(dist/total*1000) / 1000
+	}
+	return dist, progress, offset, true
+}
+
+// segmentDistance returns the distance in meters from p to the segment
+// a-b.
+func segmentDistance(p, a, b shapePoint) float64 {
+	_, d := segmentProjection(p, a, b)
+	return d
+}
+
+// segmentProjection finds the point on the segment a-b closest to p,
+// returning how far it is from a to b as a fraction, and its distance
+// from p in meters.  Shapes cover a small area, so an equirectangular
+// projection around p is accurate enough.
+func segmentProjection(p, a, b shapePoint) (t, meters float64) {
+	const metersPerDegree = 111320
+
+	cos := math.Cos(p.Latitude * math.Pi / 180)
+	project := func(q shapePoint) (x, y float64) {
+		return (q.Longitude - p.Longitude) * metersPerDegree * cos, (q.Latitude - p.Latitude) * metersPerDegree
+	}
+
+	ax, ay := project(a)
+	bx, by := project(b)
+	dx, dy := bx-ax, by-ay
+
+	// p is the origin, so find the point on a-b closest to it.
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+	return t, math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+// encodePolyline encodes points in Google's encoded polyline format,
+// which most map libraries can decode.
+func encodePolyline(pts []shapePoint) string {
+	var b strings.Builder
+	var prevLat, prevLon int64
+
+	enc := func(v int64) {
+		u := uint64(v << 1)
+		if v < 0 {
+			u = ^u
+		}
+		for u >= 0x20 {
+			b.WriteByte(byte(0x20|u&0x1f) + 63)
+			u >>= 5
+		}
+		b.WriteByte(byte(u) + 63)
+	}
+
+	for _, p := range pts {
+		lat := int64(math.Round(p.Latitude * 1e5))
+		lon := int64(math.Round(p.Longitude * 1e5))
+		enc(lat - prevLat)
+		enc(lon - prevLon)
+		prevLat, prevLon = lat, lon
+	}
+	return b.String()
+}
+
+func handleShapes(shapes *shapeCache, responses *jsonCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		route, tolerance := req.FormValue("route"), req.FormValue("tolerance")
+		withPoints := slices.Contains(splitList(req.FormValue("fields")), "points")
+
+		key := fmt.Sprintf("shapes %q %q %t", route, tolerance, withPoints)
+		body, err := responses.get(key, 0, func() (any, error) {
+			out, ok := shapes.get(route, tolerance, withPoints)
+			if !ok {
+				return nil, errInvalidTolerance
+			}
+			return out, nil
+		})
+		if errors.Is(err, errInvalidTolerance) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeCachedJSON(rw, body)
+	}
+}
+
+var errInvalidTolerance = errors.New("Invalid tolerance argument")
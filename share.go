@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// realtimeColumns are the columns of each realtime table, as created
+// by createRealtimeTables.
+var realtimeColumns = map[string][]string{
+	"vehicle_positions": {"vehicle_id", "vehicle_label", "trip_id", "latitude", "longitude", "feed_source", "occupancy_status"},
+	"stop_time_updates": {"stop_id", "trip_id", "arrival_time", "vehicle_id", "feed_source", "schedule_relationship"},
+}
+
+// sharedExpiry is how long realtime data shared in Redis lasts without
+// being updated, so readers don't serve it forever if the instance
+// polling COTA goes away.
+const sharedExpiry = 10 * realtimeInterval
+
+// realtimeSnapshot is the contents of a realtime table.  Every value is
+// kept as a string, and sqlite's column affinity turns numbers back
+// into numbers when the snapshot is loaded.
+type realtimeSnapshot struct {
+	FetchedAt time.Time  `json:"fetched_at"`
+	Columns   []string   `json:"columns"`
+	Rows      [][]string `json:"rows"`
+}
+
+func readRealtimeSnapshot(ctx context.Context, db *sqlx.DB, table string) (_ *realtimeSnapshot, err error) {
+	ctx, span := tracer.Start(ctx, "db.select "+table+" snapshot")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	cols := realtimeColumns[table]
+	rows, err := db.QueryContext(ctx, "SELECT "+strings.Join(cols, ", ")+" FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snap := &realtimeSnapshot{FetchedAt: feedNow(), Columns: cols, Rows: [][]string{}}
+	for rows.Next() {
+		row := make([]string, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		snap.Rows = append(snap.Rows, row)
+	}
+	return snap, rows.Err()
+}
+
+// loadRealtimeSnapshot replaces the contents of a realtime table.
+func loadRealtimeSnapshot(ctx context.Context, db *sqlx.DB, table string, snap *realtimeSnapshot) (err error) {
+	ctx, span := tracer.Start(ctx, "load "+table+" snapshot")
+	defer func() {
+		endSpan(span, err)
+		span.End()
+	}()
+
+	cols := realtimeColumns[table]
+	if !slices.Equal(snap.Columns, cols) {
+		return fmt.Errorf("snapshot of %s has columns %v, want %v", table, snap.Columns, cols)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+		return err
+	}
+
+	q := "INSERT INTO " + table + " (" + strings.Join(cols, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(cols)-1) + ")"
+	stmt, err := tx.Prepare(q)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, len(cols))
+	for _, row := range snap.Rows {
+		if len(row) != len(cols) {
+			return fmt.Errorf("snapshot of %s has a row of %d values, want %d", table, len(row), len(cols))
+		}
+		for i := range args {
+			args[i] = row[i]
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// leaderLease is how long an elected leader stays leader without
+// renewing its lease.  Leaders renew every update cycle, so this is
+// also about how long it takes another instance to take over from one
+// that went away.
+const leaderLease = 3 * realtimeInterval
+
+// renewLeaseScript extends the leader lease in KEYS[1] by ARGV[2]
+// milliseconds if it is still held by ARGV[1].
+var renewLeaseScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// realtimeShare shares realtime data between instances through Redis.
+// One instance polls COTA and puts each table's snapshot there, and
+// the others get it instead of polling COTA themselves.
+//
+// A share can instead follow another cota-bus instance, getting
+// snapshots from its /cota/realtime-snapshot endpoint.
+type realtimeShare struct {
+	redis  *redis.Client
+	prefix string
+
+	// upstream is the base URL of the instance followed.
+	upstream string
+
+	// readOnly instances never poll COTA.
+	readOnly bool
+
+	// With elect set, instances hold an election through Redis and
+	// only the leader polls COTA.  id identifies this instance as
+	// leader.
+	elect  bool
+	id     string
+	leader bool
+
+	// loaded is when the snapshot of each table last loaded was
+	// fetched.
+	loaded map[string]time.Time
+}
+
+func newRealtimeShare(redis *redis.Client, prefix string, readOnly, elect bool) *realtimeShare {
+	return &realtimeShare{
+		redis:    redis,
+		prefix:   prefix,
+		readOnly: readOnly,
+		elect:    elect,
+		id:       newRequestID(),
+		loaded:   map[string]time.Time{},
+	}
+}
+
+// followRealtime returns a share that gets realtime data from the
+// cota-bus instance at upstream.
+func followRealtime(upstream string) *realtimeShare {
+	return &realtimeShare{
+		upstream: strings.TrimSuffix(upstream, "/"),
+		readOnly: true,
+		loaded:   map[string]time.Time{},
+	}
+}
+
+func (s *realtimeShare) String() string {
+	if s.upstream != "" {
+		return s.upstream
+	}
+	return "redis://" + s.redis.Options().Addr
+}
+
+func (s *realtimeShare) key(table string) string {
+	return s.prefix + ":" + table
+}
+
+// polls reports whether this instance should poll COTA this cycle,
+// rather than read what another instance shared.
+func (s *realtimeShare) polls() bool {
+	if s.readOnly {
+		return false
+	}
+	if !s.elect {
+		return true
+	}
+
+	// If Redis can't be reached, no one is sharing realtime data
+	// through it, so poll COTA until it's back.
+	leader, err := s.lead(context.Background())
+	if err != nil {
+		slog.Error("error holding leader election", "redis", s, "err", err)
+		return true
+	}
+	if leader != s.leader {
+		slog.Info("leadership changed", "leader", leader, "id", s.id)
+		s.leader = leader
+	}
+	return leader
+}
+
+// lead renews this instance's leader lease, or takes it if no one
+// holds it, and reports whether this instance is the leader.
+func (s *realtimeShare) lead(ctx context.Context) (bool, error) {
+	key := s.key("leader")
+
+	if s.leader {
+		n, err := renewLeaseScript.Run(ctx, s.redis, []string{key}, s.id, leaderLease.Milliseconds()).Int()
+		if err != nil {
+			return false, err
+		}
+		if n == 1 {
+			return true, nil
+		}
+	}
+
+	return s.redis.SetNX(ctx, key, s.id, leaderLease).Result()
+}
+
+// put shares the current contents of a realtime table.
+func (s *realtimeShare) put(ctx context.Context, db *sqlx.DB, table string) error {
+	snap, err := readRealtimeSnapshot(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	d, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, s.key(table), d, sharedExpiry).Err()
+}
+
+// get loads a realtime table from its shared snapshot, reporting
+// whether there was a newer one than last time.
+func (s *realtimeShare) get(ctx context.Context, db *sqlx.DB, table string) (updated bool, res updateResult, err error) {
+	start := time.Now()
+	d, err := s.fetch(ctx, table)
+	res.Latency = time.Since(start)
+	if err != nil || d == nil {
+		return false, res, err
+	}
+
+	var snap realtimeSnapshot
+	if err := json.Unmarshal(d, &snap); err != nil {
+		return false, res, err
+	}
+	if !snap.FetchedAt.After(s.loaded[table]) {
+		return false, res, nil
+	}
+	if err := loadRealtimeSnapshot(ctx, db, table, &snap); err != nil {
+		return false, res, err
+	}
+	s.loaded[table] = snap.FetchedAt
+
+	res.Entities = len(snap.Rows)
+	return true, res, nil
+}
+
+// fetch returns the encoded snapshot of a table, or nil if there isn't
+// one.
+func (s *realtimeShare) fetch(ctx context.Context, table string) ([]byte, error) {
+	if s.upstream == "" {
+		d, err := s.redis.Get(ctx, s.key(table)).Bytes()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return d, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.upstream+"/cota/realtime-snapshot?table="+url.QueryEscape(table), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		// The upstream hasn't fetched the table yet.
+		return nil, nil
+	}
+	return nil, errors.New(resp.Status)
+}
+
+// shareRealtimeTable puts a freshly updated table in Redis, if realtime
+// data is being shared.
+func shareRealtimeTable(ctx context.Context, db *sqlx.DB, share *realtimeShare, table string) {
+	if share == nil {
+		return
+	}
+	if err := share.put(ctx, db, table); err != nil {
+		slog.Error("error sharing realtime data", "table", table, "redis", share, "err", err)
+	}
+}
+
+// readSharedRealtimeData runs one cycle of loading realtime data from
+// Redis or the instance followed.  It checks more often than COTA is
+// polled, so it isn't far behind the instance that polls it.
+func readSharedRealtimeData(db *sqlx.DB, events *eventBus, health *healthTracker, share *realtimeShare) {
+	ctx, span := tracer.Start(context.Background(), "shared realtime read cycle")
+
+	for _, t := range realtimeUpdaters {
+		updated, res, err := share.get(ctx, db, t.table)
+		if err != nil {
+			health.record(t.name, res, err)
+			slog.Error("error reading shared realtime data", "table", t.table, "source", share, "err", err)
+		} else if updated {
+			health.record(t.name, res, nil)
+			events.publish(t.event)
+		}
+	}
+
+	span.End()
+	feedSleep(realtimeInterval / 4)
+}
+
+// handleRealtimeSnapshot serves the contents of a realtime table, for
+// other instances to follow.  The snapshot's fetched_at is when the
+// table was last updated.
+func handleRealtimeSnapshot(db *sqlx.DB, health *healthTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		table := req.FormValue("table")
+		i := slices.IndexFunc(realtimeUpdaters, func(t realtimeUpdater) bool { return t.table == table })
+		if i < 0 {
+			http.Error(rw, "table must be vehicle_positions or stop_time_updates", http.StatusBadRequest)
+			return
+		}
+
+		updated := health.snapshot()[realtimeUpdaters[i].name].LastSuccess
+		if updated.IsZero() {
+			http.Error(rw, "No realtime data has been fetched yet", http.StatusNotFound)
+			return
+		}
+
+		snap, err := readRealtimeSnapshot(req.Context(), db, table)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snap.FetchedAt = updated
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(snap)
+	}
+}
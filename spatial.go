@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// gridSize is the size in degrees of the cells in a spatialIndex,
+// roughly a kilometer at COTA's latitude.
+const gridSize = 0.01
+
+// maxSearchRadius bounds nearby searches, and maxBBoxSpan each side of
+// a bounding box, so a single request can't walk the whole index.
+const (
+	maxSearchRadius = 5000 // meters
+	maxBBoxSpan     = 1    // degrees
+)
+
+type spatialEntry struct {
+	ID       string
+	Lat, Lon float64
+}
+
+type gridCell struct{ x, y int32 }
+
+func cellFor(lat, lon float64) gridCell {
+	return gridCell{int32(math.Floor(lon / gridSize)), int32(math.Floor(lat / gridSize))}
+}
+
+// spatialIndex buckets points into a fixed grid so area searches only
+// look at the cells they overlap.  It is never modified once built.
+type spatialIndex struct {
+	cells map[gridCell][]spatialEntry
+}
+
+func newSpatialIndex(entries []spatialEntry) *spatialIndex {
+	ix := &spatialIndex{cells: map[gridCell][]spatialEntry{}}
+	for _, e := range entries {
+		c := cellFor(e.Lat, e.Lon)
+		ix.cells[c] = append(ix.cells[c], e)
+	}
+	return ix
+}
+
+// within returns the entries inside a bounding box.
+func (ix *spatialIndex) within(south, west, north, east float64) []spatialEntry {
+	lo, hi := cellFor(south, west), cellFor(north, east)
+
+	var out []spatialEntry
+	for x := lo.x; x <= hi.x; x++ {
+		for y := lo.y; y <= hi.y; y++ {
+			for _, e := range ix.cells[gridCell{x, y}] {
+				if e.Lat >= south && e.Lat <= north && e.Lon >= west && e.Lon <= east {
+					out = append(out, e)
+				}
+			}
+		}
+	}
+	return out
+}
+
+type spatialMatch struct {
+	spatialEntry
+	Meters float64
+}
+
+// near returns the entries within meters of lat, lon, closest first.
+func (ix *spatialIndex) near(lat, lon, meters float64) []spatialMatch {
+	dLat := meters / 111320
+	dLon := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+
+	var out []spatialMatch
+	for _, e := range ix.within(lat-dLat, lon-dLon, lat+dLat, lon+dLon) {
+		if d := distanceMeters(lat, lon, e.Lat, e.Lon); d <= meters {
+			out = append(out, spatialMatch{e, d})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Meters != out[j].Meters {
+			return out[i].Meters < out[j].Meters
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// validLatLon reports whether lat and lon are finite and in range.
+// NaN fails every comparison, so it would otherwise get through the
+// checks on a search's extent.
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// spatialFilter is an area search given in request arguments: either
+// lat, lon, and radius, or bbox=south,west,north,east.
+type spatialFilter struct {
+	near                     bool
+	lat, lon, radius         float64
+	south, west, north, east float64
+}
+
+// parseSpatialFilter returns the area search in req, or nil if it has
+// none.
+func parseSpatialFilter(req *http.Request) (*spatialFilter, error) {
+	if bbox := req.FormValue("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be south,west,north,east")
+		}
+		var v [4]float64
+		for i, p := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, errors.New("bbox must be south,west,north,east")
+			}
+			v[i] = f
+		}
+		if !validLatLon(v[0], v[1]) || !validLatLon(v[2], v[3]) || v[0] > v[2] || v[1] > v[3] {
+			return nil, errors.New("bbox must be south,west,north,east")
+		}
+		if v[2]-v[0] > maxBBoxSpan || v[3]-v[1] > maxBBoxSpan {
+			return nil, errors.New("bbox is too large")
+		}
+		return &spatialFilter{south: v[0], west: v[1], north: v[2], east: v[3]}, nil
+	}
+
+	if req.FormValue("lat") == "" && req.FormValue("lon") == "" {
+		return nil, nil
+	}
+
+	f := &spatialFilter{near: true, radius: 500}
+	var err error
+	if f.lat, err = strconv.ParseFloat(req.FormValue("lat"), 64); err != nil {
+		return nil, errors.New("invalid lat argument")
+	}
+	if f.lon, err = strconv.ParseFloat(req.FormValue("lon"), 64); err != nil {
+		return nil, errors.New("invalid lon argument")
+	}
+	if !validLatLon(f.lat, f.lon) {
+		return nil, errors.New("lat must be between -90 and 90 and lon between -180 and 180")
+	}
+	if r := req.FormValue("radius"); r != "" {
+		if f.radius, err = strconv.ParseFloat(r, 64); err != nil || !(f.radius > 0 && f.radius <= maxSearchRadius) {
+			return nil, errors.New("radius must be between 0 and 5000 meters")
+		}
+	}
+	return f, nil
+}
+
+func (f *spatialFilter) search(ix *spatialIndex) []spatialMatch {
+	if f.near {
+		return ix.near(f.lat, f.lon, f.radius)
+	}
+
+	var out []spatialMatch
+	for _, e := range ix.within(f.south, f.west, f.north, f.east) {
+		out = append(out, spatialMatch{spatialEntry: e})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// searchVehicles returns the vehicles matching an area search, in the
+// order the search returns them, with their distance set for nearby
+// searches.  There are few enough vehicles to index them per request.
+func searchVehicles(vehicles []vehicle, f *spatialFilter) []vehicle {
+	byID := make(map[string]vehicle, len(vehicles))
+	entries := make([]spatialEntry, 0, len(vehicles))
+	for _, v := range vehicles {
+		byID[v.ID] = v
+		entries = append(entries, spatialEntry{ID: v.ID, Lat: float64(v.Latitude), Lon: float64(v.Longitude)})
+	}
+
+	out := []vehicle{}
+	for _, m := range f.search(newSpatialIndex(entries)) {
+		v := byID[m.ID]
+		v.Distance = math.Round(m.Meters)
+		out = append(out, v)
+	}
+	return out
+}
+
+// stopSnapshot is every stop with a spatial index over them, and
+// indexes by stop_code and parent station.  It is never modified once
+// built.
+type stopSnapshot struct {
+	all      []stop // sorted by stop_id
+	byID     map[string]stop
+	byCode   map[string][]string
+	byParent map[string][]string
+	index    *spatialIndex
+}
+
+// stopCache holds the current stopSnapshot.
+type stopCache struct {
+	snap atomic.Pointer[stopSnapshot]
+}
+
+// refresh rereads stops from the database and rebuilds the index.
+func (c *stopCache) refresh(ctx context.Context, db *sqlx.DB) error {
+	stops := []stop{}
+	if err := dbSelect(ctx, db, "stops", &stops, `SELECT stop_id, stop_name, stop_lat, stop_lon, stop_code, parent_station FROM stops ORDER BY stop_id`); err != nil {
+		return err
+	}
+
+	byID := make(map[string]stop, len(stops))
+	byCode := map[string][]string{}
+	byParent := map[string][]string{}
+	entries := make([]spatialEntry, 0, len(stops))
+	for _, s := range stops {
+		byID[s.ID] = s
+		if s.Code != "" {
+			byCode[s.Code] = append(byCode[s.Code], s.ID)
+		}
+		if s.ParentStation != "" {
+			byParent[s.ParentStation] = append(byParent[s.ParentStation], s.ID)
+		}
+
+		lat, err1 := strconv.ParseFloat(s.Latitude, 64)
+		lon, err2 := strconv.ParseFloat(s.Longitude, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries = append(entries, spatialEntry{ID: s.ID, Lat: lat, Lon: lon})
+	}
+	c.snap.Store(&stopSnapshot{all: stops, byID: byID, byCode: byCode, byParent: byParent, index: newSpatialIndex(entries)})
+	return nil
+}
+
+// search returns the stops matching an area search, with their
+// distance set for nearby searches.
+func (c *stopCache) search(f *spatialFilter) []stop {
+	stops := []stop{}
+	snap := c.snap.Load()
+	if snap == nil {
+		return stops
+	}
+	for _, m := range f.search(snap.index) {
+		s := snap.byID[m.ID]
+		s.Distance = math.Round(m.Meters)
+		stops = append(stops, s)
+	}
+	return stops
+}
+
+// all returns every stop, sorted by stop_id.
+func (c *stopCache) all() []stop {
+	snap := c.snap.Load()
+	if snap == nil {
+		return []stop{}
+	}
+	return slices.Clone(snap.all)
+}
+
+// byCode returns the stops with the given stop_code.  Codes are meant
+// to be unique, but nothing in GTFS requires it.
+func (c *stopCache) byCode(code string) []stop {
+	return c.lookup(func(snap *stopSnapshot) []string { return snap.byCode[code] })
+}
+
+// get returns the stop with the given stop_id.
+func (c *stopCache) get(id string) (stop, bool) {
+	snap := c.snap.Load()
+	if snap == nil {
+		return stop{}, false
+	}
+	s, ok := snap.byID[id]
+	return s, ok
+}
+
+// children returns the stops, platforms, and entrances that are part
+// of a station.
+func (c *stopCache) children(station string) []stop {
+	return c.lookup(func(snap *stopSnapshot) []string { return snap.byParent[station] })
+}
+
+func (c *stopCache) lookup(ids func(*stopSnapshot) []string) []stop {
+	stops := []stop{}
+	snap := c.snap.Load()
+	if snap == nil {
+		return stops
+	}
+	for _, id := range ids(snap) {
+		stops = append(stops, snap.byID[id])
+	}
+	return stops
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// statsdClient sends the same request metrics and route gauges served
+// at /metrics to a StatsD server, for deployments that don't scrape
+// Prometheus.  Plain StatsD has no labels, so they are folded into the
+// metric name (cota_bus.http.requests.GET__cota_routes.200); with tags
+// set they are sent as DogStatsD tags instead.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+func newStatsdClient(addr, prefix string, tags bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: tags}, nil
+}
+
+var (
+	statsdNameReplacer = strings.NewReplacer(" ", "_", "/", "_", ".", "_", ":", "_", "|", "_", "@", "_", "{", "_", "}", "_")
+	statsdTagReplacer  = strings.NewReplacer("|", "_", ",", "_", "#", "_")
+)
+
+// send writes one metric, with labels given as name, value pairs.
+// Metrics go over UDP, so a missing server is not an error.
+func (c *statsdClient) send(name, value, typ string, labels ...string) {
+	var b strings.Builder
+	if c.prefix != "" {
+		b.WriteString(c.prefix)
+		b.WriteString(".")
+	}
+	b.WriteString(name)
+	if !c.tags {
+		for i := 1; i < len(labels); i += 2 {
+			b.WriteString(".")
+			b.WriteString(statsdNameReplacer.Replace(labels[i]))
+		}
+	}
+	b.WriteString(":" + value + "|" + typ)
+	if c.tags && len(labels) > 1 {
+		b.WriteString("|#")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(labels[i] + ":" + statsdTagReplacer.Replace(labels[i+1]))
+		}
+	}
+
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		slog.Debug("error sending statsd metric", "name", name, "err", err)
+	}
+}
+
+func (c *statsdClient) count(name string, n int, labels ...string) {
+	c.send(name, strconv.Itoa(n), "c", labels...)
+}
+
+func (c *statsdClient) timing(name string, d time.Duration, labels ...string) {
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", labels...)
+}
+
+func (c *statsdClient) gauge(name string, v float64, labels ...string) {
+	// A signed value changes a StatsD gauge rather than setting it,
+	// so a negative one has to be set from zero.
+	if v < 0 && !c.tags {
+		c.send(name, "0", "g", labels...)
+	}
+	c.send(name, strconv.FormatFloat(v, 'f', -1, 64), "g", labels...)
+}
+
+// run sends the route gauges whenever the realtime data changes.
+func (c *statsdClient) run(events *eventBus, db *sqlx.DB, shapes *shapeCache) {
+	ch := events.subscribe(vehiclesUpdated, predictionsUpdated)
+	defer events.unsubscribe(ch)
+
+	// StatsD servers keep reporting a gauge's last value, so routes
+	// that drop out of service are sent zeros.
+	last := map[string]bool{}
+	for range ch {
+		gauges, err := routeGauges(context.Background(), db, shapes)
+		if err != nil {
+			slog.Error("error computing route gauges", "err", err)
+			continue
+		}
+		current := map[string]bool{}
+		for _, g := range gauges {
+			current[g.RouteID] = true
+		}
+		for route := range last {
+			if !current[route] {
+				gauges = append(gauges, &routeGauge{RouteID: route})
+			}
+		}
+		last = current
+
+		for _, g := range gauges {
+			c.gauge("route.active_vehicles", float64(g.Vehicles), "route", g.RouteID)
+			if g.Delayed > 0 {
+				c.gauge("route.average_delay_seconds", float64(g.DelaySeconds)/float64(g.Delayed), "route", g.RouteID)
+			}
+			c.gauge("route.predictions", float64(g.Predictions), "route", g.RouteID)
+			c.gauge("route.bunching_incidents", float64(g.Bunched), "route", g.RouteID)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// updateResult describes one run of an updater.  For the realtime
+// updaters Latency is how long fetching the slowest feed took; for
+// static loads it is how long the whole load took.
+type updateResult struct {
+	Entities int
+	Latency  time.Duration
+
+	// FeedTime is the timestamp in a realtime feed's header, the oldest
+	// if there are several feeds.  It is zero if the feeds don't set
+	// one.
+	FeedTime time.Time
+}
+
+type updaterHealth struct {
+	LastAttempt   time.Time `json:"last_attempt"`
+	LastSuccess   time.Time `json:"last_success,omitzero"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitzero"`
+	LatencyMS     int64     `json:"latency_ms"`
+	Entities      int       `json:"entities"`
+	Failures      int       `json:"consecutive_failures"`
+	FeedTimestamp time.Time `json:"feed_timestamp,omitzero"`
+}
+
+// healthTracker records the outcome of each updater run so operators
+// can see feed health at /admin/status.
+type healthTracker struct {
+	started time.Time
+
+	mu       sync.Mutex
+	updaters map[string]*updaterHealth
+
+	// lastCycle is when the realtime update loop last began a cycle.
+	lastCycle time.Time
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		started:  time.Now(),
+		updaters: map[string]*updaterHealth{},
+	}
+}
+
+func (h *healthTracker) record(name string, res updateResult, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u := h.updaters[name]
+	if u == nil {
+		u = &updaterHealth{}
+		h.updaters[name] = u
+	}
+
+	now := time.Now()
+	u.LastAttempt = now
+	u.LatencyMS = res.Latency.Milliseconds()
+	if err != nil {
+		u.LastError = err.Error()
+		u.LastErrorTime = now
+		u.Failures++
+		return
+	}
+
+	u.LastSuccess = now
+	u.Entities = res.Entities
+	u.Failures = 0
+	if !res.FeedTime.IsZero() {
+		u.FeedTimestamp = res.FeedTime
+	}
+}
+
+// staleFeedAge is how old a realtime feed's timestamp can get before
+// its data is reported as stale.
+const staleFeedAge = 3 * realtimeInterval
+
+// predictionCutoff returns the time before which trip updates have
+// passed: the trip updates feed's own timestamp rather than now, so
+// predictions age with the feed they came from.  It also reports
+// whether that feed is stale.  Without a feed timestamp, as when
+// reading shared data, it is now.
+func (h *healthTracker) predictionCutoff(now time.Time) (time.Time, bool) {
+	h.mu.Lock()
+	var ts time.Time
+	if u := h.updaters["trip_updates"]; u != nil {
+		ts = u.FeedTimestamp
+	}
+	h.mu.Unlock()
+
+	if ts.IsZero() || ts.After(now) {
+		return now, false
+	}
+	return ts, now.Sub(ts) > staleFeedAge
+}
+
+// setRealtimeHeaders tells clients how fresh the realtime data behind
+// a response is: when the named updater last succeeded, and the
+// timestamp of the feed it last read, so they can warn when data is
+// stale.
+func (h *healthTracker) setRealtimeHeaders(rw http.ResponseWriter, name string) {
+	h.mu.Lock()
+	u := h.updaters[name]
+	var updated, feedTime time.Time
+	if u != nil {
+		updated, feedTime = u.LastSuccess, u.FeedTimestamp
+	}
+	h.mu.Unlock()
+
+	if !updated.IsZero() {
+		rw.Header().Set("X-Realtime-Updated", updated.UTC().Format(time.RFC3339))
+	}
+	if !feedTime.IsZero() {
+		rw.Header().Set("X-Realtime-Feed-Timestamp", feedTime.UTC().Format(time.RFC3339))
+	}
+}
+
+// cycle records the start of a realtime update cycle.
+func (h *healthTracker) cycle() {
+	h.mu.Lock()
+	h.lastCycle = time.Now()
+	h.mu.Unlock()
+}
+
+// cycling reports whether a realtime update cycle has begun within d,
+// or the server started within d.
+func (h *healthTracker) cycling(d time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	last := h.lastCycle
+	if last.IsZero() {
+		last = h.started
+	}
+	return time.Since(last) < d
+}
+
+// snapshot returns a copy of the current health of every updater.
+func (h *healthTracker) snapshot() map[string]updaterHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]updaterHealth, len(h.updaters))
+	for name, u := range h.updaters {
+		out[name] = *u
+	}
+	return out
+}
+
+// statusTables are counted for the entity counts in /admin/status.
+var statusTables = []string{
+	"agency",
+	"routes",
+	"stops",
+	"trips",
+	"stop_times",
+	"shapes",
+	"transfers",
+	"fare_attributes",
+	"fare_rules",
+	"vehicle_positions",
+	"stop_time_updates",
+}
+
+func handleStatus(db *sqlx.DB, health *healthTracker, feed *feedInfoCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		counts := map[string]int{}
+		for _, t := range statusTables {
+			var n int
+			if err := db.GetContext(req.Context(), &n, `SELECT COUNT(*) FROM `+t); err == nil {
+				counts[t] = n
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(map[string]interface{}{
+			"started":  health.started,
+			"uptime":   time.Since(health.started).Round(time.Second).String(),
+			"updaters": health.snapshot(),
+			"counts":   counts,
+			"feed":     feed.get(),
+			"build":    currentBuild(),
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Rough per-value sizes for estimating the memory the caches hold.
+// They ignore allocator rounding and map load factors, so estimates are
+// good for spotting growth and comparing caches, not for exact sizing.
+const (
+	stringHeaderBytes = 16
+	sliceHeaderBytes  = 24
+	mapEntryBytes     = 48
+)
+
+func stringBytes(s string) int64 { return stringHeaderBytes + int64(len(s)) }
+
+// storeTable describes one database table.
+type storeTable struct {
+	Rows    int      `json:"rows"`
+	Indexes []string `json:"indexes"`
+}
+
+// storeCache describes one of the in-memory caches.  IndexEntries
+// counts the entries of any secondary indexes over Entries.
+type storeCache struct {
+	Entries      int   `json:"entries"`
+	IndexEntries int   `json:"index_entries"`
+	ApproxBytes  int64 `json:"approx_bytes"`
+}
+
+func (c *shapeCache) storeStats() storeCache {
+	var out storeCache
+	snap := c.snapshot()
+	for _, shapes := range snap.byTolerance {
+		for id, s := range shapes {
+			out.Entries++
+			out.ApproxBytes += mapEntryBytes + 2*stringBytes(id) + stringBytes(s.Polyline) + sliceHeaderBytes + int64(len(s.Points))*24
+		}
+	}
+	for route, ids := range snap.routeShapes {
+		out.IndexEntries += len(ids)
+		out.ApproxBytes += mapEntryBytes + stringBytes(route) + sliceHeaderBytes + int64(len(ids))*stringHeaderBytes
+	}
+	return out
+}
+
+func (c *stopCache) storeStats() storeCache {
+	var out storeCache
+	snap := c.snap.Load()
+	if snap == nil {
+		return out
+	}
+	for id, s := range snap.byID {
+		out.Entries++
+		out.ApproxBytes += mapEntryBytes + stringBytes(id) + stringBytes(s.ID) + stringBytes(s.Name) +
+			stringBytes(s.Latitude) + stringBytes(s.Longitude) + stringBytes(s.Code) + stringBytes(s.ParentStation)
+	}
+	for _, idx := range []map[string][]string{snap.byCode, snap.byParent} {
+		for key, ids := range idx {
+			out.IndexEntries += len(ids)
+			out.ApproxBytes += mapEntryBytes + stringBytes(key) + sliceHeaderBytes + int64(len(ids))*stringHeaderBytes
+		}
+	}
+	for _, entries := range snap.index.cells {
+		out.IndexEntries += len(entries)
+		out.ApproxBytes += mapEntryBytes + sliceHeaderBytes + int64(len(entries))*(stringHeaderBytes+16)
+	}
+	return out
+}
+
+func (c *searchCache) storeStats() storeCache {
+	var out storeCache
+	ix := c.index.Load()
+	if ix == nil {
+		return out
+	}
+	for _, r := range ix.results {
+		out.Entries++
+		out.ApproxBytes += stringBytes(r.Type) + stringBytes(r.ID) + stringBytes(r.Name) + stringBytes(r.ShortName)
+	}
+	for w, postings := range ix.postings {
+		out.IndexEntries += len(postings)
+		out.ApproxBytes += mapEntryBytes + 2*stringBytes(w) + sliceHeaderBytes + int64(len(postings))*8
+	}
+	return out
+}
+
+func (c *patternCache) storeStats() storeCache {
+	var out storeCache
+	for _, p := range c.get("") {
+		out.Entries++
+		out.IndexEntries += len(p.StopIDs)
+		out.ApproxBytes += stringBytes(p.ID) + stringBytes(p.RouteID) + stringBytes(p.RouteShortName) + stringBytes(p.DirectionID) +
+			stringBytes(p.Headsign) + stringBytes(p.TripID) + stringBytes(p.ShapeID) + sliceHeaderBytes + 8
+		for _, id := range p.StopIDs {
+			out.ApproxBytes += stringBytes(id)
+		}
+	}
+	return out
+}
+
+func (c *translationCache) storeStats() storeCache {
+	var out storeCache
+	for lang, m := range c.set() {
+		out.ApproxBytes += mapEntryBytes + stringBytes(lang)
+		for k, v := range m {
+			out.Entries++
+			out.ApproxBytes += mapEntryBytes + stringBytes(k.table) + stringBytes(k.field) + stringBytes(k.id) + stringBytes(k.value) + stringBytes(v)
+		}
+	}
+	return out
+}
+
+// storeStats counts the predictions waiting to be scored, which is what
+// grows if arrivals stop being observed.
+func (t *accuracyTracker) storeStats() storeCache {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return storeCache{
+		Entries:     len(t.pending),
+		ApproxBytes: int64(len(t.pending))*(mapEntryBytes+128) + int64(len(t.routes))*(mapEntryBytes+256),
+	}
+}
+
+func (o *otpTracker) storeStats() storeCache {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return storeCache{
+		Entries:     len(o.bins),
+		ApproxBytes: int64(len(o.bins)) * (mapEntryBytes + 96),
+	}
+}
+
+// handleStore reports what the server holds: rows and indexes in each
+// database table, the size of the database, the size of each in-memory
+// cache, and the Go heap, so growth can be spotted without a heap
+// profile.
+func handleStore(db *sqlx.DB, loader *gtfsLoader, accuracy *accuracyTracker, otp *otpTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		var tables []string
+		if err := db.SelectContext(ctx, &tables, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`); err != nil {
+			writeError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var indexes []struct {
+			Name  string `db:"name"`
+			Table string `db:"tbl_name"`
+		}
+		if err := db.SelectContext(ctx, &indexes, `SELECT name, tbl_name FROM sqlite_master WHERE type = 'index' ORDER BY name`); err != nil {
+			writeError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		byTable := map[string]*storeTable{}
+		for _, t := range tables {
+			st := &storeTable{Indexes: []string{}}
+			if err := db.GetContext(ctx, &st.Rows, `SELECT COUNT(*) FROM "`+t+`"`); err != nil {
+				writeError(rw, http.StatusInternalServerError, err.Error())
+				return
+			}
+			byTable[t] = st
+		}
+		for _, ix := range indexes {
+			if st := byTable[ix.Table]; st != nil {
+				st.Indexes = append(st.Indexes, ix.Name)
+			}
+		}
+
+		var pageCount, pageSize, freePages int64
+		db.GetContext(ctx, &pageCount, `PRAGMA page_count`)
+		db.GetContext(ctx, &pageSize, `PRAGMA page_size`)
+		db.GetContext(ctx, &freePages, `PRAGMA freelist_count`)
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(map[string]interface{}{
+			"database": map[string]interface{}{
+				"bytes":      pageCount * pageSize,
+				"free_bytes": freePages * pageSize,
+				"tables":     byTable,
+			},
+			"caches": map[string]storeCache{
+				"shapes":       loader.shapes.storeStats(),
+				"stops":        loader.stops.storeStats(),
+				"search":       loader.search.storeStats(),
+				"patterns":     loader.patterns.storeStats(),
+				"translations": loader.trans.storeStats(),
+				"accuracy":     accuracy.storeStats(),
+				"otp":          otp.storeStats(),
+			},
+			"heap": map[string]interface{}{
+				"alloc_bytes": mem.HeapAlloc,
+				"inuse_bytes": mem.HeapInuse,
+				"sys_bytes":   mem.Sys,
+				"objects":     mem.HeapObjects,
+				"gc_cycles":   mem.NumGC,
+				"goroutines":  runtime.NumGoroutine(),
+			},
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type streamMessage struct {
+	topic   string
+	payload []byte
+}
+
+// streamSink is a message broker that realtime data is published to.
+type streamSink interface {
+	// topic joins the parts of a topic name the way the broker
+	// expects.
+	topic(parts ...string) string
+
+	publish(msgs []streamMessage) error
+
+	// ping keeps the connection to the broker alive when there is
+	// nothing to publish.
+	ping() error
+
+	String() string
+}
+
+// streamPublisher publishes realtime data to a broker after every
+// update, under these topics (as named for MQTT):
+//
+//	<prefix>/vehicles/<route_id>      vehicles on the route
+//	<prefix>/predictions/<stop_id>    next realtime arrival of each route
+//
+// A topic with nothing left in it gets an empty array, so subscribers
+// know the last message is stale.
+type streamPublisher struct {
+	db     *sqlx.DB
+	shapes *shapeCache
+	prefix string
+	sink   streamSink
+
+	// last is the topics published by the previous update of each
+	// kind.
+	last map[event]map[string]bool
+}
+
+func newStreamPublisher(db *sqlx.DB, shapes *shapeCache, prefix string, sink streamSink) *streamPublisher {
+	return &streamPublisher{
+		db:     db,
+		shapes: shapes,
+		prefix: prefix,
+		sink:   sink,
+		last:   map[event]map[string]bool{},
+	}
+}
+
+func (p *streamPublisher) run(events *eventBus) {
+	ch := events.subscribe(vehiclesUpdated, predictionsUpdated)
+	defer events.unsubscribe(ch)
+
+	for e := range ch {
+		ctx := context.Background()
+
+		var byTopic map[string]interface{}
+		var err error
+		switch e {
+		case vehiclesUpdated:
+			byTopic, err = p.vehicles(ctx)
+		case predictionsUpdated:
+			byTopic, err = p.predictions(ctx)
+		}
+		if err != nil {
+			slog.Error("error reading realtime data to publish", "event", e, "err", err)
+			continue
+		}
+
+		var msgs []streamMessage
+		for topic, v := range byTopic {
+			d, err := json.Marshal(v)
+			if err != nil {
+				slog.Error("error encoding realtime message", "topic", topic, "err", err)
+				continue
+			}
+			msgs = append(msgs, streamMessage{topic, d})
+		}
+		for topic := range p.last[e] {
+			if _, ok := byTopic[topic]; !ok {
+				msgs = append(msgs, streamMessage{topic, []byte("[]")})
+			}
+		}
+
+		if len(msgs) == 0 {
+			err = p.sink.ping()
+		} else {
+			err = p.sink.publish(msgs)
+		}
+		if err != nil {
+			slog.Warn("error publishing realtime data", "broker", p.sink, "err", err)
+			continue
+		}
+
+		topics := make(map[string]bool, len(byTopic))
+		for topic := range byTopic {
+			topics[topic] = true
+		}
+		p.last[e] = topics
+	}
+}
+
+func (p *streamPublisher) vehicles(ctx context.Context) (map[string]interface{}, error) {
+	vehicles, err := selectVehicles(ctx, p.db, p.shapes, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byRoute := map[string][]vehicle{}
+	for _, v := range vehicles {
+		byRoute[v.RouteID] = append(byRoute[v.RouteID], v)
+	}
+	out := make(map[string]interface{}, len(byRoute))
+	for route, vs := range byRoute {
+		out[p.sink.topic(p.prefix, "vehicles", route)] = vs
+	}
+	return out, nil
+}
+
+func (p *streamPublisher) predictions(ctx context.Context) (map[string]interface{}, error) {
+	predictions := []prediction{}
+	const q = `SELECT stu.stop_id, trips.trip_headsign, trips.route_id, min(stu.arrival_time)-? as arrival_time,
+		          COALESCE(st.arrival_time, '') AS scheduled_arrival
+		   FROM stop_time_updates AS stu
+		   INNER JOIN trips ON stu.trip_id = trips.trip_id
+		   LEFT JOIN stop_times AS st ON stu.trip_id = st.trip_id AND stu.stop_id = st.stop_id
+		   WHERE stu.arrival_time >= ?
+		   GROUP BY stu.stop_id, trips.route_id`
+	now := feedNow()
+	if err := dbSelect(ctx, p.db, "published predictions", &predictions, q, now.Unix(), now.Unix()); err != nil {
+		return nil, err
+	}
+
+	loc := agencyLocation(ctx, p.db)
+	byStop := map[string][]prediction{}
+	for _, pr := range predictions {
+		arrival := now.Add(time.Duration(pr.ArrivalTime) * time.Second)
+		pr.Delay = scheduleDelay(arrival, pr.ScheduledArrival, loc)
+		byStop[pr.StopID] = append(byStop[pr.StopID], pr)
+	}
+	out := make(map[string]interface{}, len(byStop))
+	for stop, ps := range byStop {
+		out[p.sink.topic(p.prefix, "predictions", stop)] = ps
+	}
+	return out, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// systemd passes activated sockets starting at this fd.
+const sdListenFDsStart = 3
+
+var (
+	sdListenersOnce sync.Once
+	sdListeners     []*os.File
+)
+
+// nextSystemdListener returns the next socket passed by systemd socket
+// activation, in the order of the unit's ListenStream lines, or nil if
+// there are no more.
+func nextSystemdListener() *os.File {
+	sdListenersOnce.Do(func() {
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+		// The variables are meant for this process only, not an
+		// upgraded one.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		if pid != os.Getpid() {
+			return
+		}
+		for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+			sdListeners = append(sdListeners, os.NewFile(uintptr(fd), "systemd socket "+strconv.Itoa(fd)))
+		}
+	})
+
+	if len(sdListeners) == 0 {
+		return nil
+	}
+	f := sdListeners[0]
+	sdListeners = sdListeners[1:]
+	return f
+}
+
+// sdNotify sends a state change to systemd, if it is supervising the
+// server with Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("error notifying systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// sdWatchdog pets the systemd watchdog, if WatchdogSec is set, for as
+// long as the realtime updaters keep running.  It is the update loop
+// running that matters, not whether COTA's feeds are up: restarting
+// the server won't fix a feed outage, but it will fix a stuck loop.
+// With no health tracker, as when there are no realtime updaters, it
+// pets the watchdog unconditionally.
+func sdWatchdog(health *healthTracker) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	t := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer t.Stop()
+	for range t.C {
+		if health != nil && !health.cycling(3*realtimeInterval) {
+			slog.Warn("realtime updates have stalled, not notifying systemd watchdog")
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsOptions selects how, if at all, the server terminates TLS itself.
+// A certificate/key pair and autocert domains are mutually exclusive.
+type tlsOptions struct {
+	CertFile string
+	KeyFile  string
+
+	AutocertDomains []string
+	AutocertCache   string
+	AutocertEmail   string
+	AutocertHTTP    string
+}
+
+func (o tlsOptions) enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || len(o.AutocertDomains) > 0
+}
+
+// serve runs srv on ln with plain HTTP, a static certificate, or
+// certificates obtained from Let's Encrypt, depending on o.
+func (o tlsOptions) serve(srv *http.Server, ln net.Listener) error {
+	switch {
+	case len(o.AutocertDomains) > 0:
+		if o.CertFile != "" || o.KeyFile != "" {
+			return errors.New("-tls-cert/-tls-key cannot be combined with -autocert-domains")
+		}
+
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.AutocertDomains...),
+			Cache:      autocert.DirCache(o.AutocertCache),
+			Email:      o.AutocertEmail,
+		}
+
+		// The TLS-ALPN challenge is answered on the main listener, but
+		// that only works if it is reachable on port 443.  Optionally
+		// answer HTTP-01 challenges (and redirect everything else to
+		// HTTPS) on a plain HTTP port as well.
+		if o.AutocertHTTP != "" {
+			httpLn, err := listen(o.AutocertHTTP)
+			if err != nil {
+				return err
+			}
+			go func() {
+				err := http.Serve(httpLn, m.HTTPHandler(nil))
+				slog.Error("autocert HTTP listener exited", "err", err)
+			}()
+		}
+
+		srv.TLSConfig = m.TLSConfig()
+		return srv.ServeTLS(ln, "", "")
+
+	case o.CertFile != "" || o.KeyFile != "":
+		if o.CertFile == "" || o.KeyFile == "" {
+			return errors.New("-tls-cert and -tls-key must be given together")
+		}
+
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		return srv.ServeTLS(ln, o.CertFile, o.KeyFile)
+
+	default:
+		return srv.Serve(ln)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestTraceRedactsQuery checks that API keys passed in the query don't
+// end up in exported spans.
+func TestTraceRedactsQuery(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	h := traceHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cota/stops?api_key=secret", nil))
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	for _, a := range spans[0].Attributes {
+		if strings.Contains(a.Value.Emit(), "secret") {
+			t.Errorf("span attribute %s = %s has the API key", a.Key, a.Value.Emit())
+		}
+		if a.Key == "url.query" && a.Value.AsString() != "api_key=xxxxx" {
+			t.Errorf("url.query = %s, want api_key=xxxxx", a.Value.AsString())
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type translationKey struct {
+	table string
+	field string
+
+	// Exactly one of id and value is set: translations.txt matches
+	// either by record_id or by the untranslated field_value.
+	id    string
+	value string
+}
+
+// translationSet maps each language to its translations.
+type translationSet map[string]map[translationKey]string
+
+// translationCache holds translations.txt in memory, keyed by
+// language, so names can be localized without a query per row.  The
+// set is replaced wholesale on refresh and never modified, so reads
+// don't need a lock.
+type translationCache struct {
+	byLang atomic.Pointer[translationSet]
+}
+
+// refresh rereads translations from the database.
+func (c *translationCache) refresh(ctx context.Context, db *sqlx.DB) error {
+	var rows []struct {
+		Table       string `db:"table_name"`
+		Field       string `db:"field_name"`
+		Language    string `db:"language"`
+		Translation string `db:"translation"`
+		RecordID    string `db:"record_id"`
+		FieldValue  string `db:"field_value"`
+	}
+	const q = `SELECT table_name, field_name, language, translation, record_id, field_value FROM translations`
+	err := dbSelect(ctx, db, "translations", &rows, q)
+
+	byLang := translationSet{}
+	for _, r := range rows {
+		lang := strings.ToLower(r.Language)
+		m := byLang[lang]
+		if m == nil {
+			m = map[translationKey]string{}
+			byLang[lang] = m
+		}
+
+		k := translationKey{table: r.Table, field: r.Field}
+		if r.RecordID != "" {
+			k.id = r.RecordID
+		} else {
+			k.value = r.FieldValue
+		}
+		m[k] = r.Translation
+	}
+
+	c.byLang.Store(&byLang)
+	return err
+}
+
+// set returns the current translations.  It must not be modified.
+func (c *translationCache) set() translationSet {
+	if p := c.byLang.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// language picks the language to answer req in: the lang argument if
+// there is one, otherwise the most preferred language in
+// Accept-Language that we have translations for.  It returns the empty
+// string if names should be left in the feed's own language.
+func (c *translationCache) language(req *http.Request) string {
+	byLang := c.set()
+
+	var prefs []string
+	if lang := req.FormValue("lang"); lang != "" {
+		prefs = []string{lang}
+	} else {
+		prefs = parseAcceptLanguage(req.Header.Get("Accept-Language"))
+	}
+
+	for _, p := range prefs {
+		p = strings.ToLower(p)
+		if _, ok := byLang[p]; ok {
+			return p
+		}
+		// Fall back from a regional variant to the base language, so
+		// es-MX is answered in es.
+		if i := strings.IndexByte(p, '-'); i > 0 {
+			if _, ok := byLang[p[:i]]; ok {
+				return p[:i]
+			}
+		}
+	}
+	return ""
+}
+
+// translate returns the translation of a field of a record, or value
+// unchanged if there isn't one.
+func (c *translationCache) translate(lang, table, field, id, value string) string {
+	m := c.set()[lang]
+	if t, ok := m[translationKey{table: table, field: field, id: id}]; ok {
+		return t
+	}
+	if t, ok := m[translationKey{table: table, field: field, value: value}]; ok {
+		return t
+	}
+	return value
+}
+
+// parseAcceptLanguage returns the languages in an Accept-Language
+// header, most preferred first.
+func parseAcceptLanguage(header string) []string {
+	type pref struct {
+		lang string
+		q    float64
+	}
+
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if lang == "" || lang == "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q <= 0 {
+			continue
+		}
+		prefs = append(prefs, pref{lang, q})
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	langs := make([]string, len(prefs))
+	for i, p := range prefs {
+		langs[i] = p.lang
+	}
+	return langs
+}
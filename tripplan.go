@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// planWindow is how long after the requested time a trip plan may
+	// start.
+	planWindow = 2 * time.Hour
+
+	// planMaxDuration is how long a trip plan may take, which bounds
+	// how late its second leg may depart.
+	planMaxDuration = 3 * time.Hour
+
+	// planMinTransfer is the time allowed to change buses at the same
+	// stop when transfers.txt doesn't say otherwise.
+	planMinTransfer = 2 * time.Minute
+
+	// maxTripPlans is how many itineraries /cota/trip-plans returns.
+	maxTripPlans = 5
+)
+
+type planLeg struct {
+	TripID         string    `json:"trip_id"`
+	RouteID        string    `json:"route_id"`
+	RouteShortName string    `json:"route_short_name"`
+	TripHeadsign   string    `json:"trip_headsign"`
+	FromStopID     string    `json:"from_stop_id"`
+	ToStopID       string    `json:"to_stop_id"`
+	Departure      time.Time `json:"departure"`
+	Arrival        time.Time `json:"arrival"`
+}
+
+type tripPlan struct {
+	Departure time.Time `json:"departure"`
+	Arrival   time.Time `json:"arrival"`
+
+	// Duration is in seconds.
+	Duration int       `json:"duration"`
+	Legs     []planLeg `json:"legs"`
+}
+
+// planHop is a ride on one trip between two stops, as selected from
+// stop_times.
+type planHop struct {
+	TripID         string   `db:"trip_id"`
+	RouteID        string   `db:"route_id"`
+	RouteShortName string   `db:"route_short_name"`
+	TripHeadsign   string   `db:"trip_headsign"`
+	FromStopID     string   `db:"from_stop_id"`
+	ToStopID       string   `db:"to_stop_id"`
+	Departure      gtfsTime `db:"departure_time"`
+	Arrival        gtfsTime `db:"arrival_time"`
+}
+
+func (h planHop) leg(day time.Time) planLeg {
+	return planLeg{
+		TripID:         h.TripID,
+		RouteID:        h.RouteID,
+		RouteShortName: h.RouteShortName,
+		TripHeadsign:   h.TripHeadsign,
+		FromStopID:     h.FromStopID,
+		ToStopID:       h.ToStopID,
+		Departure:      h.Departure.On(day),
+		Arrival:        h.Arrival.On(day),
+	}
+}
+
+// selectHops returns rides on trips running on services that stop at
+// from and later at to, departing from between earliest and latest.
+// Either stop may be empty to match any stop.
+func selectHops(ctx context.Context, db *sqlx.DB, services []string, from, to string, earliest, latest gtfsTime) ([]planHop, error) {
+	q := `SELECT a.trip_id, trips.route_id, routes.route_short_name, trips.trip_headsign,
+	             a.stop_id AS from_stop_id, b.stop_id AS to_stop_id, a.departure_time, b.arrival_time
+	      FROM stop_times AS a
+	      INNER JOIN stop_times AS b ON a.trip_id = b.trip_id
+	        AND CAST(a.stop_sequence AS INTEGER) < CAST(b.stop_sequence AS INTEGER)
+	      INNER JOIN trips ON a.trip_id = trips.trip_id
+	      INNER JOIN routes ON trips.route_id = routes.route_id
+	      WHERE trips.service_id IN (?)
+	        AND a.departure_time != '' AND b.arrival_time != ''
+	        AND ` + gtfsSeconds("a.departure_time") + ` BETWEEN ? AND ?`
+	args := []interface{}{services, int(earliest), int(latest)}
+	if from != "" {
+		q += ` AND a.stop_id = ?`
+		args = append(args, from)
+	}
+	if to != "" {
+		q += ` AND b.stop_id = ?`
+		args = append(args, to)
+	}
+
+	q, args, err := sqlx.In(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	hops := []planHop{}
+	err = dbSelect(ctx, db, "trip plan hops", &hops, db.Rebind(q), args...)
+	return hops, err
+}
+
+// transferTimes returns, for each stop, the stops a rider can change
+// to and how long it takes.  Every stop allows changing at the stop
+// itself, which transfers.txt may override.
+func transferTimes(ctx context.Context, db *sqlx.DB) map[string]map[string]time.Duration {
+	out := map[string]map[string]time.Duration{}
+
+	transfers := []transfer{}
+	const q = `SELECT from_stop_id, to_stop_id, transfer_type, min_transfer_time FROM transfers`
+	if err := dbSelect(ctx, db, "transfers", &transfers, q); err != nil {
+		slog.Debug("no transfers for trip planning", "err", err)
+		return out
+	}
+
+	for _, t := range transfers {
+		m := out[t.FromStopID]
+		if m == nil {
+			m = map[string]time.Duration{}
+			out[t.FromStopID] = m
+		}
+		switch t.TransferType {
+		case "3":
+			// Transfers aren't possible.
+			m[t.ToStopID] = -1
+		case "2":
+			secs, _ := strconv.Atoi(t.MinTransferTime)
+			m[t.ToStopID] = time.Duration(secs) * time.Second
+		default:
+			m[t.ToStopID] = planMinTransfer
+		}
+	}
+	return out
+}
+
+// planTrips finds itineraries from one stop to another leaving after
+// at: direct trips, and trips with one transfer.  The soonest to
+// arrive come first.
+func planTrips(ctx context.Context, db *sqlx.DB, from, to string, at time.Time) ([]tripPlan, error) {
+	at = at.In(agencyLocation(ctx, db))
+	transfers := transferTimes(ctx, db)
+
+	plans := []tripPlan{}
+	for _, date := range serviceDays(at) {
+		p, err := planTripsOn(ctx, db, from, to, at, date, transfers)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, p...)
+	}
+
+	// Soonest arrival first, and of plans arriving at the same time,
+	// keep the one with the fewest legs that leaves latest.
+	sort.Slice(plans, func(i, j int) bool {
+		if !plans[i].Arrival.Equal(plans[j].Arrival) {
+			return plans[i].Arrival.Before(plans[j].Arrival)
+		}
+		if len(plans[i].Legs) != len(plans[j].Legs) {
+			return len(plans[i].Legs) < len(plans[j].Legs)
+		}
+		return plans[i].Departure.After(plans[j].Departure)
+	})
+	arrivals := map[int64]bool{}
+	plans = slices.DeleteFunc(plans, func(p tripPlan) bool {
+		if arrivals[p.Arrival.Unix()] {
+			return true
+		}
+		arrivals[p.Arrival.Unix()] = true
+		return false
+	})
+	if len(plans) > maxTripPlans {
+		plans = plans[:maxTripPlans]
+	}
+	return plans, nil
+}
+
+// planTripsOn finds itineraries leaving after at on trips of the
+// service day of date.
+func planTripsOn(ctx context.Context, db *sqlx.DB, from, to string, at, date time.Time, transfers map[string]map[string]time.Duration) ([]tripPlan, error) {
+	services, err := activeServiceIDs(ctx, db, date)
+	if err != nil {
+		return nil, err
+	}
+	var plans []tripPlan
+	if len(services) == 0 {
+		return plans, nil
+	}
+
+	day := serviceDayStart(date)
+	start := gtfsTime(at.Sub(day) / time.Second)
+	firstLatest := start + gtfsTime(planWindow/time.Second)
+	secondLatest := start + gtfsTime(planMaxDuration/time.Second)
+
+	add := func(hops ...planHop) {
+		p := tripPlan{}
+		for _, h := range hops {
+			p.Legs = append(p.Legs, h.leg(day))
+		}
+		p.Departure = p.Legs[0].Departure
+		p.Arrival = p.Legs[len(p.Legs)-1].Arrival
+		p.Duration = int(p.Arrival.Sub(p.Departure) / time.Second)
+		plans = append(plans, p)
+	}
+
+	direct, err := selectHops(ctx, db, services, from, to, start, firstLatest)
+	if err != nil {
+		return nil, err
+	}
+	directRoutes := map[string]bool{}
+	for _, h := range direct {
+		add(h)
+		directRoutes[h.RouteID] = true
+	}
+
+	first, err := selectHops(ctx, db, services, from, "", start, firstLatest)
+	if err != nil {
+		return nil, err
+	}
+	second, err := selectHops(ctx, db, services, "", to, start, secondLatest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index second legs by where they board, earliest departure first.
+	boarding := map[string][]planHop{}
+	for _, h := range second {
+		boarding[h.FromStopID] = append(boarding[h.FromStopID], h)
+	}
+	for _, hops := range boarding {
+		sort.Slice(hops, func(i, j int) bool { return hops[i].Departure < hops[j].Departure })
+	}
+
+	// For each first leg, take the second leg that arrives soonest.
+	// Legs on a route that goes direct aren't worth a transfer.
+	for _, h1 := range first {
+		if h1.ToStopID == to || directRoutes[h1.RouteID] {
+			continue
+		}
+
+		changes := map[string]time.Duration{h1.ToStopID: planMinTransfer}
+		for stop, d := range transfers[h1.ToStopID] {
+			changes[stop] = d
+		}
+
+		var best *planHop
+		for stop, d := range changes {
+			if d < 0 {
+				continue
+			}
+			ready := h1.Arrival + gtfsTime(d/time.Second)
+			for i, h2 := range boarding[stop] {
+				if h2.Departure < ready || h2.TripID == h1.TripID || h2.RouteID == h1.RouteID {
+					continue
+				}
+				if best == nil || h2.Arrival < best.Arrival {
+					best = &boarding[stop][i]
+				}
+			}
+		}
+		if best != nil {
+			add(h1, *best)
+		}
+	}
+	return plans, nil
+}
+
+func handleTripPlans(db *sqlx.DB) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		from, to := req.FormValue("from"), req.FormValue("to")
+		if from == "" || to == "" {
+			http.Error(rw, "Missing from or to argument", http.StatusBadRequest)
+			return
+		}
+		if from == to {
+			http.Error(rw, "from and to must be different stops", http.StatusBadRequest)
+			return
+		}
+
+		at := feedNow()
+		if t := req.FormValue("time"); t != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, t); err != nil {
+				http.Error(rw, "time must be in RFC 3339 format", http.StatusBadRequest)
+				return
+			}
+		}
+
+		plans, err := planTrips(req.Context(), db, from, to, at)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(plans)
+	}
+}
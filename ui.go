@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the live map at /ui/, a static page that uses the rest of
+// the API from the browser.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func handleUI() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServerFS(sub))
+}
@@ -0,0 +1,238 @@
+// A live map of COTA routes, stops, and vehicles, served by the
+// cota-bus server itself at /ui/.  It only uses the server's public
+// API, relative to wherever the server is mounted.
+(function() {
+  var base_url = new URL("..", document.baseURI).href.replace(/\/$/, "");
+
+  var line_colors = ["#FF0000", "#0000FF", "#00AA00", "#FF7700", "#FF00FF", "#777700"];
+
+  var map = L.map("map").setView([39.965912, -82.999939], 12);
+  L.tileLayer("https://tile.openstreetmap.org/{z}/{x}/{y}.png", {
+    maxZoom: 19,
+    attribution: '&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a> contributors'
+  }).addTo(map);
+
+  var select = document.getElementById("route");
+  var status = document.getElementById("status");
+
+  var selected_route = "";
+  var route_layer = L.layerGroup().addTo(map);
+  var vehicle_layer = L.layerGroup().addTo(map);
+  var vehicle_markers = {};
+  var shape_colors = {};
+  var socket = null;
+
+  function getJSON(path) {
+    return fetch(base_url + path).then(function(resp) {
+      if (!resp.ok) {
+        throw new Error(resp.status + " " + resp.statusText);
+      }
+      return resp.json();
+    });
+  }
+
+  function escapeHTML(s) {
+    var div = document.createElement("div");
+    div.textContent = s;
+    return div.innerHTML;
+  }
+
+  function showError(err) {
+    status.textContent = "Error: " + err.message;
+  }
+
+  function populateRouteList() {
+    getJSON("/cota/routes").then(function(routes) {
+      routes.forEach(function(route) {
+        var option = document.createElement("option");
+        option.value = route.route_id;
+        option.textContent = route.short_name + " – " + route.long_name;
+        select.appendChild(option);
+      });
+
+      var route = new URLSearchParams(document.location.search).get("route");
+      if (route) {
+        select.value = route;
+        selectRoute();
+      }
+    }).catch(showError);
+  }
+
+  function selectRoute() {
+    selected_route = select.value;
+    route_layer.clearLayers();
+    vehicle_layer.clearLayers();
+    vehicle_markers = {};
+    shape_colors = {};
+    status.textContent = "";
+    if (socket !== null) {
+      socket.onclose = null;
+      socket.close();
+      socket = null;
+    }
+
+    var url = new URL(document.location);
+    if (selected_route) {
+      url.searchParams.set("route", selected_route);
+    } else {
+      url.searchParams.delete("route");
+    }
+    history.replaceState(null, "", url);
+
+    if (!selected_route) {
+      return;
+    }
+
+    fetchRouteData(selected_route);
+    connectVehicles(selected_route);
+  }
+
+  function fetchRouteData(route_id) {
+    var route = encodeURIComponent(route_id);
+
+    getJSON("/cota/shapes?route=" + route + "&fields=points&tolerance=low").then(function(shapes) {
+      if (route_id != selected_route) {
+        return;
+      }
+      var bounds = L.latLngBounds([]);
+      shapes.forEach(function(shape, i) {
+        var color = line_colors[i % line_colors.length];
+        shape_colors[shape.shape_id] = color;
+        var points = (shape.points || []).map(function(p) {
+          return [p.latitude, p.longitude];
+        });
+        L.polyline(points, { color: color, weight: 4, opacity: 0.6 }).addTo(route_layer);
+        points.forEach(function(p) { bounds.extend(p); });
+      });
+      if (bounds.isValid()) {
+        map.fitBounds(bounds);
+      }
+      for (var id in vehicle_markers) {
+        vehicle_markers[id].setStyle({ fillColor: shapeColor(vehicle_markers[id].vehicle.shape_id) });
+      }
+    }).catch(showError);
+
+    getJSON("/cota/stops?route=" + route).then(function(stops) {
+      if (route_id != selected_route) {
+        return;
+      }
+      stops.forEach(placeStop);
+    }).catch(showError);
+  }
+
+  function placeStop(stop) {
+    var marker = L.circleMarker([stop.latitude, stop.longitude], {
+      radius: 4,
+      color: "#333",
+      weight: 1,
+      fillColor: "#fff",
+      fillOpacity: 1
+    }).addTo(route_layer);
+
+    var title = "<h3>" + escapeHTML(stop.name) + "</h3>";
+    marker.bindPopup(title);
+    marker.on("click", function() {
+      marker.setPopupContent(title + "<p>Loading…</p>");
+      getJSON("/cota/predictions?stop=" + encodeURIComponent(stop.stop_id)).then(function(predictions) {
+        marker.setPopupContent(title + predictionList(predictions));
+      }).catch(function(err) {
+        marker.setPopupContent(title + "<p>" + escapeHTML(err.message) + "</p>");
+      });
+    });
+  }
+
+  function predictionList(predictions) {
+    if (predictions.length == 0) {
+      return "<p>No upcoming arrivals</p>";
+    }
+    predictions.sort(function(a, b) { return a.arrival_time - b.arrival_time; });
+
+    var html = "<ul>";
+    predictions.forEach(function(p) {
+      var minutes = Math.round(p.arrival_time / 60);
+      html += "<li>" + escapeHTML(p.route_id + " " + p.trip_headsign) + ": " +
+        (minutes < 1 ? "arriving" : minutes + " min") +
+        (p.scheduled ? " (scheduled)" : "") + "</li>";
+    });
+    return html + "</ul>";
+  }
+
+  function shapeColor(shape_id) {
+    return shape_colors[shape_id] || "#888";
+  }
+
+  function vehicleContent(v) {
+    var html = "<h3>" + escapeHTML(v.trip_headsign) + "</h3><p>Vehicle " + escapeHTML(v.name || v.vehicle_id) + "</p>";
+    if (v.delay !== null) {
+      var minutes = Math.round(v.delay / 60);
+      if (minutes > 0) {
+        html += '<p class="vehicle-late">' + minutes + " min late</p>";
+      } else if (minutes < 0) {
+        html += "<p>" + -minutes + " min early</p>";
+      } else {
+        html += "<p>On time</p>";
+      }
+    }
+    if (v.off_route) {
+      html += "<p>Off route</p>";
+    }
+    return html;
+  }
+
+  function updateVehicles(delta) {
+    delta.removed.forEach(function(id) {
+      if (vehicle_markers[id]) {
+        vehicle_layer.removeLayer(vehicle_markers[id]);
+        delete vehicle_markers[id];
+      }
+    });
+
+    delta.vehicles.forEach(function(v) {
+      var marker = vehicle_markers[v.vehicle_id];
+      if (!marker) {
+        marker = L.circleMarker([v.latitude, v.longitude], {
+          radius: 8,
+          color: "#000",
+          weight: 2,
+          fillOpacity: 0.9
+        }).bindPopup("").addTo(vehicle_layer);
+        vehicle_markers[v.vehicle_id] = marker;
+      }
+      marker.vehicle = v;
+      marker.setLatLng([v.latitude, v.longitude]);
+      marker.setStyle({ fillColor: shapeColor(v.shape_id) });
+      marker.setPopupContent(vehicleContent(v));
+    });
+
+    var count = Object.keys(vehicle_markers).length;
+    status.textContent = count + (count == 1 ? " bus" : " buses") + ", updated " + new Date().toLocaleTimeString();
+  }
+
+  // Vehicles come from the websocket, which sends every vehicle on the
+  // route when it connects and changes after that.  If it drops, the
+  // server resends everything on reconnect, so start over then.
+  function connectVehicles(route_id) {
+    var url = new URL(base_url + "/ws", document.location);
+    url.protocol = url.protocol == "https:" ? "wss:" : "ws:";
+    url.searchParams.set("route", route_id);
+
+    socket = new WebSocket(url);
+    socket.onmessage = function(event) {
+      updateVehicles(JSON.parse(event.data));
+    };
+    socket.onclose = function() {
+      socket = null;
+      status.textContent = "Disconnected, reconnecting…";
+      setTimeout(function() {
+        if (route_id == selected_route && socket === null) {
+          vehicle_layer.clearLayers();
+          vehicle_markers = {};
+          connectVehicles(route_id);
+        }
+      }, 5000);
+    };
+  }
+
+  select.addEventListener("change", selectRoute);
+  populateRouteList();
+})();
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// listenersEnv is how a process passes its listening sockets to
+	// the process replacing it, as addr=fd pairs separated by commas.
+	listenersEnv = "COTA_BUS_LISTENERS"
+
+	// upgradePIDEnv is the pid of the process being replaced, which
+	// the new process stops once it is serving.
+	upgradePIDEnv = "COTA_BUS_UPGRADE_PID"
+
+	// shutdownTimeout is how long in-flight requests have to finish
+	// when the server is stopped.
+	shutdownTimeout = 30 * time.Second
+)
+
+// upgrading is set once a new process has been started to take over
+// from this one.
+var upgrading bool
+
+// listeners are the sockets the server listens on, by address, to be
+// passed on when upgrading.
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]*os.File{}
+)
+
+// listen listens on addr, which is a TCP address or a unix socket
+// path prefixed with "unix:", or takes over the socket listening on it
+// from the process being upgraded.  Under systemd socket activation,
+// it uses the next socket systemd passed instead.
+func listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	if fd, ok := inheritedListeners()[addr]; ok {
+		f := os.NewFile(uintptr(fd), addr)
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inheriting listener for %s: %w", addr, err)
+		}
+		slog.Info("inherited listener", "addr", addr)
+	} else if f := nextSystemdListener(); f != nil {
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("using systemd socket for %s: %w", addr, err)
+		}
+		slog.Info("using systemd socket", "addr", addr, "socket", ln.Addr())
+	} else if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		var err error
+		if ln, err = listenUnix(path); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep a duplicate of the socket to pass on, since the listener's
+	// own is closed when the server shuts down.
+	if fl, ok := ln.(interface{ File() (*os.File, error) }); ok {
+		f, err := fl.File()
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		listenersMu.Lock()
+		listeners[addr] = f
+		listenersMu.Unlock()
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket left
+// behind by a server that didn't exit cleanly.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// An upgraded server keeps listening on the socket after this
+	// process closes it, so the socket must stay where it is.
+	ln.SetUnlinkOnClose(false)
+
+	// Let a proxy running as another user in the same group connect.
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func inheritedListeners() map[string]int {
+	out := map[string]int{}
+	for _, pair := range strings.Split(os.Getenv(listenersEnv), ",") {
+		// A socket path could contain "=", but an fd can't.
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			continue
+		}
+		if n, err := strconv.Atoi(pair[i+1:]); err == nil {
+			out[pair[:i]] = n
+		}
+	}
+	return out
+}
+
+// upgrade starts a new copy of the running executable, which may have
+// been replaced on disk since this process started, passing it the
+// sockets this process listens on.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listenersMu.Lock()
+	var files []*os.File
+	var pairs []string
+	for addr, f := range listeners {
+		// ExtraFiles start at fd 3 in the child.
+		pairs = append(pairs, fmt.Sprintf("%s=%d", addr, 3+len(files)))
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+
+	// WATCHDOG_PID names this process, so the new one mustn't see it.
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if name != listenersEnv && name != upgradePIDEnv && name != "WATCHDOG_PID" {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		listenersEnv+"="+strings.Join(pairs, ","),
+		upgradePIDEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	slog.Info("started upgraded server", "pid", cmd.Process.Pid)
+	upgrading = true
+
+	// The new process outlives this one, and is never waited for.
+	return cmd.Process.Release()
+}
+
+// finishUpgrade stops the process this one was upgraded from, now that
+// this one is serving on its sockets.
+func finishUpgrade() {
+	pid, err := strconv.Atoi(os.Getenv(upgradePIDEnv))
+	if err != nil {
+		return
+	}
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		err = p.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		slog.Warn("error stopping upgraded server", "pid", pid, "err", err)
+	}
+}
+
+// serve runs srv on its address until it fails or is told to stop.
+// SIGINT and SIGTERM stop the server gracefully, letting in-flight
+// requests finish.  SIGHUP upgrades it: a new copy of the executable
+// takes over the listening socket, and stops this one once it is
+// serving, so no connections are refused and realtime polling never
+// pauses.
+func serve(srv *http.Server, tlsOpts tlsOptions) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	ln, err := listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- tlsOpts.serve(srv, ln) }()
+	finishUpgrade()
+
+	// After an upgrade this is a new process, which systemd needs
+	// NotifyAccess=all to hear from.
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := upgrade(); err != nil {
+					slog.Error("error upgrading server", "err", err)
+				}
+				continue
+			}
+
+			slog.Info("shutting down server", "signal", sig)
+			if !upgrading {
+				sdNotify("STOPPING=1")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(ctx)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type validationIssue struct {
+	Severity string   `json:"severity"`
+	Check    string   `json:"check"`
+	File     string   `json:"file"`
+	Message  string   `json:"message"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples,omitempty"`
+}
+
+// validationReport is the outcome of validating one static GTFS load.
+// Errors and Warnings count offending records, not issues.
+type validationReport struct {
+	Time     time.Time         `json:"time"`
+	Source   string            `json:"source"`
+	Errors   int               `json:"errors"`
+	Warnings int               `json:"warnings"`
+	Rejected bool              `json:"rejected"`
+	Issues   []validationIssue `json:"issues"`
+}
+
+func (r *validationReport) add(severity, check, file, message string, examples []string, count int) {
+	r.Issues = append(r.Issues, validationIssue{
+		Severity: severity,
+		Check:    check,
+		File:     file,
+		Message:  message,
+		Count:    count,
+		Examples: examples,
+	})
+	if severity == "error" {
+		r.Errors += count
+	} else {
+		r.Warnings += count
+	}
+}
+
+// gtfsRequiredColumns are the columns the GTFS reference requires of
+// each file we rely on.  The files themselves are required too, except
+// that a feed needs only one of calendar and calendar_dates.
+var gtfsRequiredColumns = map[string][]string{
+	"agency":         {"agency_name", "agency_url", "agency_timezone"},
+	"routes":         {"route_id", "route_type"},
+	"trips":          {"route_id", "service_id", "trip_id"},
+	"stop_times":     {"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"},
+	"stops":          {"stop_id", "stop_lat", "stop_lon"},
+	"calendar":       {"service_id", "start_date", "end_date"},
+	"calendar_dates": {"service_id", "date", "exception_type"},
+}
+
+// gtfsSeconds is a SQL expression converting the H:MM:SS or HH:MM:SS
+// time in column c to seconds, allowing hours past 24.
+func gtfsSeconds(c string) string {
+	return fmt.Sprintf(`(CAST(substr(%[1]s, 1, instr(%[1]s, ':') - 1) AS INTEGER) * 3600
+		+ CAST(substr(%[1]s, instr(%[1]s, ':') + 1, 2) AS INTEGER) * 60
+		+ CAST(substr(%[1]s, -2) AS INTEGER))`, c)
+}
+
+// validationCheck finds offending records with a query that returns
+// one identifying string per record.  Table names in the query are
+// written as {table} and replaced with the staging table.
+type validationCheck struct {
+	Severity string
+	Name     string
+	File     string
+	Message  string
+	Tables   []string
+	Query    string
+}
+
+var validationChecks = []validationCheck{
+	{
+		Severity: "error",
+		Name:     "trip_route",
+		File:     "trips.txt",
+		Message:  "trip references a route_id not in routes.txt",
+		Tables:   []string{"trips", "routes"},
+		Query:    `SELECT trip_id FROM {trips} WHERE route_id NOT IN (SELECT route_id FROM {routes})`,
+	},
+	{
+		Severity: "error",
+		Name:     "stop_time_trip",
+		File:     "stop_times.txt",
+		Message:  "stop time references a trip_id not in trips.txt",
+		Tables:   []string{"stop_times", "trips"},
+		Query:    `SELECT DISTINCT trip_id FROM {stop_times} WHERE trip_id NOT IN (SELECT trip_id FROM {trips})`,
+	},
+	{
+		Severity: "error",
+		Name:     "stop_time_stop",
+		File:     "stop_times.txt",
+		Message:  "stop time references a stop_id not in stops.txt",
+		Tables:   []string{"stop_times", "stops"},
+		Query:    `SELECT DISTINCT stop_id FROM {stop_times} WHERE stop_id NOT IN (SELECT stop_id FROM {stops})`,
+	},
+	{
+		Severity: "error",
+		Name:     "stop_coordinates",
+		File:     "stops.txt",
+		Message:  "stop has a missing or out of range latitude or longitude",
+		Tables:   []string{"stops"},
+		Query: `SELECT stop_id FROM {stops}
+			WHERE location_type IN ('', '0', '1', '2')
+			  AND (stop_lat = '' OR stop_lon = ''
+			       OR CAST(stop_lat AS REAL) NOT BETWEEN -90 AND 90
+			       OR CAST(stop_lon AS REAL) NOT BETWEEN -180 AND 180
+			       OR (CAST(stop_lat AS REAL) = 0 AND CAST(stop_lon AS REAL) = 0))`,
+	},
+	{
+		Severity: "error",
+		Name:     "stop_time_order",
+		File:     "stop_times.txt",
+		Message:  "trip has arrival or departure times that go backwards",
+		Tables:   []string{"stop_times"},
+		Query: `WITH st AS (
+			    SELECT trip_id,
+			           ` + gtfsSeconds("arrival_time") + ` AS arr,
+			           ` + gtfsSeconds("departure_time") + ` AS dep,
+			           LAG(` + gtfsSeconds("departure_time") + `) OVER (
+			               PARTITION BY trip_id ORDER BY CAST(stop_sequence AS INTEGER)
+			           ) AS prev_dep
+			    FROM {stop_times}
+			    WHERE arrival_time != '' AND departure_time != ''
+			)
+			SELECT DISTINCT trip_id FROM st WHERE dep < arr OR arr < prev_dep`,
+	},
+	{
+		Severity: "warning",
+		Name:     "trip_without_stop_times",
+		File:     "trips.txt",
+		Message:  "trip has no stop times",
+		Tables:   []string{"trips", "stop_times"},
+		Query:    `SELECT trip_id FROM {trips} WHERE trip_id NOT IN (SELECT trip_id FROM {stop_times})`,
+	},
+}
+
+// validateStaging checks the staging tables just imported by a load.
+func validateStaging(ctx context.Context, db *sqlx.DB, src string, loaded []string) (*validationReport, error) {
+	ctx, span := tracer.Start(ctx, "validate gtfs")
+	defer span.End()
+
+	report := &validationReport{Time: time.Now(), Source: redactURL(src), Issues: []validationIssue{}}
+
+	staged := map[string]bool{}
+	for _, t := range loaded {
+		staged[t] = true
+	}
+	// Checks can only run against tables that have the columns they
+	// query.
+	usable := map[string]bool{}
+	for _, t := range gtfsTables {
+		required, ok := gtfsRequiredColumns[t]
+		if !ok {
+			continue
+		}
+		if !staged[t] {
+			if t == "calendar" || t == "calendar_dates" {
+				continue
+			}
+			report.add("error", "missing_file", t+".txt", "required file is missing", nil, 1)
+			continue
+		}
+
+		var have []string
+		if err := db.SelectContext(ctx, &have, `SELECT name FROM pragma_table_info(?)`, stagingTable(t)); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		var missing []string
+		for _, c := range required {
+			if !slices.Contains(have, c) {
+				missing = append(missing, c)
+			}
+		}
+		if len(missing) > 0 {
+			report.add("error", "missing_column", t+".txt", "required column is missing", missing, len(missing))
+			continue
+		}
+		usable[t] = true
+	}
+	if !staged["calendar"] && !staged["calendar_dates"] {
+		report.add("error", "missing_file", "calendar.txt", "one of calendar.txt and calendar_dates.txt is required", nil, 1)
+	}
+
+	for _, c := range validationChecks {
+		runnable := true
+		q := c.Query
+		for _, t := range c.Tables {
+			runnable = runnable && usable[t]
+			q = strings.ReplaceAll(q, "{"+t+"}", stagingTable(t))
+		}
+		if !runnable {
+			continue
+		}
+
+		var ids []string
+		if err := db.SelectContext(ctx, &ids, q); err != nil {
+			endSpan(span, err)
+			return nil, fmt.Errorf("validation check %s: %w", c.Name, err)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		examples := ids
+		if len(examples) > 5 {
+			examples = examples[:5]
+		}
+		report.add(c.Severity, c.Name, c.File, c.Message, examples, len(ids))
+	}
+
+	return report, nil
+}
+
+func handleValidation(loader *gtfsLoader) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		report := loader.validationReport()
+		if report == nil {
+			writeError(rw, http.StatusNotFound, "No GTFS load has been validated yet")
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.Encode(report)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// voiceDepartures is how many arrivals a voice answer reads out.
+const voiceDepartures = 3
+
+// voiceRequest is the part of an Alexa skill request or a Dialogflow
+// (Google Assistant) fulfillment request that handleVoice reads.  Both
+// carry a stop slot, holding the code posted at the stop or its
+// stop_id, and optionally a route slot.
+type voiceRequest struct {
+	// Alexa
+	Request *struct {
+		Type   string `json:"type"`
+		Intent struct {
+			Slots map[string]struct {
+				Value string `json:"value"`
+			} `json:"slots"`
+		} `json:"intent"`
+	} `json:"request"`
+
+	// Dialogflow
+	QueryResult *struct {
+		Parameters     map[string]interface{} `json:"parameters"`
+		OutputContexts []struct {
+			Parameters map[string]interface{} `json:"parameters"`
+		} `json:"outputContexts"`
+	} `json:"queryResult"`
+}
+
+func (r *voiceRequest) slot(name string) string {
+	switch {
+	case r.Request != nil:
+		return strings.TrimSpace(r.Request.Intent.Slots[name].Value)
+	case r.QueryResult != nil:
+		// Dialogflow sends numbers as numbers, which loses leading
+		// zeros in stop codes, but keeps what was said under
+		// name.original in its output contexts.
+		for _, c := range r.QueryResult.OutputContexts {
+			if v, ok := c.Parameters[name+".original"].(string); ok && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+		switch v := r.QueryResult.Parameters[name].(type) {
+		case string:
+			return strings.TrimSpace(v)
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// handleVoice answers "when is the next bus at stop X" for voice
+// assistants, replying in whichever of the Alexa or Dialogflow webhook
+// formats the request came in.  It doesn't verify Alexa's request
+// signatures, so it should sit behind something that does if the skill
+// is published.
+func handleVoice(db *sqlx.DB, stops *stopCache) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var vr voiceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 64*1024)).Decode(&vr); err != nil {
+			http.Error(rw, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if vr.Request == nil && vr.QueryResult == nil {
+			http.Error(rw, "Not an Alexa or Dialogflow request", http.StatusBadRequest)
+			return
+		}
+
+		var speech string
+		if vr.Request != nil && vr.Request.Type == "LaunchRequest" {
+			speech = "Which stop? You can say the stop number posted on the sign."
+		} else {
+			var err error
+			speech, err = voiceAnswer(req, db, stops, vr.slot("stop"), vr.slot("route"))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		if vr.Request != nil {
+			enc.Encode(map[string]interface{}{
+				"version": "1.0",
+				"response": map[string]interface{}{
+					"outputSpeech": map[string]string{
+						"type": "PlainText",
+						"text": speech,
+					},
+					"shouldEndSession": true,
+				},
+			})
+			return
+		}
+		enc.Encode(map[string]string{"fulfillmentText": speech})
+	}
+}
+
+// voiceAnswer is the sentence read out for the next arrivals at stop,
+// which may be a stop code or a stop_id, optionally only for route.
+func voiceAnswer(req *http.Request, db *sqlx.DB, stops *stopCache, stopArg, route string) (string, error) {
+	if stopArg == "" {
+		return "Which stop? You can say the stop number posted on the sign.", nil
+	}
+
+	var s stop
+	if byCode := stops.byCode(stopArg); len(byCode) > 0 {
+		s = byCode[0]
+	} else if byID, ok := stops.get(stopArg); ok {
+		s = byID
+	} else {
+		return fmt.Sprintf("I couldn't find stop %s.", stopArg), nil
+	}
+
+	now := feedNow()
+	deps, err := departures(req.Context(), db, s.ID, now, timeWindow{from: now})
+	if err != nil {
+		return "", err
+	}
+	if route != "" {
+		matching := deps[:0]
+		for _, d := range deps {
+			if strings.EqualFold(d.RouteShortName, route) || d.RouteID == route {
+				matching = append(matching, d)
+			}
+		}
+		deps = matching
+	}
+
+	if len(deps) == 0 {
+		if route != "" {
+			return fmt.Sprintf("There are no upcoming route %s buses at %s.", route, s.Name), nil
+		}
+		return fmt.Sprintf("There are no upcoming buses at %s.", s.Name), nil
+	}
+	if len(deps) > voiceDepartures {
+		deps = deps[:voiceDepartures]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "At %s, ", s.Name)
+	for i, d := range deps {
+		if i > 0 {
+			b.WriteString(", then ")
+		}
+		fmt.Fprintf(&b, "route %s to %s %s", d.RouteShortName, d.TripHeadsign, voiceWhen(d))
+	}
+	b.WriteString(".")
+	return b.String(), nil
+}
+
+func voiceWhen(d departure) string {
+	minutes := int(d.ArrivalTime / 60)
+	when := "is arriving now"
+	switch {
+	case minutes == 1:
+		when = "arrives in 1 minute"
+	case minutes > 1:
+		when = fmt.Sprintf("arrives in %d minutes", minutes)
+	}
+	if d.Source == "scheduled" {
+		when += " according to the schedule"
+	}
+	return when
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVoiceSlotDialogflow(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		// Large codes mustn't come out in exponent form.
+		{`{"queryResult":{"parameters":{"stop":12345678}}}`, "12345678"},
+		{`{"queryResult":{"parameters":{"stop":" HIGBRON "}}}`, "HIGBRON"},
+		// What was said keeps the leading zero the number drops.
+		{`{"queryResult":{"parameters":{"stop":123},"outputContexts":[{"parameters":{"stop":123,"stop.original":"0123"}}]}}`, "0123"},
+		{`{"queryResult":{"parameters":{"route":2}}}`, ""},
+	}
+	for _, tt := range tests {
+		var vr voiceRequest
+		if err := json.Unmarshal([]byte(tt.body), &vr); err != nil {
+			t.Fatal(err)
+		}
+		if got := vr.slot("stop"); got != tt.want {
+			t.Errorf("%s: slot(stop) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxWebhookThreshold bounds how many minutes ahead a webhook may
+	// ask to be told about an arrival.
+	maxWebhookThreshold = 60
+
+	// webhookTimeout is how long a webhook's server has to respond.
+	webhookTimeout = 10 * time.Second
+
+	// webhookTTL is how long a registration lasts.  Clients that
+	// want to keep being notified register again.
+	webhookTTL = 24 * time.Hour
+
+	// maxWebhooksPerClient bounds how many webhooks one client address
+	// can have registered, so one client can't take every slot.
+	maxWebhooksPerClient = 10
+
+	// maxWebhookDeliveries bounds how many notices are being POSTed
+	// at once.  Notices past that are dropped.
+	maxWebhookDeliveries = 16
+)
+
+var (
+	errTooManyWebhooks       = errors.New("too many webhooks registered")
+	errTooManyClientWebhooks = errors.New("too many webhooks registered by this client")
+)
+
+// nonPublicPrefixes are ranges that aren't caught by netip.Addr's
+// methods but still don't belong to anyone on the internet.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// isPublicAddr reports whether addr is a public unicast address, one
+// webhooks may be delivered to.  Anything else could reach the server
+// itself, its admin port, cloud metadata services, or the private
+// network it runs on.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns the client webhooks are delivered with.
+// Addresses are checked as they are dialed, after DNS resolution, so a
+// name that resolves to a private address is refused too.  Redirects
+// aren't followed, since they could point anywhere, and proxies aren't
+// used, since the proxy's address is the one that would be checked.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(ap.Addr()) {
+				return fmt.Errorf("webhook address %s is not public", ap.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhook is a client's request to be told when a bus on a route is
+// within some number of minutes of a stop.
+type webhook struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	StopID    string `json:"stop_id"`
+	RouteID   string `json:"route_id"`
+	Threshold int    `json:"threshold_minutes"`
+
+	// ExpiresAt is when the registration lapses, webhookTTL after it
+	// was made.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// owner is the address of the client that registered it.
+	owner string
+}
+
+// webhookNotice is the body POSTed to a webhook's URL.
+type webhookNotice struct {
+	WebhookID   string    `json:"webhook_id"`
+	StopID      string    `json:"stop_id"`
+	RouteID     string    `json:"route_id"`
+	TripID      string    `json:"trip_id"`
+	Time        time.Time `json:"time"`
+	ArrivalTime uint64    `json:"arrival_time"`
+}
+
+// webhookRegistry holds the registered webhooks, and which trips each
+// has already been told about so a trip only triggers a webhook once.
+// Registrations are kept in memory and don't survive a restart.
+type webhookRegistry struct {
+	db      *sqlx.DB
+	max     int
+	client  *http.Client
+	proxies proxyConfig
+
+	// deliveries holds a slot for each notice being POSTed.
+	deliveries chan struct{}
+
+	mu       sync.Mutex
+	hooks    map[string]*webhook
+	notified map[string]map[string]bool
+}
+
+func newWebhookRegistry(db *sqlx.DB, max int, proxies proxyConfig) *webhookRegistry {
+	return &webhookRegistry{
+		db:         db,
+		max:        max,
+		client:     newWebhookClient(),
+		proxies:    proxies,
+		deliveries: make(chan struct{}, maxWebhookDeliveries),
+		hooks:      map[string]*webhook{},
+		notified:   map[string]map[string]bool{},
+	}
+}
+
+func newWebhookID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (r *webhookRegistry) add(w webhook, owner string, now time.Time) (webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+	if len(r.hooks) >= r.max {
+		return w, errTooManyWebhooks
+	}
+	var owned int
+	for _, h := range r.hooks {
+		if h.owner == owner {
+			owned++
+		}
+	}
+	if owned >= maxWebhooksPerClient {
+		return w, errTooManyClientWebhooks
+	}
+
+	w.ID = newWebhookID()
+	w.ExpiresAt = now.Add(webhookTTL)
+	w.owner = owner
+	r.hooks[w.ID] = &w
+	return w, nil
+}
+
+// expire removes the webhooks whose registrations have lapsed.  Must
+// be called with r.mu held.
+func (r *webhookRegistry) expire(now time.Time) {
+	for id, w := range r.hooks {
+		if !now.Before(w.ExpiresAt) {
+			delete(r.hooks, id)
+			delete(r.notified, id)
+		}
+	}
+}
+
+func (r *webhookRegistry) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.hooks[id]; !ok {
+		return false
+	}
+	delete(r.hooks, id)
+	delete(r.notified, id)
+	return true
+}
+
+func (r *webhookRegistry) run(events *eventBus) {
+	ch := events.subscribe(predictionsUpdated)
+	defer events.unsubscribe(ch)
+
+	for range ch {
+		if err := r.check(context.Background(), feedNow()); err != nil {
+			slog.Error("error checking webhooks", "err", err)
+		}
+	}
+}
+
+// check notifies every webhook with a predicted arrival that has come
+// within its threshold since the last check.
+func (r *webhookRegistry) check(ctx context.Context, now time.Time) error {
+	r.mu.Lock()
+	r.expire(time.Now())
+	n := len(r.hooks)
+	r.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+
+	var rows []struct {
+		TripID      string `db:"trip_id"`
+		StopID      string `db:"stop_id"`
+		RouteID     string `db:"route_id"`
+		ArrivalTime int64  `db:"arrival_time"`
+	}
+	const q = `SELECT stu.trip_id, stu.stop_id, trips.route_id, stu.arrival_time
+		   FROM stop_time_updates AS stu
+		   INNER JOIN trips ON stu.trip_id = trips.trip_id
+		   WHERE stu.arrival_time BETWEEN ? AND ?`
+	end := now.Add(maxWebhookThreshold * time.Minute)
+	if err := dbSelect(ctx, r.db, "webhook predictions", &rows, q, now.Unix(), end.Unix()); err != nil {
+		return err
+	}
+
+	var notices []webhookNotice
+	var urls []string
+
+	r.mu.Lock()
+	for id, w := range r.hooks {
+		notified := map[string]bool{}
+		for _, row := range rows {
+			if row.StopID != w.StopID || row.RouteID != w.RouteID {
+				continue
+			}
+			// Remember the trip for as long as it's predicted, so it
+			// isn't announced again if its prediction slips.
+			notified[row.TripID] = r.notified[id][row.TripID]
+
+			at := time.Unix(row.ArrivalTime, 0)
+			if notified[row.TripID] || at.Sub(now) > time.Duration(w.Threshold)*time.Minute {
+				continue
+			}
+			notified[row.TripID] = true
+			notices = append(notices, webhookNotice{
+				WebhookID:   id,
+				StopID:      row.StopID,
+				RouteID:     row.RouteID,
+				TripID:      row.TripID,
+				Time:        at,
+				ArrivalTime: uint64(at.Sub(now) / time.Second),
+			})
+			urls = append(urls, w.URL)
+		}
+		r.notified[id] = notified
+	}
+	r.mu.Unlock()
+
+	for i := range notices {
+		select {
+		case r.deliveries <- struct{}{}:
+			go func() {
+				defer func() { <-r.deliveries }()
+				r.post(urls[i], notices[i])
+			}()
+		default:
+			slog.Warn("too many webhook deliveries in progress, dropping notice", "webhook", notices[i].WebhookID)
+		}
+	}
+	return nil
+}
+
+func (r *webhookRegistry) post(u string, n webhookNotice) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("error encoding webhook notice", "err", err)
+		return
+	}
+
+	resp, err := r.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("error calling webhook", "webhook", n.WebhookID, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("webhook failed", "webhook", n.WebhookID, "status", resp.Status)
+	}
+}
+
+func handleAddWebhook(hooks *webhookRegistry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var w webhook
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 4096)).Decode(&w); err != nil {
+			http.Error(rw, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			http.Error(rw, "url must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+		// Names are checked again when the notice is delivered, once
+		// they have been resolved.
+		if addr, err := netip.ParseAddr(u.Hostname()); (err == nil && !isPublicAddr(addr)) || u.Hostname() == "localhost" {
+			http.Error(rw, "url must be on a public host", http.StatusBadRequest)
+			return
+		}
+		if w.StopID == "" || w.RouteID == "" {
+			http.Error(rw, "Missing stop_id or route_id", http.StatusBadRequest)
+			return
+		}
+		if w.Threshold <= 0 || w.Threshold > maxWebhookThreshold {
+			http.Error(rw, "threshold_minutes must be between 1 and 60", http.StatusBadRequest)
+			return
+		}
+
+		w, err = hooks.add(w, hooks.proxies.clientIP(req), time.Now())
+		if errors.Is(err, errTooManyClientWebhooks) {
+			http.Error(rw, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		enc := json.NewEncoder(rw)
+		enc.Encode(w)
+	}
+}
+
+func handleDeleteWebhook(hooks *webhookRegistry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !hooks.remove(req.PathValue("id")) {
+			http.Error(rw, "No such webhook", http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
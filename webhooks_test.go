@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// TestWebhookClientRefusesLoopback checks that the address is checked
+// when it is dialed, not only when the webhook is registered.
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	resp, err := newWebhookClient().Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("POST to a loopback address succeeded")
+	}
+	if called {
+		t.Error("loopback server was called")
+	}
+}
+
+func TestAddWebhookRejectsPrivateHosts(t *testing.T) {
+	hooks := newWebhookRegistry(nil, 10, proxyConfig{})
+	for _, u := range []string{
+		"http://127.0.0.1:18080/admin/reload",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/",
+		"http://localhost/",
+	} {
+		body := `{"url":"` + u + `","stop_id":"HIGBRON","route_id":"2","threshold_minutes":5}`
+		rec := httptest.NewRecorder()
+		handleAddWebhook(hooks).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cota/webhooks", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("registering %s: status = %d, want 400", u, rec.Code)
+		}
+	}
+}
+
+func TestWebhookLimits(t *testing.T) {
+	now := time.Now()
+	hooks := newWebhookRegistry(nil, maxWebhooksPerClient+1, proxyConfig{})
+	w := webhook{URL: "https://example.com/hook", StopID: "HIGBRON", RouteID: "2", Threshold: 5}
+
+	for range maxWebhooksPerClient {
+		if _, err := hooks.add(w, "198.51.100.7", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hooks.add(w, "198.51.100.7", now); err != errTooManyClientWebhooks {
+		t.Errorf("add past the per-client limit: err = %v, want %v", err, errTooManyClientWebhooks)
+	}
+	if _, err := hooks.add(w, "203.0.113.9", now); err != nil {
+		t.Errorf("add from another client: %v", err)
+	}
+	if _, err := hooks.add(w, "192.0.2.1", now); err != errTooManyWebhooks {
+		t.Errorf("add past the limit: err = %v, want %v", err, errTooManyWebhooks)
+	}
+
+	// Once registrations lapse, their slots are free again.
+	if _, err := hooks.add(w, "198.51.100.7", now.Add(webhookTTL)); err != nil {
+		t.Errorf("add after registrations expired: %v", err)
+	}
+}
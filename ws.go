@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/websocket"
+)
+
+// vehicleDelta is what gets pushed to websocket clients.  The first
+// message after connecting contains every vehicle; subsequent messages
+// only contain vehicles whose data changed and the IDs of vehicles
+// that disappeared from the feed.
+type vehicleDelta struct {
+	Vehicles []vehicle `json:"vehicles"`
+	Removed  []string  `json:"removed"`
+}
+
+// vehicleHub serves websocket clients, waking them up whenever new
+// vehicle positions have been written to the database.
+type vehicleHub struct {
+	db     *sqlx.DB
+	shapes *shapeCache
+	events *eventBus
+	cors   corsPolicy
+}
+
+func newVehicleHub(db *sqlx.DB, shapes *shapeCache, events *eventBus, cors corsPolicy) *vehicleHub {
+	return &vehicleHub{
+		db:     db,
+		shapes: shapes,
+		events: events,
+		cors:   cors,
+	}
+}
+
+func (h *vehicleHub) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Browsers don't apply CORS to websockets, so enforce the same
+	// origin policy as the rest of the API during the handshake.
+	// Non-browser clients don't send an Origin and are always allowed.
+	s := websocket.Server{
+		Handler: h.serveConn,
+		Handshake: func(cfg *websocket.Config, req *http.Request) error {
+			origin := req.Header.Get("Origin")
+			if origin != "" && h.cors.allowOrigin(origin) == "" {
+				return errors.New("origin not allowed")
+			}
+			return nil
+		},
+	}
+	s.ServeHTTP(rw, req)
+}
+
+func (h *vehicleHub) serveConn(ws *websocket.Conn) {
+	defer ws.Close()
+
+	route := ws.Request().FormValue("route")
+
+	// A reload can change the trips vehicles are on, so resend then
+	// too.
+	wakeup := h.events.subscribe(vehiclesUpdated, staticReloaded)
+	defer h.events.unsubscribe(wakeup)
+
+	// We never expect anything from the client, but we have to read
+	// to notice when the connection goes away.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	last := map[string]vehicle{}
+	for {
+		vehicles, err := selectVehicles(ws.Request().Context(), h.db, h.shapes, route)
+		if err != nil {
+			slog.Error("error selecting vehicles for websocket", "err", err)
+		} else {
+			delta := diffVehicles(last, vehicles)
+			if len(delta.Vehicles) > 0 || len(delta.Removed) > 0 || len(last) == 0 {
+				if err := websocket.JSON.Send(ws, delta); err != nil {
+					return
+				}
+			}
+
+			last = map[string]vehicle{}
+			for _, v := range vehicles {
+				last[v.ID] = v
+			}
+		}
+
+		select {
+		case <-wakeup:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func diffVehicles(last map[string]vehicle, vehicles []vehicle) vehicleDelta {
+	delta := vehicleDelta{
+		Vehicles: []vehicle{},
+		Removed:  []string{},
+	}
+
+	seen := map[string]bool{}
+	for _, v := range vehicles {
+		seen[v.ID] = true
+		if old, ok := last[v.ID]; !ok || !old.equal(v) {
+			delta.Vehicles = append(delta.Vehicles, v)
+		}
+	}
+
+	for id := range last {
+		if !seen[id] {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+
+	return delta
+}